@@ -0,0 +1,175 @@
+package olm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// EncryptedFileVersion is the version of the attachment encryption scheme.
+const EncryptedFileVersion = "v2"
+
+// JSONWebKey is the AES-256-CTR key of an encrypted attachment in JSON Web Key
+// format.  K is the key in unpadded url-safe base64.
+type JSONWebKey struct {
+	KeyType     string   `json:"kty"`
+	KeyOps      []string `json:"key_ops"`
+	Algorithm   string   `json:"alg"`
+	K           string   `json:"k"`
+	Extractable bool     `json:"ext"`
+}
+
+// EncryptedFile describes an encrypted attachment as in the "file" field of
+// an encrypted m.room.message event.  The IV and the hashes are in unpadded
+// base64.
+type EncryptedFile struct {
+	URL     string            `json:"url"`
+	Key     JSONWebKey        `json:"key"`
+	IV      string            `json:"iv"`
+	Hashes  map[string]string `json:"hashes"`
+	Version string            `json:"v"`
+}
+
+// attachmentReader encrypts or decrypts a stream with AES-256-CTR and hashes
+// its cipher-text with SHA-256.
+type attachmentReader struct {
+	r       io.Reader
+	stream  cipher.Stream
+	hash    hash.Hash
+	encrypt bool
+	// done is called with the hash of the cipher-text once r returns EOF.
+	done func(sum []byte) error
+	err  error
+}
+
+// Read implements io.Reader.
+func (a *attachmentReader) Read(p []byte) (int, error) {
+	if a.err != nil {
+		return 0, a.err
+	}
+	n, err := a.r.Read(p)
+	if n > 0 {
+		if !a.encrypt {
+			a.hash.Write(p[:n])
+		}
+		a.stream.XORKeyStream(p[:n], p[:n])
+		if a.encrypt {
+			a.hash.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		if doneErr := a.done(a.hash.Sum(nil)); doneErr != nil {
+			err = doneErr
+		}
+	}
+	if err != nil {
+		a.err = err
+	}
+	return n, err
+}
+
+// EncryptAttachment encrypts the attachment read from r with a new random
+// key.  Returns a reader for the cipher-text, to be uploaded to the media
+// repository, and the description of the encrypted file without URL.  The
+// attachment is encrypted while it is read, so the "sha256" hash is only
+// added to Hashes once the returned reader has been read up to EOF.
+func EncryptAttachment(r io.Reader) (io.Reader, EncryptedFile) {
+	key := make([]byte, 32)
+	_, err := crand.Read(key)
+	if err != nil {
+		panic("Couldn't get enough randomness from crypto/rand")
+	}
+	iv := make([]byte, aes.BlockSize)
+	_, err = crand.Read(iv[:8])
+	if err != nil {
+		panic("Couldn't get enough randomness from crypto/rand")
+	}
+	file := EncryptedFile{
+		Key: JSONWebKey{
+			KeyType:     "oct",
+			KeyOps:      []string{"encrypt", "decrypt"},
+			Algorithm:   "A256CTR",
+			K:           base64.RawURLEncoding.EncodeToString(key),
+			Extractable: true,
+		},
+		IV:      base64.RawStdEncoding.EncodeToString(iv),
+		Hashes:  map[string]string{},
+		Version: EncryptedFileVersion,
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	hashes := file.Hashes
+	return &attachmentReader{
+		r:       r,
+		stream:  cipher.NewCTR(block, iv),
+		hash:    sha256.New(),
+		encrypt: true,
+		done: func(sum []byte) error {
+			hashes["sha256"] = base64.RawStdEncoding.EncodeToString(sum)
+			return nil
+		},
+	}, file
+}
+
+// DecryptAttachment decrypts the attachment described by file whose
+// cipher-text is read from r.  Returns a reader for the plain-text.  The
+// attachment is decrypted while it is read, and its hash is checked when r
+// returns EOF, so the plain-text mustn't be trusted before the returned reader
+// returned EOF.  If the hash doesn't match the reader returns the error
+// "BAD_MESSAGE_MAC" instead of EOF.  Returns error if file isn't a valid
+// description of an encrypted file.  If the key, IV or hash isn't valid
+// base64 the error will be "INVALID_BASE64".
+func DecryptAttachment(r io.Reader, file EncryptedFile) (io.Reader, error) {
+	if file.Version != EncryptedFileVersion {
+		return nil, fmt.Errorf("Unsupported encrypted file version %q", file.Version)
+	}
+	if file.Key.KeyType != "oct" || file.Key.Algorithm != "A256CTR" {
+		return nil, fmt.Errorf("Unsupported key type %q or algorithm %q", file.Key.KeyType, file.Key.Algorithm)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(file.Key.K, "="))
+	if err != nil {
+		return nil, fmt.Errorf("INVALID_BASE64")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Key must be 32 bytes, got %d", len(key))
+	}
+	iv, err := decodeBase64(file.IV)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("IV must be %d bytes, got %d", aes.BlockSize, len(iv))
+	}
+	hashString, ok := file.Hashes["sha256"]
+	if !ok {
+		return nil, fmt.Errorf("Encrypted file has no sha256 hash")
+	}
+	expected, err := decodeBase64(hashString)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &attachmentReader{
+		r:      r,
+		stream: cipher.NewCTR(block, iv),
+		hash:   sha256.New(),
+		done: func(sum []byte) error {
+			if !hmac.Equal(sum, expected) {
+				return fmt.Errorf("BAD_MESSAGE_MAC")
+			}
+			return nil
+		},
+	}, nil
+}
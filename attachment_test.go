@@ -0,0 +1,107 @@
+package olm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestDecryptAttachmentVector(t *testing.T) {
+	ciphertext, _ := base64.StdEncoding.DecodeString("LQcXvUjYdQThmqKJ8atI0MTWLM49Q1s=")
+	var file EncryptedFile
+	err := json.Unmarshal([]byte(`{
+		"url": "mxc://example.org/abcd",
+		"key": {"kty": "oct", "key_ops": ["encrypt", "decrypt"], "alg": "A256CTR", "k": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8", "ext": true},
+		"iv": "AQIDBAUGBwgAAAAAAAAAAA",
+		"hashes": {"sha256": "AyE9lTUf4shRS0qmTU89aGrHgCChE/slFzIj4N7zrYc"},
+		"v": "v2"
+	}`), &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := DecryptAttachment(bytes.NewReader(ciphertext), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "Hello, encrypted world!" {
+		t.Fatal("Wrong plaintext", string(plaintext))
+	}
+
+	ciphertext[0] ^= 1
+	r, err = DecryptAttachment(bytes.NewReader(ciphertext), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err == nil || err.Error() != "BAD_MESSAGE_MAC" {
+		t.Fatal("Expected BAD_MESSAGE_MAC, got", err)
+	}
+
+	bad := file
+	bad.Version = "v1"
+	if _, err := DecryptAttachment(bytes.NewReader(ciphertext), bad); err == nil {
+		t.Fatal("Version v1 should be rejected")
+	}
+	bad = file
+	bad.Key.K = "AAECAwQ"
+	if _, err := DecryptAttachment(bytes.NewReader(ciphertext), bad); err == nil {
+		t.Fatal("Short key should be rejected")
+	}
+	bad = file
+	bad.IV = "!!"
+	if _, err := DecryptAttachment(bytes.NewReader(ciphertext), bad); err == nil || err.Error() != "INVALID_BASE64" {
+		t.Fatal("Expected INVALID_BASE64, got", err)
+	}
+	bad = file
+	bad.Hashes = nil
+	if _, err := DecryptAttachment(bytes.NewReader(ciphertext), bad); err == nil {
+		t.Fatal("File without hash should be rejected")
+	}
+}
+
+func TestAttachment(t *testing.T) {
+	const size = 8 << 20
+	plainHash := sha256.New()
+	r, file := EncryptAttachment(io.TeeReader(io.LimitReader(rand.New(rand.NewSource(1)), size), plainHash))
+	if _, ok := file.Hashes["sha256"]; ok {
+		t.Fatal("Hash shouldn't be known before the attachment was read")
+	}
+	var ciphertext bytes.Buffer
+	n, err := io.Copy(&ciphertext, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size {
+		t.Fatal("Cipher-text should be as long as the plain-text, got", n)
+	}
+	if _, ok := file.Hashes["sha256"]; !ok {
+		t.Fatal("Hash should be known once the attachment was read")
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(data))
+
+	r, err = DecryptAttachment(&ciphertext, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decryptedHash := sha256.New()
+	n, err = io.Copy(decryptedHash, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size || !bytes.Equal(decryptedHash.Sum(nil), plainHash.Sum(nil)) {
+		t.Fatal("Decrypted attachment doesn't match")
+	}
+}
@@ -0,0 +1,209 @@
+package olm
+
+import "fmt"
+
+// OlmAccount is an Account of a Backend.  *Account is wrapped by
+// DefaultBackend to implement it.
+type OlmAccount interface {
+	Clear() error
+	Pickle(key []byte) string
+	IdentityKeys() (Ed25519, Curve25519)
+	IdentityKeysJSON() string
+	Sign(message string) string
+	SignJSON(_obj interface{}, userID, deviceID string) (interface{}, error)
+	OneTimeKeys() OTKs
+	MarkKeysAsPublished()
+	MaxNumberOfOneTimeKeys() uint
+	GenOneTimeKeys(num uint)
+	NewOutboundSession(theirIdentityKey, theirOneTimeKey Curve25519) (OlmSession, error)
+	NewInboundSession(oneTimeKeyMsg string) (OlmSession, error)
+	NewInboundSessionFrom(theirIdentityKey Curve25519, oneTimeKeyMsg string) (OlmSession, error)
+	// RemoveOneTimeKeys only accepts the sessions of the same Backend.
+	RemoveOneTimeKeys(s OlmSession) error
+}
+
+// OlmSession is a Session of a Backend.  *Session implements it.
+type OlmSession interface {
+	Clear() error
+	Pickle(key []byte) string
+	ID() SessionID
+	HasReceivedMessage() bool
+	MatchesInboundSession(oneTimeKeyMsg string) (bool, error)
+	MatchesInboundSessionFrom(theirIdentityKey, oneTimeKeyMsg string) (bool, error)
+	EncryptMsgType() MsgType
+	Encrypt(plaintext string) (MsgType, string)
+	Decrypt(message string, msgType MsgType) (string, error)
+}
+
+// OlmOutboundGroupSession is an OutboundGroupSession of a Backend.
+// *OutboundGroupSession implements it.
+type OlmOutboundGroupSession interface {
+	Clear() error
+	Pickle(key []byte) string
+	Encrypt(plaintext string) string
+	ID() SessionID
+	MessageIndex() uint
+	SessionKey() string
+}
+
+// OlmInboundGroupSession is an InboundGroupSession of a Backend.
+// *InboundGroupSession implements it.
+type OlmInboundGroupSession interface {
+	Clear() error
+	Pickle(key []byte) string
+	Decrypt(message string) (string, uint32, error)
+	ID() SessionID
+	FirstKnownIndex() uint
+	IsVerified() uint
+	Export(messageIndex uint32) (string, error)
+}
+
+// OlmUtility is a Utility of a Backend.  *Utility implements it.
+type OlmUtility interface {
+	Clear() error
+	Sha256(input string) string
+	VerifySignature(message string, key Ed25519, signature string) (bool, error)
+	VerifySignatureJSON(_obj interface{}, userID, deviceID string, key Ed25519) (bool, error)
+}
+
+// Backend is an implementation of Olm and Megolm.  The functions have the
+// same behaviour and errors as the functions of the package with the same
+// name.  Applications and tests using a Backend can swap in another
+// implementation, or a mock.
+type Backend interface {
+	// Name returns the name of the implementation.
+	Name() string
+	NewAccount() OlmAccount
+	AccountFromPickled(pickled string, key []byte) (OlmAccount, error)
+	SessionFromPickled(pickled string, key []byte) (OlmSession, error)
+	NewOutboundGroupSession() OlmOutboundGroupSession
+	OutboundGroupSessionFromPickled(pickled string, key []byte) (OlmOutboundGroupSession, error)
+	NewInboundGroupSession(sessionKey []byte) (OlmInboundGroupSession, error)
+	InboundGroupSessionImport(sessionKey []byte) (OlmInboundGroupSession, error)
+	InboundGroupSessionFromPickled(pickled string, key []byte) (OlmInboundGroupSession, error)
+	NewUtility() OlmUtility
+}
+
+// DefaultBackend is the Backend of the package: the libolm bindings, or the
+// pure Go implementation if built with the goolm tag.
+var DefaultBackend Backend = defaultBackend{}
+
+var (
+	_ OlmSession              = (*Session)(nil)
+	_ OlmOutboundGroupSession = (*OutboundGroupSession)(nil)
+	_ OlmInboundGroupSession  = (*InboundGroupSession)(nil)
+	_ OlmUtility              = (*Utility)(nil)
+)
+
+// defaultBackend implements Backend with the types of the package.
+type defaultBackend struct{}
+
+func (defaultBackend) Name() string {
+	return backend
+}
+
+func (defaultBackend) NewAccount() OlmAccount {
+	return backendAccount{NewAccount()}
+}
+
+func (defaultBackend) AccountFromPickled(pickled string, key []byte) (OlmAccount, error) {
+	a, err := AccountFromPickled(pickled, key)
+	if err != nil {
+		return nil, err
+	}
+	return backendAccount{a}, nil
+}
+
+func (defaultBackend) SessionFromPickled(pickled string, key []byte) (OlmSession, error) {
+	s, err := SessionFromPickled(pickled, key)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (defaultBackend) NewOutboundGroupSession() OlmOutboundGroupSession {
+	return NewOutboundGroupSession()
+}
+
+func (defaultBackend) OutboundGroupSessionFromPickled(pickled string, key []byte) (OlmOutboundGroupSession, error) {
+	s, err := OutboundGroupSessionFromPickled(pickled, key)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (defaultBackend) NewInboundGroupSession(sessionKey []byte) (OlmInboundGroupSession, error) {
+	s, err := NewInboundGroupSession(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (defaultBackend) InboundGroupSessionImport(sessionKey []byte) (OlmInboundGroupSession, error) {
+	s, err := InboundGroupSessionImport(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (defaultBackend) InboundGroupSessionFromPickled(pickled string, key []byte) (OlmInboundGroupSession, error) {
+	s, err := InboundGroupSessionFromPickled(pickled, key)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (defaultBackend) NewUtility() OlmUtility {
+	return NewUtility()
+}
+
+// backendAccount wraps an Account to return its sessions as OlmSession.
+type backendAccount struct {
+	*Account
+}
+
+// BackendAccount returns the Account of an OlmAccount of DefaultBackend, or
+// nil for the accounts of other backends.
+func BackendAccount(a OlmAccount) *Account {
+	if b, ok := a.(backendAccount); ok {
+		return b.Account
+	}
+	return nil
+}
+
+func (a backendAccount) NewOutboundSession(theirIdentityKey, theirOneTimeKey Curve25519) (OlmSession, error) {
+	s, err := a.Account.NewOutboundSession(theirIdentityKey, theirOneTimeKey)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (a backendAccount) NewInboundSession(oneTimeKeyMsg string) (OlmSession, error) {
+	s, err := a.Account.NewInboundSession(oneTimeKeyMsg)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (a backendAccount) NewInboundSessionFrom(theirIdentityKey Curve25519, oneTimeKeyMsg string) (OlmSession, error) {
+	s, err := a.Account.NewInboundSessionFrom(theirIdentityKey, oneTimeKeyMsg)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (a backendAccount) RemoveOneTimeKeys(s OlmSession) error {
+	session, ok := s.(*Session)
+	if !ok {
+		return fmt.Errorf("Session of another backend")
+	}
+	return a.Account.RemoveOneTimeKeys(session)
+}
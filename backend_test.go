@@ -0,0 +1,124 @@
+package olm
+
+import (
+	"fmt"
+	"testing"
+)
+
+// mockUtility is an OlmUtility accepting every signature.
+type mockUtility struct {
+	OlmUtility
+}
+
+func (mockUtility) VerifySignature(message string, key Ed25519, signature string) (bool, error) {
+	return true, nil
+}
+
+// mockBackend is DefaultBackend with a mockUtility.
+type mockBackend struct {
+	Backend
+}
+
+func (mockBackend) Name() string {
+	return "mock"
+}
+
+func (b mockBackend) NewUtility() OlmUtility {
+	return mockUtility{b.Backend.NewUtility()}
+}
+
+// backendConversation sets up a session and a group session with b and
+// exchanges messages.
+func backendConversation(b Backend) error {
+	key := []byte("backend pickle key")
+	alice := b.NewAccount()
+	bob := b.NewAccount()
+	bob.GenOneTimeKeys(1)
+	var otk Curve25519
+	for _, otk = range bob.OneTimeKeys().Curve25519 {
+	}
+	bob.MarkKeysAsPublished()
+	_, bobKey := bob.IdentityKeys()
+	outbound, err := alice.NewOutboundSession(bobKey, otk)
+	if err != nil {
+		return err
+	}
+	msgType, message := outbound.Encrypt("hello")
+	inbound, err := bob.NewInboundSession(message)
+	if err != nil {
+		return err
+	}
+	if err := bob.RemoveOneTimeKeys(inbound); err != nil {
+		return err
+	}
+	plaintext, err := inbound.Decrypt(message, msgType)
+	if err != nil || plaintext != "hello" {
+		return fmt.Errorf("Decrypt() failed: %q %v", plaintext, err)
+	}
+	inbound, err = b.SessionFromPickled(inbound.Pickle(key), key)
+	if err != nil {
+		return err
+	}
+	msgType, message = inbound.Encrypt("reply")
+	if plaintext, err := outbound.Decrypt(message, msgType); err != nil || plaintext != "reply" {
+		return fmt.Errorf("Decrypt() failed for reply: %q %v", plaintext, err)
+	}
+	if _, err := b.AccountFromPickled(bob.Pickle(key), key); err != nil {
+		return err
+	}
+
+	group := b.NewOutboundGroupSession()
+	received, err := b.NewInboundGroupSession([]byte(group.SessionKey()))
+	if err != nil {
+		return err
+	}
+	received, err = b.InboundGroupSessionFromPickled(received.Pickle(key), key)
+	if err != nil {
+		return err
+	}
+	plaintext, index, err := received.Decrypt(group.Encrypt("group"))
+	if err != nil || plaintext != "group" || index != 0 {
+		return fmt.Errorf("Decrypt() failed for group message: %q %v", plaintext, err)
+	}
+	if received.ID() != group.ID() {
+		return fmt.Errorf("Wrong group session ID %s", received.ID())
+	}
+	return nil
+}
+
+func TestDefaultBackend(t *testing.T) {
+	if DefaultBackend.Name() != backend {
+		t.Fatal("Wrong backend name", DefaultBackend.Name())
+	}
+	err := backendConversation(DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := DefaultBackend.NewAccount()
+	if BackendAccount(a) == nil {
+		t.Fatal("BackendAccount() returned nil")
+	}
+	if a.RemoveOneTimeKeys(nil) == nil {
+		t.Fatal("RemoveOneTimeKeys() accepted a session of another backend")
+	}
+}
+
+func TestMockBackend(t *testing.T) {
+	b := mockBackend{DefaultBackend}
+	err := backendConversation(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := b.NewUtility().VerifySignature("message", "key", "signature")
+	if !ok || err != nil {
+		t.Fatal("mockUtility wasn't used", ok, err)
+	}
+	if BackendAccount(mockAccount{}) != nil {
+		t.Fatal("BackendAccount() returned the Account of another backend")
+	}
+}
+
+// mockAccount is an OlmAccount of another backend.
+type mockAccount struct {
+	OlmAccount
+}
@@ -0,0 +1,378 @@
+package olm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// AlgorithmMegolmBackupV1 is the algorithm of server-side key backups whose
+// session data is encrypted to a Curve25519 public key.
+const AlgorithmMegolmBackupV1 Algorithm = "m.megolm_backup.v1.curve25519-aes-sha2"
+
+// backupMACLen is the number of bytes of the HMAC-SHA-256 kept in the mac of
+// the encrypted session data.
+const backupMACLen = 8
+
+// BackupKey stores the Curve25519 key pair of a server-side key backup
+// version.  The private key is the recovery key of the backup.
+type BackupKey struct {
+	privateKey [32]byte
+	publicKey  [32]byte
+	// passphrase is set if the key was derived from a passphrase.
+	passphrase *PassphraseInfo
+}
+
+// NewBackupKey creates a new random BackupKey.
+func NewBackupKey() *BackupKey {
+	random := make([]byte, 32)
+	_, err := crand.Read(random)
+	if err != nil {
+		panic("Couldn't get enough randomness from crypto/rand")
+	}
+	k, err := BackupKeyFromBytes(random)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// BackupKeyFromBytes loads a BackupKey from the 32 bytes of its private key.
+// Returns error on failure.
+func BackupKeyFromBytes(privateKey []byte) (*BackupKey, error) {
+	if len(privateKey) != 32 {
+		return nil, fmt.Errorf("Invalid private key length %d, expected 32", len(privateKey))
+	}
+	var k BackupKey
+	copy(k.privateKey[:], privateKey)
+	publicKey, err := curve25519.X25519(k.privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(k.publicKey[:], publicKey)
+	return &k, nil
+}
+
+// Bytes returns the private key of the BackupKey.
+func (k *BackupKey) Bytes() []byte {
+	privateKey := make([]byte, len(k.privateKey))
+	copy(privateKey, k.privateKey[:])
+	return privateKey
+}
+
+// PublicKey returns the public key of the BackupKey, as it appears in the
+// auth_data of the backup version.
+func (k *BackupKey) PublicKey() Curve25519 {
+	return Curve25519(base64.RawStdEncoding.EncodeToString(k.publicKey[:]))
+}
+
+// BackupAuthData is the auth_data of a backup version using
+// AlgorithmMegolmBackupV1.
+type BackupAuthData struct {
+	PublicKey            Curve25519 `json:"public_key"`
+	PrivateKeySalt       string     `json:"private_key_salt,omitempty"`
+	PrivateKeyIterations int        `json:"private_key_iterations,omitempty"`
+	PrivateKeyBits       int        `json:"private_key_bits,omitempty"`
+	Signatures           Signatures `json:"signatures"`
+}
+
+// AuthData returns the auth_data of a backup version for this BackupKey,
+// including the passphrase parameters if the key was derived from one, signed
+// by the device deviceID of userID with Account.SignJSON.
+func (k *BackupKey) AuthData(a *Account, userID, deviceID string) (*BackupAuthData, error) {
+	authData := BackupAuthData{PublicKey: k.PublicKey()}
+	if k.passphrase != nil {
+		authData.PrivateKeySalt = k.passphrase.Salt
+		authData.PrivateKeyIterations = k.passphrase.Iterations
+		authData.PrivateKeyBits = k.passphrase.Bits
+	}
+	signed, err := a.SignJSON(authData, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	authData.Signatures, err = toSignatures(signed.(map[string]interface{})["signatures"])
+	if err != nil {
+		return nil, err
+	}
+	return &authData, nil
+}
+
+// Verify checks that the auth_data was signed by the device deviceID of
+// userID whose Ed25519 key is key.  Returns error on failure.
+func (d *BackupAuthData) Verify(userID, deviceID string, key Ed25519) (bool, error) {
+	return VerifySignatureJSON(d, userID, deviceID, key)
+}
+
+// BackupVersion is the description of a backup version as returned by the
+// /room_keys/version endpoint.
+type BackupVersion struct {
+	Algorithm Algorithm       `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+	Count     int             `json:"count,omitempty"`
+	ETag      string          `json:"etag,omitempty"`
+	Version   string          `json:"version,omitempty"`
+}
+
+// BackupSessionData is the plain-text of the session data of a backed up
+// InboundGroupSession.
+type BackupSessionData struct {
+	Algorithm                    Algorithm          `json:"algorithm"`
+	ForwardingCurve25519KeyChain []Curve25519       `json:"forwarding_curve25519_key_chain"`
+	SenderKey                    Curve25519         `json:"sender_key"`
+	SenderClaimedKeys            map[string]Ed25519 `json:"sender_claimed_keys"`
+	SessionKey                   string             `json:"session_key"`
+}
+
+// EncryptedSessionData is the session data of a backed up
+// InboundGroupSession, encrypted to the public key of the backup.
+type EncryptedSessionData struct {
+	Ephemeral  Curve25519 `json:"ephemeral"`
+	Ciphertext string     `json:"ciphertext"`
+	MAC        string     `json:"mac"`
+}
+
+// KeyBackupData is a backed up InboundGroupSession.
+type KeyBackupData struct {
+	FirstMessageIndex uint                 `json:"first_message_index"`
+	ForwardedCount    int                  `json:"forwarded_count"`
+	IsVerified        bool                 `json:"is_verified"`
+	SessionData       EncryptedSessionData `json:"session_data"`
+}
+
+// RoomKeyBackup holds the backed up InboundGroupSessions of a room.
+type RoomKeyBackup struct {
+	Sessions map[SessionID]*KeyBackupData `json:"sessions"`
+}
+
+// KeyBackup holds the backed up InboundGroupSessions of several rooms, as sent
+// to and received from the /room_keys/keys endpoint.
+type KeyBackup struct {
+	Rooms map[string]*RoomKeyBackup `json:"rooms"`
+}
+
+// Add adds a backed up session of the room roomID to the KeyBackup.
+func (b *KeyBackup) Add(roomID string, sessionID SessionID, data *KeyBackupData) {
+	if b.Rooms == nil {
+		b.Rooms = map[string]*RoomKeyBackup{}
+	}
+	room, ok := b.Rooms[roomID]
+	if !ok {
+		room = &RoomKeyBackup{Sessions: map[SessionID]*KeyBackupData{}}
+		b.Rooms[roomID] = room
+	}
+	room.Sessions[sessionID] = data
+}
+
+// backupKeys derives the AES key, HMAC key and AES IV used to encrypt session
+// data from the Curve25519 shared secret.
+func backupKeys(sharedSecret []byte) (aesKey, hmacKey, iv []byte, err error) {
+	keys := make([]byte, 80)
+	_, err = io.ReadFull(hkdf.New(sha256.New, sharedSecret, make([]byte, 32), nil), keys)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[:32], keys[32:64], keys[64:], nil
+}
+
+// backupMAC returns the truncated MAC of encrypted session data.  The MAC is
+// calculated over an empty message, as libolm's PkEncryption does.
+func backupMAC(hmacKey []byte) []byte {
+	mac := hmac.New(sha256.New, hmacKey)
+	return mac.Sum(nil)[:backupMACLen]
+}
+
+// EncryptSessionData encrypts the session data to the public key of a backup.
+// Returns error on failure.
+func EncryptSessionData(publicKey Curve25519, data *BackupSessionData) (*EncryptedSessionData, error) {
+	theirKey, err := publicKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral := NewBackupKey()
+	sharedSecret, err := curve25519.X25519(ephemeral.privateKey[:], theirKey)
+	if err != nil {
+		return nil, err
+	}
+	aesKey, hmacKey, iv, err := backupKeys(sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext = pkcs7Pad(plaintext, aes.BlockSize)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+	return &EncryptedSessionData{
+		Ephemeral:  ephemeral.PublicKey(),
+		Ciphertext: base64.RawStdEncoding.EncodeToString(ciphertext),
+		MAC:        base64.RawStdEncoding.EncodeToString(backupMAC(hmacKey)),
+	}, nil
+}
+
+// DecryptSessionData decrypts session data encrypted to the public key of this
+// BackupKey.  Returns error on failure.  If the base64 couldn't be decoded then
+// the error will be "INVALID_BASE64".  If the MAC didn't match then the error
+// will be "BAD_MESSAGE_MAC".
+func (k *BackupKey) DecryptSessionData(data *EncryptedSessionData) (*BackupSessionData, error) {
+	ephemeral, err := data.Ephemeral.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := decodeBase64(data.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := decodeBase64(data.MAC)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := curve25519.X25519(k.privateKey[:], ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aesKey, hmacKey, iv, err := backupKeys(sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, backupMAC(hmacKey)) {
+		return nil, fmt.Errorf("BAD_MESSAGE_MAC")
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	plaintext, err = pkcs7Unpad(plaintext, aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	var sessionData BackupSessionData
+	err = json.Unmarshal(plaintext, &sessionData)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionData, nil
+}
+
+// NewKeyBackupData exports an InboundGroupSession and encrypts it to the
+// public key of a backup.  senderKey and signingKey are the Curve25519 and
+// Ed25519 identity keys of the device that created the session.  Returns error
+// on failure.
+func NewKeyBackupData(s *InboundGroupSession, senderKey Curve25519, signingKey Ed25519, publicKey Curve25519) (*KeyBackupData, error) {
+	exported, err := NewExportedSession(s, "", senderKey, signingKey)
+	if err != nil {
+		return nil, err
+	}
+	sessionData, err := EncryptSessionData(publicKey, &BackupSessionData{
+		Algorithm:                    exported.Algorithm,
+		ForwardingCurve25519KeyChain: exported.ForwardingCurve25519KeyChain,
+		SenderKey:                    exported.SenderKey,
+		SenderClaimedKeys:            exported.SenderClaimedKeys,
+		SessionKey:                   exported.SessionKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KeyBackupData{
+		FirstMessageIndex: s.FirstKnownIndex(),
+		ForwardedCount:    len(exported.ForwardingCurve25519KeyChain),
+		IsVerified:        s.IsVerified() != 0,
+		SessionData:       *sessionData,
+	}, nil
+}
+
+// Restore decrypts a backed up session of the room roomID.  Use
+// ExportedSession.Session to turn it into an InboundGroupSession.  Returns
+// error on failure.
+func (k *BackupKey) Restore(roomID string, sessionID SessionID, data *KeyBackupData) (*ExportedSession, error) {
+	sessionData, err := k.DecryptSessionData(&data.SessionData)
+	if err != nil {
+		return nil, err
+	}
+	return &ExportedSession{
+		Algorithm:                    sessionData.Algorithm,
+		ForwardingCurve25519KeyChain: sessionData.ForwardingCurve25519KeyChain,
+		RoomID:                       roomID,
+		SenderKey:                    sessionData.SenderKey,
+		SenderClaimedKeys:            sessionData.SenderClaimedKeys,
+		SessionID:                    sessionID,
+		SessionKey:                   sessionData.SessionKey,
+	}, nil
+}
+
+// RestoreAll decrypts every session of a KeyBackup.  Sessions that can't be
+// decrypted are skipped and their errors are returned in a map from room ID
+// and session ID to error.
+func (k *BackupKey) RestoreAll(b *KeyBackup) ([]*ExportedSession, map[string]map[SessionID]error) {
+	var sessions []*ExportedSession
+	failed := map[string]map[SessionID]error{}
+	for roomID, room := range b.Rooms {
+		for sessionID, data := range room.Sessions {
+			exported, err := k.Restore(roomID, sessionID, data)
+			if err != nil {
+				if failed[roomID] == nil {
+					failed[roomID] = map[SessionID]error{}
+				}
+				failed[roomID][sessionID] = err
+				continue
+			}
+			sessions = append(sessions, exported)
+		}
+	}
+	return sessions, failed
+}
+
+// decodeBase64 decodes padded or unpadded base64.  Returns error
+// "INVALID_BASE64" on failure.
+func decodeBase64(input string) ([]byte, error) {
+	output, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(input, "="))
+	if err != nil {
+		return nil, fmt.Errorf("INVALID_BASE64")
+	}
+	return output, nil
+}
+
+// pkcs7Pad pads the input to a multiple of blockSize.
+func pkcs7Pad(input []byte, blockSize int) []byte {
+	padding := blockSize - len(input)%blockSize
+	return append(input, bytes.Repeat([]byte{byte(padding)}, padding)...)
+}
+
+// pkcs7Unpad removes the padding added by pkcs7Pad.  Returns error
+// "BAD_MESSAGE_FORMAT" if the padding is invalid.
+func pkcs7Unpad(input []byte, blockSize int) ([]byte, error) {
+	if len(input) == 0 || len(input)%blockSize != 0 {
+		return nil, fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	padding := int(input[len(input)-1])
+	if padding == 0 || padding > blockSize {
+		return nil, fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	for _, b := range input[len(input)-padding:] {
+		if int(b) != padding {
+			return nil, fmt.Errorf("BAD_MESSAGE_FORMAT")
+		}
+	}
+	return input[:len(input)-padding], nil
+}
@@ -0,0 +1,240 @@
+package olm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBackupSessionData(t *testing.T) {
+	k := NewBackupKey()
+	t.Log("PublicKey():", k.PublicKey())
+
+	k2, err := BackupKeyFromBytes(k.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.PublicKey() != k2.PublicKey() {
+		t.Fatal("BackupKeyFromBytes(k.Bytes()) has a different public key")
+	}
+
+	sessionData := &BackupSessionData{
+		Algorithm:                    AlgorithmMegolmV1,
+		ForwardingCurve25519KeyChain: []Curve25519{},
+		SenderKey:                    "wo76WcYtb0Vk/pBOdmduiGJ0wIEjW4IBMbbQn7aSnTo",
+		SenderClaimedKeys:            map[string]Ed25519{"ed25519": "TdbnI8JjtbJW1h9dISHcZ7LTpMYIjKFiEBfKp8hxCeI"},
+		SessionKey:                   "SESSIONKEY",
+	}
+	encrypted, err := EncryptSessionData(k.PublicKey(), sessionData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("EncryptSessionData():", encrypted)
+
+	decrypted, err := k.DecryptSessionData(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.SessionKey != sessionData.SessionKey || decrypted.SenderKey != sessionData.SenderKey {
+		t.Fatalf("DecryptSessionData(EncryptSessionData()) = %+v != %+v", decrypted, sessionData)
+	}
+
+	// Decrypt with a different key
+	_, err = NewBackupKey().DecryptSessionData(encrypted)
+	if err == nil || err.Error() != "BAD_MESSAGE_MAC" {
+		t.Fatal("DecryptSessionData() with a wrong key should fail with BAD_MESSAGE_MAC, got", err)
+	}
+
+	_, err = BackupKeyFromBytes([]byte("short"))
+	if err == nil {
+		t.Fatal("BackupKeyFromBytes() of a short key should fail")
+	}
+}
+
+// TestBackupSessionDataVector decrypts session data encrypted with the X25519
+// keys of RFC 7748 section 6.1.  The ciphertext and MAC were computed with
+// OpenSSL, independently of this package.
+func TestBackupSessionDataVector(t *testing.T) {
+	privateKey, _ := hex.DecodeString("5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb")
+	k, err := BackupKeyFromBytes(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.PublicKey() != "3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08" {
+		t.Fatal("Unexpected public key", k.PublicKey())
+	}
+	encrypted := EncryptedSessionData{
+		Ephemeral: "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo",
+		Ciphertext: "9lq9DgATQh0Ey5ZaVGHfoeMtfpavaYtV17dAmUZKJ5KE2zq6WJ3ZNxzSc7vBLxZ92LDrQYg628RcotpdEqWh6K8IFGIxibaj6emMBbPWgEWCuN/en40zYYcjju9d/gK/" +
+			"Y13J7+jy4FIHtKhgYwpo//lIm6+3LdWN86QfunImZxf6RL08OIfJ/Z5LRxRX/e1gaJU5dFX3+tBVYwM2gZDSE/853Jwu/0a9YuokiiUmqRoYRDkBG1i59ws9DZIxvFHLsXHNVhizCWJ8v8Uuuao+KfU6Cad7LQadgTgYKnrePhif64Cg8p5YOdvE7pvMn6UN",
+		MAC: "zpzU6BkZcNI",
+	}
+	decrypted, err := k.DecryptSessionData(&encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.Algorithm != AlgorithmMegolmV1 || decrypted.SenderKey != "3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08" ||
+		decrypted.SenderClaimedKeys["ed25519"] != "TdbnI8JjtbJW1h9dISHcZ7LTpMYIjKFiEBfKp8hxCeI" || decrypted.SessionKey != "SESSIONKEY" {
+		t.Fatalf("DecryptSessionData() = %+v", decrypted)
+	}
+
+	// Failures are reported per room, even if session IDs are the same
+	var b KeyBackup
+	b.Add("!good:example.org", "SESSION", &KeyBackupData{SessionData: encrypted})
+	tampered := encrypted
+	tampered.MAC = "AAAAAAAAAAA"
+	b.Add("!bad:example.org", "SESSION", &KeyBackupData{SessionData: tampered})
+	restored, failed := k.RestoreAll(&b)
+	if len(restored) != 1 || restored[0].RoomID != "!good:example.org" {
+		t.Fatalf("RestoreAll() = %+v", restored)
+	}
+	if len(failed) != 1 || len(failed["!bad:example.org"]) != 1 || errString(failed["!bad:example.org"]["SESSION"]) != "BAD_MESSAGE_MAC" {
+		t.Fatal("RestoreAll() failed =", failed)
+	}
+}
+
+// backupServer is a local stand-in for the /room_keys endpoints of a
+// homeserver that stores a single backup version.
+type backupServer struct {
+	version BackupVersion
+	keys    KeyBackup
+}
+
+func (b *backupServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch {
+	case r.URL.Path == "/room_keys/version" && r.Method == http.MethodPost:
+		err = json.NewDecoder(r.Body).Decode(&b.version)
+		b.version.Version = "1"
+		json.NewEncoder(w).Encode(map[string]string{"version": b.version.Version})
+	case r.URL.Path == "/room_keys/version" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(b.version)
+	case r.URL.Path == "/room_keys/keys" && r.Method == http.MethodPut:
+		var keys KeyBackup
+		err = json.NewDecoder(r.Body).Decode(&keys)
+		for roomID, room := range keys.Rooms {
+			for sessionID, data := range room.Sessions {
+				b.keys.Add(roomID, sessionID, data)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]int{"count": len(keys.Rooms)})
+	case r.URL.Path == "/room_keys/keys" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(b.keys)
+	default:
+		http.NotFound(w, r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func doJSON(t *testing.T, method, url string, in, out interface{}) {
+	var body bytes.Buffer
+	if in != nil {
+		err := json.NewEncoder(&body).Encode(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s: %s", method, url, resp.Status)
+	}
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	server := httptest.NewServer(&backupServer{})
+	defer server.Close()
+
+	a := NewAccount()
+	signingKey, senderKey := a.IdentityKeys()
+	k := NewBackupKey()
+
+	// Create the backup version
+	authData, err := k.AuthData(a, "@alice:example.org", "DEVICEID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authDataJSON, err := json.Marshal(authData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doJSON(t, http.MethodPost, server.URL+"/room_keys/version",
+		BackupVersion{Algorithm: AlgorithmMegolmBackupV1, AuthData: authDataJSON}, nil)
+
+	// Back up a session
+	outbound := NewOutboundGroupSession()
+	inbound, err := NewInboundGroupSession([]byte(outbound.SessionKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := outbound.Encrypt("HELLO WORLD")
+	data, err := NewKeyBackupData(inbound, senderKey, signingKey, k.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys KeyBackup
+	keys.Add("!room:example.org", inbound.ID(), data)
+	doJSON(t, http.MethodPut, server.URL+"/room_keys/keys?version=1", keys, nil)
+
+	// Fetch the backup version and check its signature
+	var version BackupVersion
+	doJSON(t, http.MethodGet, server.URL+"/room_keys/version", nil, &version)
+	if version.Algorithm != AlgorithmMegolmBackupV1 {
+		t.Fatal("Unexpected backup algorithm", version.Algorithm)
+	}
+	var fetchedAuthData BackupAuthData
+	err = json.Unmarshal(version.AuthData, &fetchedAuthData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := fetchedAuthData.Verify("@alice:example.org", "DEVICEID", signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("auth_data signature verification failed")
+	}
+	if fetchedAuthData.PublicKey != k.PublicKey() {
+		t.Fatal("auth_data public key doesn't match")
+	}
+
+	// Restore the session and decrypt the message with it
+	var fetched KeyBackup
+	doJSON(t, http.MethodGet, server.URL+"/room_keys/keys?version=1", nil, &fetched)
+	restored, failed := k.RestoreAll(&fetched)
+	if len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	if len(restored) != 1 || restored[0].RoomID != "!room:example.org" {
+		t.Fatalf("RestoreAll() = %+v", restored)
+	}
+	s, err := restored[0].Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, _, err := s.Decrypt(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "HELLO WORLD" {
+		t.Fatalf("Decrypt() = \"%s\" != \"HELLO WORLD\"", plaintext)
+	}
+}
@@ -0,0 +1,259 @@
+package olm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// benchmarkSizes are the plain-text sizes of the encryption benchmarks.
+var benchmarkSizes = []int{16, 1024, 64 * 1024}
+
+var benchmarkPickleKey = []byte("benchmark pickle key")
+
+func BenchmarkNewAccount(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewAccount()
+	}
+}
+
+func BenchmarkGenOneTimeKeys(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		a := NewAccount()
+		b.StartTimer()
+		a.GenOneTimeKeys(a.MaxNumberOfOneTimeKeys())
+	}
+}
+
+func BenchmarkNewOutboundSession(b *testing.B) {
+	alice := NewAccount()
+	bob := NewAccount()
+	bob.GenOneTimeKeys(1)
+	var otk Curve25519
+	for _, otk = range bob.OneTimeKeys().Curve25519 {
+	}
+	_, bobKey := bob.IdentityKeys()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := alice.NewOutboundSession(bobKey, otk)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewInboundSession(b *testing.B) {
+	bob := NewAccount()
+	_, message, _ := testSessions(b, NewAccount(), bob)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := bob.NewInboundSession(message)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkSessions returns an out-bound and in-bound Session which have
+// exchanged messages both ways.
+func benchmarkSessions(b *testing.B) (*Session, *Session) {
+	outbound, first, inbound := testSessions(b, NewAccount(), NewAccount())
+	if _, err := inbound.Decrypt(first, MsgTypePreKey); err != nil {
+		b.Fatal(err)
+	}
+	msgType, reply := inbound.Encrypt("reply")
+	if _, err := outbound.Decrypt(reply, msgType); err != nil {
+		b.Fatal(err)
+	}
+	return outbound, inbound
+}
+
+func BenchmarkOlmEncrypt(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			outbound, _ := benchmarkSessions(b)
+			plaintext := strings.Repeat("a", size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				outbound.Encrypt(plaintext)
+			}
+		})
+	}
+}
+
+func BenchmarkOlmDecrypt(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			outbound, inbound := benchmarkSessions(b)
+			plaintext := strings.Repeat("a", size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Each message can only be decrypted once.
+				b.StopTimer()
+				msgType, message := outbound.Encrypt(plaintext)
+				b.StartTimer()
+				_, err := inbound.Decrypt(message, msgType)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMegolmEncrypt(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			outbound := NewOutboundGroupSession()
+			plaintext := strings.Repeat("a", size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				outbound.Encrypt(plaintext)
+			}
+		})
+	}
+}
+
+func BenchmarkMegolmDecrypt(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			outbound := NewOutboundGroupSession()
+			inbound, err := NewInboundGroupSession([]byte(outbound.SessionKey()))
+			if err != nil {
+				b.Fatal(err)
+			}
+			message := outbound.Encrypt(strings.Repeat("a", size))
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _, err := inbound.Decrypt(message)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkPickle benchmarks the pickling of an object and its loading with
+// fromPickled.
+func benchmarkPickle(b *testing.B, obj interface{ Pickle([]byte) string }, fromPickled func(pickled string, key []byte) error) {
+	b.Run("Pickle", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			obj.Pickle(benchmarkPickleKey)
+		}
+	})
+	pickled := obj.Pickle(benchmarkPickleKey)
+	b.Run("FromPickled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := fromPickled(pickled, benchmarkPickleKey)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkAccountPickle(b *testing.B) {
+	a := NewAccount()
+	a.GenOneTimeKeys(a.MaxNumberOfOneTimeKeys())
+	benchmarkPickle(b, a, func(pickled string, key []byte) error {
+		_, err := AccountFromPickled(pickled, key)
+		return err
+	})
+}
+
+func BenchmarkSessionPickle(b *testing.B) {
+	_, inbound := benchmarkSessions(b)
+	benchmarkPickle(b, inbound, func(pickled string, key []byte) error {
+		_, err := SessionFromPickled(pickled, key)
+		return err
+	})
+}
+
+func BenchmarkOutboundGroupSessionPickle(b *testing.B) {
+	benchmarkPickle(b, NewOutboundGroupSession(), func(pickled string, key []byte) error {
+		_, err := OutboundGroupSessionFromPickled(pickled, key)
+		return err
+	})
+}
+
+func BenchmarkInboundGroupSessionPickle(b *testing.B) {
+	inbound, err := NewInboundGroupSession([]byte(NewOutboundGroupSession().SessionKey()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkPickle(b, inbound, func(pickled string, key []byte) error {
+		_, err := InboundGroupSessionFromPickled(pickled, key)
+		return err
+	})
+}
+
+func BenchmarkSign(b *testing.B) {
+	a := NewAccount()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.Sign("message")
+	}
+}
+
+func BenchmarkVerifySignature(b *testing.B) {
+	a := NewAccount()
+	key, _ := a.IdentityKeys()
+	signature := a.Sign("message")
+	u := NewUtility()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ok, err := u.VerifySignature("message", key, signature)
+		if !ok || err != nil {
+			b.Fatal("VerifySignature() failed", err)
+		}
+	}
+}
+
+// BenchmarkMegolmScrollback decrypts the history of a group session
+// backwards, with InboundGroupSession.Decrypt and with a GroupDecryptor.
+func BenchmarkMegolmScrollback(b *testing.B) {
+	const n = 2000
+	messages, inbound := groupHistory(b, n, 0)
+	if _, _, err := inbound.Decrypt(messages[n-1]); err != nil {
+		b.Fatal(err)
+	}
+	d, err := NewGroupDecryptor(inbound, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, bench := range []struct {
+		name    string
+		decrypt func(message string) (string, uint32, error)
+	}{
+		{"Naive", inbound.Decrypt},
+		{"Checkpoints", d.Decrypt},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, err := bench.decrypt(messages[n-1-i%n])
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package olm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// KeysClaimRequest is the body of a /keys/claim request.
+type KeysClaimRequest struct {
+	Timeout     int                          `json:"timeout,omitempty"`
+	OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+}
+
+// NewKeysClaimRequest returns a /keys/claim request for a signed one time key
+// of each device.
+func NewKeysClaimRequest(devices []*Device) *KeysClaimRequest {
+	r := &KeysClaimRequest{OneTimeKeys: map[string]map[string]string{}}
+	for _, device := range devices {
+		if r.OneTimeKeys[device.UserID] == nil {
+			r.OneTimeKeys[device.UserID] = map[string]string{}
+		}
+		r.OneTimeKeys[device.UserID][device.DeviceID] = KeyAlgorithmSignedCurve25519
+	}
+	return r
+}
+
+// KeysClaimResponse is the response of /keys/claim.  The one time keys map
+// from userID to deviceID to "<algorithm>:<key id>" to key.
+type KeysClaimResponse struct {
+	Failures    map[string]interface{}                           `json:"failures,omitempty"`
+	OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+// signedOneTimeKey returns the signed one time key claimed for the device.
+func (r *KeysClaimResponse) signedOneTimeKey(device *Device) (*SignedOneTimeKey, error) {
+	for keyID, raw := range r.OneTimeKeys[device.UserID][device.DeviceID] {
+		if !strings.HasPrefix(keyID, KeyAlgorithmSignedCurve25519+":") {
+			continue
+		}
+		var key SignedOneTimeKey
+		err := json.Unmarshal(raw, &key)
+		if err != nil {
+			return nil, fmt.Errorf("One time key %s of device %s of %s is invalid: %v", keyID, device.DeviceID, device.UserID, err)
+		}
+		return &key, nil
+	}
+	return nil, fmt.Errorf("Device %s of %s has no one time key", device.DeviceID, device.UserID)
+}
+
+// ClaimSessions creates outbound Sessions to the devices from the one time
+// keys of a /keys/claim response.  The signature of each one time key is
+// verified against the Ed25519 key of its device before the Session is
+// created.  Returns the created Sessions by userID and deviceID, and the
+// reason no Session was created for the other devices.  If the claimed key
+// isn't valid base64 the error will be "INVALID_BASE64".
+func (a *Account) ClaimSessions(resp *KeysClaimResponse, devices []*Device) (map[string]map[string]*Session, DeviceErrors) {
+	sessions := map[string]map[string]*Session{}
+	failed := DeviceErrors{}
+	for _, device := range devices {
+		s, err := a.claimSession(resp, device)
+		if err != nil {
+			failed.add(device.UserID, device.DeviceID, err)
+			continue
+		}
+		if sessions[device.UserID] == nil {
+			sessions[device.UserID] = map[string]*Session{}
+		}
+		sessions[device.UserID][device.DeviceID] = s
+	}
+	return sessions, failed
+}
+
+// claimSession creates an outbound Session to a single device.
+func (a *Account) claimSession(resp *KeysClaimResponse, device *Device) (*Session, error) {
+	key, err := resp.signedOneTimeKey(device)
+	if err != nil {
+		return nil, err
+	}
+	_, err = key.Key.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if !hasSignature(key, device.UserID, "ed25519:"+device.DeviceID) {
+		return nil, fmt.Errorf("One time key of device %s of %s isn't signed by the device", device.DeviceID, device.UserID)
+	}
+	ok, err := VerifySignatureJSON(key, device.UserID, device.DeviceID, device.Ed25519)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("One time key of device %s of %s has an invalid signature", device.DeviceID, device.UserID)
+	}
+	return a.NewOutboundSession(device.Curve25519, key.Key)
+}
@@ -0,0 +1,141 @@
+package olm
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// newTestDevice returns a Device for the Account, as a DeviceTracker would.
+func newTestDevice(a *Account, userID, deviceID string) *Device {
+	ed25519Key, curve25519Key := a.IdentityKeys()
+	return &Device{UserID: userID, DeviceID: deviceID, Ed25519: ed25519Key, Curve25519: curve25519Key}
+}
+
+// claimedKey returns the claimed one time keys of a device in a
+// /keys/claim response.
+func claimedKey(t *testing.T, payload map[string]*SignedOneTimeKey) map[string]json.RawMessage {
+	for keyID, key := range payload {
+		data, err := json.Marshal(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return map[string]json.RawMessage{keyID: data}
+	}
+	t.Fatal("No one time key")
+	return nil
+}
+
+func TestClaimSessions(t *testing.T) {
+	alice := NewAccount()
+	bob := NewAccount()
+	mallory := NewAccount()
+	bobDevice := newTestDevice(bob, "@bob:example.org", "BOB")
+	malloryDevice := newTestDevice(mallory, "@bob:example.org", "MALLORY")
+	carolDevice := newTestDevice(NewAccount(), "@carol:example.org", "CAROL")
+	daveDevice := newTestDevice(NewAccount(), "@dave:example.org", "DAVE")
+
+	request := NewKeysClaimRequest([]*Device{bobDevice, malloryDevice, carolDevice, daveDevice})
+	if request.OneTimeKeys["@bob:example.org"]["BOB"] != KeyAlgorithmSignedCurve25519 {
+		t.Fatal("NewKeysClaimRequest() =", request.OneTimeKeys)
+	}
+
+	bobKeys, err := NewOneTimeKeyManager(bob, "@bob:example.org", "BOB").Prepare(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mallory's key is signed by Bob's device instead of her own
+	bob.GenOneTimeKeys(1)
+	malloryKeys, err := NewOneTimeKeyManager(bob, "@bob:example.org", "MALLORY").Prepare(map[string]int{
+		KeyAlgorithmSignedCurve25519: int(bob.MaxNumberOfOneTimeKeys()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &KeysClaimResponse{
+		OneTimeKeys: map[string]map[string]map[string]json.RawMessage{
+			"@bob:example.org": {
+				"BOB":     claimedKey(t, bobKeys),
+				"MALLORY": claimedKey(t, malloryKeys),
+			},
+			"@dave:example.org": {
+				"DAVE": {"signed_curve25519:AAAAAA": json.RawMessage(`{"key":"!!!","signatures":{}}`)},
+			},
+		},
+	}
+
+	sessions, failed := alice.ClaimSessions(resp, []*Device{bobDevice, malloryDevice, carolDevice, daveDevice})
+	if sessions["@bob:example.org"]["BOB"] == nil {
+		t.Fatal("ClaimSessions() should create a session to Bob, got", failed)
+	}
+	if len(sessions) != 1 || len(sessions["@bob:example.org"]) != 1 {
+		t.Fatal("ClaimSessions() should only create a session to Bob, got", sessions)
+	}
+	if err := failed["@bob:example.org"]["MALLORY"]; err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatal("Mallory's key should be rejected for its signature, got", err)
+	}
+	if err := failed["@carol:example.org"]["CAROL"]; err == nil || !strings.Contains(err.Error(), "no one time key") {
+		t.Fatal("Carol should have no one time key, got", err)
+	}
+	if err := failed["@dave:example.org"]["DAVE"]; err == nil || err.Error() != "INVALID_BASE64" {
+		t.Fatal("Dave's key should be invalid base64, got", err)
+	}
+
+	// Bob can decrypt a message on the new session
+	msgType, message := sessions["@bob:example.org"]["BOB"].Encrypt("HELLO WORLD")
+	s, err := bob.NewInboundSession(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := s.Decrypt(message, msgType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "HELLO WORLD" {
+		t.Fatalf("Decrypt() = \"%s\" != \"HELLO WORLD\"", plaintext)
+	}
+}
+
+func TestClaimFallbackKey(t *testing.T) {
+	alice := NewAccount()
+	bob := NewAccount()
+	bobDevice := newTestDevice(bob, "@bob:example.org", "BOB")
+	bob.GenOneTimeKeys(1)
+	var key Curve25519
+	for _, key = range bob.OneTimeKeys().Curve25519 {
+	}
+	// The server returns the fallback key with "fallback": true, which is
+	// part of the signed object.
+	signed, err := bob.SignJSON(map[string]interface{}{"key": key, "fallback": true}, "@bob:example.org", "BOB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &KeysClaimResponse{
+		OneTimeKeys: map[string]map[string]map[string]json.RawMessage{
+			"@bob:example.org": {"BOB": {"signed_curve25519:AAAAAQ": data}},
+		},
+	}
+	sessions, failed := alice.ClaimSessions(resp, []*Device{bobDevice})
+	if sessions["@bob:example.org"]["BOB"] == nil {
+		t.Fatal("ClaimSessions() should create a session with a fallback key, got", failed)
+	}
+
+	// Dropping the flag invalidates the signature
+	var tampered map[string]interface{}
+	if err := json.Unmarshal(data, &tampered); err != nil {
+		t.Fatal(err)
+	}
+	delete(tampered, "fallback")
+	resp.OneTimeKeys["@bob:example.org"]["BOB"]["signed_curve25519:AAAAAQ"], err = json.Marshal(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, failed = alice.ClaimSessions(resp, []*Device{bobDevice})
+	if err := failed["@bob:example.org"]["BOB"]; err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatal("Fallback key without its flag should be rejected for its signature, got", err)
+	}
+}
@@ -0,0 +1,257 @@
+package olm
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// otherBackend is the backend whose vectors are checked by
+// TestCrossBackendVectors.
+var otherBackend = map[string]string{"libolm": "goolm", "goolm": "libolm"}[backend]
+
+// crossVectorsPath returns the file holding the vectors written by backend b.
+func crossVectorsPath(b string) string {
+	return filepath.Join("testdata", "crossbackend_"+b+".json")
+}
+
+var writeCrossVectors = flag.Bool("olm.writevectors", false,
+	"write the vectors of TestCrossBackendVectors with the selected backend")
+
+// crossMessage is a message and its plain-text.
+type crossMessage struct {
+	Message   string  `json:"message"`
+	Type      MsgType `json:"type"`
+	Index     uint32  `json:"index,omitempty"`
+	Plaintext string  `json:"plaintext"`
+}
+
+// crossVectors are the objects and messages written by one backend of the
+// package to be checked by the other: the libolm bindings, or the pure Go
+// implementation built with the goolm tag.
+type crossVectors struct {
+	Backend   string `json:"backend"`
+	PickleKey string `json:"pickle_key"`
+
+	// Bob's account, with the one time key used by Alice.
+	Bob        string     `json:"bob"`
+	Ed25519    Ed25519    `json:"ed25519"`
+	Curve25519 Curve25519 `json:"curve25519"`
+	Signed     string     `json:"signed"`
+	Signature  string     `json:"signature"`
+	// Bob's account pickled with an empty key.
+	BobNoKey string `json:"bob_no_key"`
+
+	// Alice's session, after sending Messages to Bob.
+	Alice           string         `json:"alice"`
+	AliceCurve25519 Curve25519     `json:"alice_curve25519"`
+	SessionID       SessionID      `json:"session_id"`
+	Messages        []crossMessage `json:"messages"`
+
+	// The outbound group session, after sending GroupMessages, and the
+	// inbound one, after decrypting them.
+	Outbound      string         `json:"outbound"`
+	Inbound       string         `json:"inbound"`
+	SessionKey    string         `json:"session_key"`
+	Export        string         `json:"export"`
+	GroupMessages []crossMessage `json:"group_messages"`
+}
+
+// newCrossVectors writes vectors with the selected backend.
+func newCrossVectors(t *testing.T) *crossVectors {
+	key := []byte("cross backend pickle key")
+	v := &crossVectors{Backend: backend, PickleKey: string(key), Signed: "signed message"}
+
+	alice := NewAccount()
+	bob := NewAccount()
+	bob.GenOneTimeKeys(2)
+	var otk Curve25519
+	for _, otk = range bob.OneTimeKeys().Curve25519 {
+	}
+	bob.MarkKeysAsPublished()
+	v.Ed25519, v.Curve25519 = bob.IdentityKeys()
+	v.Signature = bob.Sign(v.Signed)
+	v.Bob = bob.Pickle(key)
+	v.BobNoKey = bob.Pickle(nil)
+
+	s, err := alice.NewOutboundSession(v.Curve25519, otk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range []string{"first", "second", "third"} {
+		msgType, message := s.Encrypt(plaintext)
+		v.Messages = append(v.Messages, crossMessage{Message: message, Type: msgType, Plaintext: plaintext})
+	}
+	v.SessionID = s.ID()
+	_, v.AliceCurve25519 = alice.IdentityKeys()
+	v.Alice = s.Pickle(key)
+
+	outbound := NewOutboundGroupSession()
+	v.SessionKey = outbound.SessionKey()
+	inbound, err := NewInboundGroupSession([]byte(v.SessionKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, plaintext := range []string{"zero", "one", "two", "three"} {
+		message := outbound.Encrypt(plaintext)
+		v.GroupMessages = append(v.GroupMessages, crossMessage{Message: message, Index: uint32(i), Plaintext: plaintext})
+		_, _, err := inbound.Decrypt(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	v.Export, err = inbound.Export(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Outbound = outbound.Pickle(key)
+	v.Inbound = inbound.Pickle(key)
+	return v
+}
+
+// check checks the vectors with the selected backend.  Pickles are
+// deterministic, so unpickling and pickling again must give the same pickle.
+func (v *crossVectors) check(t *testing.T) {
+	key := []byte(v.PickleKey)
+	t.Logf("Checking vectors of %s with %s", v.Backend, backend)
+
+	bob, err := AccountFromPickled(v.Bob, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.Pickle(key) != v.Bob {
+		t.Fatal("Account pickle changed")
+	}
+	noKey, err := AccountFromPickled(v.BobNoKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noKey.Pickle(nil) != v.BobNoKey || noKey.Pickle([]byte(" ")) != v.BobNoKey {
+		t.Fatal("Account pickle with an empty key changed")
+	}
+	ed25519, curve25519 := bob.IdentityKeys()
+	if ed25519 != v.Ed25519 || curve25519 != v.Curve25519 {
+		t.Fatal("Wrong identity keys", ed25519, curve25519)
+	}
+	// Ed25519 signatures are deterministic.
+	if bob.Sign(v.Signed) != v.Signature {
+		t.Fatal("Wrong signature", bob.Sign(v.Signed))
+	}
+	if ok, err := NewUtility().VerifySignature(v.Signed, v.Ed25519, v.Signature); !ok || err != nil {
+		t.Fatal("VerifySignature() failed", err)
+	}
+
+	alice, err := SessionFromPickled(v.Alice, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Pickle(key) != v.Alice || alice.ID() != v.SessionID {
+		t.Fatal("Session pickle changed")
+	}
+	s, err := bob.NewInboundSessionFrom(v.AliceCurve25519, v.Messages[0].Message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID() != v.SessionID {
+		t.Fatal("Wrong session ID", s.ID())
+	}
+	if err := bob.RemoveOneTimeKeys(s); err != nil {
+		t.Fatal(err)
+	}
+	// Decrypt out of order.
+	for _, i := range []int{2, 0, 1} {
+		m := v.Messages[i]
+		plaintext, err := s.Decrypt(m.Message, m.Type)
+		if err != nil || plaintext != m.Plaintext {
+			t.Fatal("Decrypt() failed for message", i, plaintext, err)
+		}
+	}
+	msgType, reply := s.Encrypt("reply")
+	if plaintext, err := alice.Decrypt(reply, msgType); err != nil || plaintext != "reply" {
+		t.Fatal("Decrypt() failed for reply", plaintext, err)
+	}
+
+	outbound, err := OutboundGroupSessionFromPickled(v.Outbound, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbound.Pickle(key) != v.Outbound || outbound.MessageIndex() != uint(len(v.GroupMessages)) {
+		t.Fatal("Outbound group session pickle changed")
+	}
+	inbound, err := InboundGroupSessionFromPickled(v.Inbound, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inbound.Pickle(key) != v.Inbound || inbound.ID() != outbound.ID() {
+		t.Fatal("Inbound group session pickle changed")
+	}
+	if export, err := inbound.Export(1); err != nil || export != v.Export {
+		t.Fatal("Wrong export", export, err)
+	}
+	fresh, err := NewInboundGroupSession([]byte(v.SessionKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{3, 1, 0, 2} {
+		m := v.GroupMessages[i]
+		plaintext, index, err := fresh.Decrypt(m.Message)
+		if err != nil || plaintext != m.Plaintext || index != m.Index {
+			t.Fatal("Decrypt() failed for group message", i, plaintext, err)
+		}
+	}
+	imported, err := InboundGroupSessionImport([]byte(v.Export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := imported.Decrypt(v.GroupMessages[0].Message); err == nil || err.Error() != "UNKNOWN_MESSAGE_INDEX" {
+		t.Fatal("Expected UNKNOWN_MESSAGE_INDEX, got", err)
+	}
+	if plaintext, _, err := imported.Decrypt(outbound.Encrypt("four")); err != nil || plaintext != "four" {
+		t.Fatal("Decrypt() failed for new group message", plaintext, err)
+	}
+}
+
+func TestCrossBackendRoundTrip(t *testing.T) {
+	v := newCrossVectors(t)
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded crossVectors
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded.check(t)
+}
+
+// TestCrossBackendVectors checks the vectors stored in testdata by the other
+// backend, and fails if there are none.  Run with -olm.writevectors to also
+// write the vectors of the selected backend.
+func TestCrossBackendVectors(t *testing.T) {
+	if *writeCrossVectors {
+		data, err := json.MarshalIndent(newCrossVectors(t), "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(crossVectorsPath(backend), append(data, '\n'), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(crossVectorsPath(otherBackend))
+	if err != nil {
+		t.Fatalf("Missing vectors of %s, write them with -olm.writevectors: %v", otherBackend, err)
+	}
+	var v crossVectors
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Backend != otherBackend {
+		t.Fatalf("Vectors of %s were written by %s", otherBackend, v.Backend)
+	}
+	v.check(t)
+}
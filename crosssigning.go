@@ -0,0 +1,403 @@
+package olm
+
+import (
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// CrossSigningUsage is the purpose of a cross-signing key.
+type CrossSigningUsage string
+
+const (
+	CrossSigningUsageMaster      CrossSigningUsage = "master"
+	CrossSigningUsageSelfSigning CrossSigningUsage = "self_signing"
+	CrossSigningUsageUserSigning CrossSigningUsage = "user_signing"
+)
+
+// CrossSigningKey is the public part of a cross-signing key as uploaded to
+// /keys/device_signing/upload and returned by /keys/query.
+type CrossSigningKey struct {
+	UserID     string              `json:"user_id"`
+	Usage      []CrossSigningUsage `json:"usage"`
+	Keys       map[string]Ed25519  `json:"keys"`
+	Signatures Signatures          `json:"signatures,omitempty"`
+}
+
+// PublicKey returns the Ed25519 key of the CrossSigningKey.  Returns error if
+// the key doesn't contain exactly one Ed25519 key.
+func (k *CrossSigningKey) PublicKey() (Ed25519, error) {
+	if len(k.Keys) != 1 {
+		return "", fmt.Errorf("Cross-signing key has %d keys, expected 1", len(k.Keys))
+	}
+	for keyID, key := range k.Keys {
+		if keyID != "ed25519:"+string(key) {
+			return "", fmt.Errorf("Cross-signing key ID %s doesn't match key %s", keyID, key)
+		}
+		return key, nil
+	}
+	panic("unreachable")
+}
+
+// validate checks that the CrossSigningKey belongs to userID, has the given
+// usage and holds exactly one valid Ed25519 key.  Returns error on failure.
+func (k *CrossSigningKey) validate(userID string, usage CrossSigningUsage) error {
+	if k.UserID != userID {
+		return fmt.Errorf("Cross-signing key of %s was returned for %s", k.UserID, userID)
+	}
+	if !k.HasUsage(usage) {
+		return fmt.Errorf("Cross-signing key of %s isn't a %s key", userID, usage)
+	}
+	key, err := k.PublicKey()
+	if err != nil {
+		return err
+	}
+	_, err = key.Bytes()
+	return err
+}
+
+// validCrossSigningKey returns the CrossSigningKey of userID, or nil if it is
+// missing or invalid.
+func validCrossSigningKey(k *CrossSigningKey, userID string, usage CrossSigningUsage) *CrossSigningKey {
+	if k == nil || k.validate(userID, usage) != nil {
+		return nil
+	}
+	return k
+}
+
+// HasUsage returns true if the CrossSigningKey has the given usage.
+func (k *CrossSigningKey) HasUsage(usage CrossSigningUsage) bool {
+	for _, u := range k.Usage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// SigningKey stores an Ed25519 key pair that isn't bound to a device, such as
+// a cross-signing key.
+type SigningKey struct {
+	privateKey ed25519.PrivateKey
+}
+
+// NewSigningKey creates a new random SigningKey.
+func NewSigningKey() *SigningKey {
+	seed := make([]byte, ed25519.SeedSize)
+	_, err := crand.Read(seed)
+	if err != nil {
+		panic("Couldn't get enough randomness from crypto/rand")
+	}
+	k, err := SigningKeyFromSeed(seed)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// SigningKeyFromSeed loads a SigningKey from its 32 byte seed.  Returns error
+// on failure.
+func SigningKeyFromSeed(seed []byte) (*SigningKey, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Invalid seed length %d, expected %d", len(seed), ed25519.SeedSize)
+	}
+	return &SigningKey{privateKey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// Seed returns the seed of the SigningKey.  This is the private key that is
+// stored in secret storage.
+func (k *SigningKey) Seed() []byte {
+	return k.privateKey.Seed()
+}
+
+// PublicKey returns the public part of the SigningKey.
+func (k *SigningKey) PublicKey() Ed25519 {
+	return Ed25519(base64.RawStdEncoding.EncodeToString(k.privateKey.Public().(ed25519.PublicKey)))
+}
+
+// Sign returns the signature of a message using the SigningKey, encoded as
+// base64 like the signatures returned by Account.Sign.
+func (k *SigningKey) Sign(message string) string {
+	return base64.RawStdEncoding.EncodeToString(ed25519.Sign(k.privateKey, []byte(message)))
+}
+
+// SignJSON signs the JSON object _obj following the Matrix specification, as
+// Account.SignJSON does, adding the signature under userID and the key ID
+// "ed25519:<public key>".  If the _obj is a struct, the `json` tags will be
+// honored.
+func (k *SigningKey) SignJSON(_obj interface{}, userID string) (map[string]interface{}, error) {
+	return signJSON(_obj, userID, "ed25519:"+string(k.PublicKey()), k.Sign)
+}
+
+// signatures signs the JSON object _obj and returns only its signatures.
+func (k *SigningKey) signatures(_obj interface{}, userID string) (Signatures, error) {
+	signed, err := k.SignJSON(_obj, userID)
+	if err != nil {
+		return nil, err
+	}
+	return toSignatures(signed["signatures"])
+}
+
+// crossSigningKey returns the public CrossSigningKey of the SigningKey.
+func (k *SigningKey) crossSigningKey(userID string, usage CrossSigningUsage) *CrossSigningKey {
+	publicKey := k.PublicKey()
+	return &CrossSigningKey{
+		UserID:     userID,
+		Usage:      []CrossSigningUsage{usage},
+		Keys:       map[string]Ed25519{"ed25519:" + string(publicKey): publicKey},
+		Signatures: Signatures{},
+	}
+}
+
+// CrossSigningKeys stores the private cross-signing keys of a user.
+type CrossSigningKeys struct {
+	UserID      string
+	Master      *SigningKey
+	SelfSigning *SigningKey
+	UserSigning *SigningKey
+}
+
+// NewCrossSigningKeys generates new master, self-signing and user-signing keys
+// for userID.
+func NewCrossSigningKeys(userID string) *CrossSigningKeys {
+	return &CrossSigningKeys{
+		UserID:      userID,
+		Master:      NewSigningKey(),
+		SelfSigning: NewSigningKey(),
+		UserSigning: NewSigningKey(),
+	}
+}
+
+// PublicCrossSigningKeys holds the public cross-signing keys of a user.
+type PublicCrossSigningKeys struct {
+	Master      *CrossSigningKey `json:"master_key"`
+	SelfSigning *CrossSigningKey `json:"self_signing_key"`
+	UserSigning *CrossSigningKey `json:"user_signing_key,omitempty"`
+}
+
+// PublicKeys returns the public cross-signing keys, with the self-signing and
+// user-signing keys signed by the master key, ready to be uploaded to
+// /keys/device_signing/upload.  Returns error on failure.
+func (k *CrossSigningKeys) PublicKeys() (*PublicCrossSigningKeys, error) {
+	master := k.Master.crossSigningKey(k.UserID, CrossSigningUsageMaster)
+	selfSigning := k.SelfSigning.crossSigningKey(k.UserID, CrossSigningUsageSelfSigning)
+	userSigning := k.UserSigning.crossSigningKey(k.UserID, CrossSigningUsageUserSigning)
+	var err error
+	selfSigning.Signatures, err = k.Master.signatures(selfSigning, k.UserID)
+	if err != nil {
+		return nil, err
+	}
+	userSigning.Signatures, err = k.Master.signatures(userSigning, k.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return &PublicCrossSigningKeys{Master: master, SelfSigning: selfSigning, UserSigning: userSigning}, nil
+}
+
+// SignDevice signs the device keys of one of our own devices with the
+// self-signing key.  The returned object holds the device keys with the new
+// signature added, ready to be uploaded to /keys/signatures/upload.
+func (k *CrossSigningKeys) SignDevice(deviceKeys interface{}) (map[string]interface{}, error) {
+	return k.SelfSigning.SignJSON(deviceKeys, k.UserID)
+}
+
+// SignMasterKey signs our own master key with the device's Account, so that
+// other devices which trust this device can trust the master key.
+func (k *CrossSigningKeys) SignMasterKey(a *Account, deviceID string) (*CrossSigningKey, error) {
+	master := k.Master.crossSigningKey(k.UserID, CrossSigningUsageMaster)
+	signed, err := a.SignJSON(master, k.UserID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	master.Signatures, err = toSignatures(signed.(map[string]interface{})["signatures"])
+	if err != nil {
+		return nil, err
+	}
+	return master, nil
+}
+
+// SignUser signs the master key of another user with the user-signing key,
+// marking that user as verified.  Returns a copy of the master key with the
+// new signature added, ready to be uploaded to /keys/signatures/upload.
+func (k *CrossSigningKeys) SignUser(masterKey *CrossSigningKey) (*CrossSigningKey, error) {
+	if !masterKey.HasUsage(CrossSigningUsageMaster) {
+		return nil, fmt.Errorf("Key isn't a master key")
+	}
+	signatures, err := k.UserSigning.signatures(masterKey, k.UserID)
+	if err != nil {
+		return nil, err
+	}
+	signed := *masterKey
+	signed.Signatures = signatures
+	return &signed, nil
+}
+
+// Store encrypts the private cross-signing keys with the secret storage key.
+// Returns the account data content of each secret by secret name.
+func (k *CrossSigningKeys) Store(ssk *SecretStorageKey) (map[string]*EncryptedSecretContent, error) {
+	secrets := map[string]*SigningKey{
+		SecretCrossSigningMaster:      k.Master,
+		SecretCrossSigningSelfSigning: k.SelfSigning,
+		SecretCrossSigningUserSigning: k.UserSigning,
+	}
+	contents := map[string]*EncryptedSecretContent{}
+	for name, key := range secrets {
+		content, err := ssk.EncryptContent(name, base64.RawStdEncoding.EncodeToString(key.Seed()))
+		if err != nil {
+			return nil, err
+		}
+		contents[name] = content
+	}
+	return contents, nil
+}
+
+// CrossSigningKeysFromStorage decrypts the private cross-signing keys of
+// userID from the account data contents returned by CrossSigningKeys.Store.
+// Returns error on failure.
+func CrossSigningKeysFromStorage(userID string, ssk *SecretStorageKey, contents map[string]*EncryptedSecretContent) (*CrossSigningKeys, error) {
+	load := func(name string) (*SigningKey, error) {
+		content, ok := contents[name]
+		if !ok {
+			return nil, fmt.Errorf("Missing secret %s", name)
+		}
+		secret, err := ssk.DecryptContent(name, content)
+		if err != nil {
+			return nil, err
+		}
+		seed, err := decodeBase64(secret)
+		if err != nil {
+			return nil, err
+		}
+		return SigningKeyFromSeed(seed)
+	}
+	var k CrossSigningKeys
+	var err error
+	k.UserID = userID
+	if k.Master, err = load(SecretCrossSigningMaster); err != nil {
+		return nil, err
+	}
+	if k.SelfSigning, err = load(SecretCrossSigningSelfSigning); err != nil {
+		return nil, err
+	}
+	if k.UserSigning, err = load(SecretCrossSigningUserSigning); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// TrustState is the level of trust in a device.
+type TrustState int
+
+const (
+	// TrustStateUnverified means the device isn't signed by its user's
+	// self-signing key.
+	TrustStateUnverified TrustState = iota
+	// TrustStateCrossSigned means the device is signed by its user's
+	// self-signing key, but the user's master key isn't verified.
+	TrustStateCrossSigned
+	// TrustStateVerified means the device is signed by its user's
+	// self-signing key, which is signed by a master key we have verified.
+	TrustStateVerified
+)
+
+func (t TrustState) String() string {
+	switch t {
+	case TrustStateUnverified:
+		return "unverified"
+	case TrustStateCrossSigned:
+		return "cross-signed"
+	case TrustStateVerified:
+		return "verified"
+	default:
+		return fmt.Sprintf("TrustState(%d)", int(t))
+	}
+}
+
+// verifyKeySignature checks that _obj is signed by userID with the public key
+// of signer.  Returns false without error if the signature is missing.
+func (u *Utility) verifyKeySignature(_obj interface{}, userID string, signer Ed25519) (bool, error) {
+	obj, err := jsonObject(_obj)
+	if err != nil {
+		return false, err
+	}
+	if !hasSignature(obj, userID, "ed25519:"+string(signer)) {
+		return false, nil
+	}
+	return u.VerifySignatureJSON(obj, userID, string(signer), signer)
+}
+
+// VerifyCrossSigningKey checks that the cross-signing key of a user is signed
+// by the user's master key.  Returns true if the verification succeeds or
+// false otherwise.  Returns error on failure.
+func (u *Utility) VerifyCrossSigningKey(key, master *CrossSigningKey) (bool, error) {
+	if !master.HasUsage(CrossSigningUsageMaster) {
+		return false, fmt.Errorf("Key isn't a master key")
+	}
+	if key.UserID != master.UserID {
+		return false, fmt.Errorf("Key of %s can't be signed by master key of %s", key.UserID, master.UserID)
+	}
+	if _, err := key.PublicKey(); err != nil {
+		return false, err
+	}
+	masterKey, err := master.PublicKey()
+	if err != nil {
+		return false, err
+	}
+	return u.verifyKeySignature(key, master.UserID, masterKey)
+}
+
+// VerifyUser checks that the master key of another user is signed by our
+// user-signing key, which is signed by our master key.  Returns true if the
+// verification succeeds or false otherwise.  Returns error on failure.
+func (u *Utility) VerifyUser(theirMaster *CrossSigningKey, ours *PublicCrossSigningKeys) (bool, error) {
+	if ours.UserSigning == nil {
+		return false, nil
+	}
+	ok, err := u.VerifyCrossSigningKey(ours.UserSigning, ours.Master)
+	if err != nil || !ok {
+		return false, err
+	}
+	if !ours.UserSigning.HasUsage(CrossSigningUsageUserSigning) {
+		return false, fmt.Errorf("Key isn't a user-signing key")
+	}
+	userSigningKey, err := ours.UserSigning.PublicKey()
+	if err != nil {
+		return false, err
+	}
+	return u.verifyKeySignature(theirMaster, ours.Master.UserID, userSigningKey)
+}
+
+// DeviceTrust computes the trust of the device keys of the device deviceID of
+// userID.  keys are the public cross-signing keys of userID and
+// masterVerified is true if we have verified the master key of userID, either
+// because it is our own trusted master key or because VerifyUser succeeded.
+// deviceKeys can be a struct, the map returned by CrossSigningKeys.SignDevice
+// or their JSON encoding.  Returns error on failure.
+func (u *Utility) DeviceTrust(deviceKeys interface{}, userID string, keys *PublicCrossSigningKeys, masterVerified bool) (TrustState, error) {
+	if keys == nil || keys.Master == nil || keys.SelfSigning == nil {
+		return TrustStateUnverified, nil
+	}
+	if keys.Master.UserID != userID {
+		return TrustStateUnverified, fmt.Errorf("Master key belongs to %s, not %s", keys.Master.UserID, userID)
+	}
+	if !keys.SelfSigning.HasUsage(CrossSigningUsageSelfSigning) {
+		return TrustStateUnverified, fmt.Errorf("Key isn't a self-signing key")
+	}
+	ok, err := u.VerifyCrossSigningKey(keys.SelfSigning, keys.Master)
+	if err != nil || !ok {
+		return TrustStateUnverified, err
+	}
+	selfSigningKey, err := keys.SelfSigning.PublicKey()
+	if err != nil {
+		return TrustStateUnverified, err
+	}
+	ok, err = u.verifyKeySignature(deviceKeys, userID, selfSigningKey)
+	if err != nil || !ok {
+		return TrustStateUnverified, err
+	}
+	if masterVerified {
+		return TrustStateVerified, nil
+	}
+	return TrustStateCrossSigned, nil
+}
@@ -0,0 +1,152 @@
+package olm
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// reparse converts the result of SignJSON back to a struct.
+func reparse(t *testing.T, in, out interface{}) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrossSigning(t *testing.T) {
+	u := NewUtility()
+	alice := NewCrossSigningKeys("@alice:example.org")
+	alicePublic, err := alice.PublicKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := u.VerifyCrossSigningKey(alicePublic.SelfSigning, alicePublic.Master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("Self-signing key isn't signed by the master key")
+	}
+
+	// Sign one of Alice's devices with her self-signing key
+	device := *newTestDeviceKeys(t, NewAccount(), "@alice:example.org", "ALICEDEVICE")
+	trust, err := u.DeviceTrust(device, device.UserID, alicePublic, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trust != TrustStateUnverified {
+		t.Fatal("Device not signed by the self-signing key should be unverified, got", trust)
+	}
+
+	crossSigned, err := alice.SignDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The signed map and its JSON encoding are accepted as they are
+	data, err := json.Marshal(crossSigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, signed := range []interface{}{crossSigned, data, json.RawMessage(data)} {
+		trust, err = u.DeviceTrust(signed, device.UserID, alicePublic, true)
+		if err != nil || trust != TrustStateVerified {
+			t.Fatalf("DeviceTrust() of a %T = %v, %v", signed, trust, err)
+		}
+	}
+	if _, err := u.DeviceTrust("device", device.UserID, alicePublic, true); err == nil {
+		t.Fatal("DeviceTrust() should fail for a string")
+	}
+	if _, err := u.VerifySignatureJSON([]string{}, device.UserID, device.DeviceID, device.Ed25519()); err == nil {
+		t.Fatal("VerifySignatureJSON() should fail for a slice")
+	}
+
+	reparse(t, crossSigned, &device)
+	if len(device.Signatures[device.UserID]) != 2 {
+		t.Fatal("Device should keep its own signature, got", device.Signatures)
+	}
+	trust, err = u.DeviceTrust(device, device.UserID, alicePublic, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trust != TrustStateCrossSigned {
+		t.Fatal("Device signed by an unverified master key should be cross-signed, got", trust)
+	}
+	trust, err = u.DeviceTrust(device, device.UserID, alicePublic, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trust != TrustStateVerified {
+		t.Fatal("Device signed by a verified master key should be verified, got", trust)
+	}
+
+	// Another user's keys can't be used to sign Alice's device
+	mallory := NewCrossSigningKeys("@alice:example.org")
+	malloryPublic, err := mallory.PublicKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trust, err = u.DeviceTrust(device, device.UserID, malloryPublic, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trust != TrustStateUnverified {
+		t.Fatal("Device should be unverified with another self-signing key, got", trust)
+	}
+
+	// Bob verifies Alice
+	bob := NewCrossSigningKeys("@bob:example.org")
+	bobPublic, err := bob.PublicKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = u.VerifyUser(alicePublic.Master, bobPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("Alice shouldn't be verified by Bob before he signs her master key")
+	}
+	aliceMaster, err := bob.SignUser(alicePublic.Master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = u.VerifyUser(aliceMaster, bobPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("Alice should be verified by Bob after he signs her master key")
+	}
+	_, err = bob.SignUser(alicePublic.SelfSigning)
+	if err == nil {
+		t.Fatal("SignUser() of a self-signing key should fail")
+	}
+}
+
+func TestCrossSigningStorage(t *testing.T) {
+	alice := NewCrossSigningKeys("@alice:example.org")
+	ssk := NewSecretStorageKey("Default key")
+	contents, err := alice.Store(ssk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := CrossSigningKeysFromStorage("@alice:example.org", ssk, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Master.Seed(), alice.Master.Seed()) ||
+		!bytes.Equal(loaded.SelfSigning.Seed(), alice.SelfSigning.Seed()) ||
+		!bytes.Equal(loaded.UserSigning.Seed(), alice.UserSigning.Seed()) {
+		t.Fatal("Keys loaded from secret storage don't match")
+	}
+	delete(contents, SecretCrossSigningUserSigning)
+	_, err = CrossSigningKeysFromStorage("@alice:example.org", ssk, contents)
+	if err == nil {
+		t.Fatal("CrossSigningKeysFromStorage() with a missing key should fail")
+	}
+}
@@ -0,0 +1,348 @@
+package olm
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// DeviceKeys is the identity of a device as uploaded to /keys/upload and
+// returned by /keys/query.
+type DeviceKeys struct {
+	UserID     string                 `json:"user_id"`
+	DeviceID   string                 `json:"device_id"`
+	Algorithms []Algorithm            `json:"algorithms"`
+	Keys       map[string]string      `json:"keys"`
+	Signatures Signatures             `json:"signatures,omitempty"`
+	Unsigned   map[string]interface{} `json:"unsigned,omitempty"`
+
+	// raw is the JSON the DeviceKeys were decoded from, which may hold
+	// signed fields the struct doesn't know about.
+	raw json.RawMessage
+}
+
+// UnmarshalJSON implements json.Unmarshaler.  The JSON is kept so that Verify
+// checks the signature over the object as the server returned it.
+func (d *DeviceKeys) UnmarshalJSON(data []byte) error {
+	type deviceKeys DeviceKeys
+	var keys deviceKeys
+	err := json.Unmarshal(data, &keys)
+	if err != nil {
+		return err
+	}
+	*d = DeviceKeys(keys)
+	d.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// Ed25519 returns the Ed25519 key of the device, or an empty key if there is
+// none.
+func (d *DeviceKeys) Ed25519() Ed25519 {
+	return Ed25519(d.Keys["ed25519:"+d.DeviceID])
+}
+
+// Curve25519 returns the Curve25519 key of the device, or an empty key if
+// there is none.
+func (d *DeviceKeys) Curve25519() Curve25519 {
+	return Curve25519(d.Keys["curve25519:"+d.DeviceID])
+}
+
+// signedObject returns the JSON the DeviceKeys were decoded from, or the
+// DeviceKeys themselves if they weren't decoded from JSON or were changed
+// since.
+func (d *DeviceKeys) signedObject() interface{} {
+	if d.raw == nil {
+		return d
+	}
+	var decoded DeviceKeys
+	err := json.Unmarshal(d.raw, &decoded)
+	if err != nil || decoded.UserID != d.UserID || decoded.DeviceID != d.DeviceID ||
+		!reflect.DeepEqual(decoded.Algorithms, d.Algorithms) || !reflect.DeepEqual(decoded.Keys, d.Keys) {
+		return d
+	}
+	return d.raw
+}
+
+// Verify checks that the device keys are complete and signed by the device's
+// own Ed25519 key.  If the DeviceKeys were decoded from JSON, the signature
+// is checked over that JSON, including the fields unknown to DeviceKeys.
+// Returns error on failure.
+func (d *DeviceKeys) Verify() error {
+	if len(d.UserID) == 0 || len(d.DeviceID) == 0 {
+		return fmt.Errorf("Device keys without user or device ID")
+	}
+	if len(d.Ed25519()) == 0 {
+		return fmt.Errorf("Device %s of %s has no Ed25519 key", d.DeviceID, d.UserID)
+	}
+	if len(d.Curve25519()) == 0 {
+		return fmt.Errorf("Device %s of %s has no Curve25519 key", d.DeviceID, d.UserID)
+	}
+	if _, err := d.Ed25519().Bytes(); err != nil {
+		return fmt.Errorf("Ed25519 key of device %s of %s is invalid: %v", d.DeviceID, d.UserID, err)
+	}
+	if _, err := d.Curve25519().Bytes(); err != nil {
+		return fmt.Errorf("Curve25519 key of device %s of %s is invalid: %v", d.DeviceID, d.UserID, err)
+	}
+	ok, err := VerifySignatureJSON(d.signedObject(), d.UserID, d.DeviceID, d.Ed25519())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Device %s of %s has an invalid signature", d.DeviceID, d.UserID)
+	}
+	return nil
+}
+
+// DeviceKeys returns the identity keys of the Account as the device deviceID
+// of userID, signed with Account.SignJSON and ready for /keys/upload.
+// Returns error on failure.
+func (a *Account) DeviceKeys(userID, deviceID string) (*DeviceKeys, error) {
+	ed25519Key, curve25519Key := a.IdentityKeys()
+	d := &DeviceKeys{
+		UserID:     userID,
+		DeviceID:   deviceID,
+		Algorithms: []Algorithm{AlgorithmOlmV1, AlgorithmMegolmV1},
+		Keys: map[string]string{
+			"curve25519:" + deviceID: string(curve25519Key),
+			"ed25519:" + deviceID:    string(ed25519Key),
+		},
+	}
+	signed, err := a.SignJSON(d, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	d.Signatures, err = toSignatures(signed.(map[string]interface{})["signatures"])
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// KeysUploadRequest is the body of a /keys/upload request.
+type KeysUploadRequest struct {
+	DeviceKeys  *DeviceKeys                  `json:"device_keys,omitempty"`
+	OneTimeKeys map[string]*SignedOneTimeKey `json:"one_time_keys,omitempty"`
+}
+
+// KeysQueryResponse is the response of /keys/query.
+type KeysQueryResponse struct {
+	Failures        map[string]interface{}            `json:"failures,omitempty"`
+	DeviceKeys      map[string]map[string]*DeviceKeys `json:"device_keys"`
+	MasterKeys      map[string]*CrossSigningKey       `json:"master_keys,omitempty"`
+	SelfSigningKeys map[string]*CrossSigningKey       `json:"self_signing_keys,omitempty"`
+	UserSigningKeys map[string]*CrossSigningKey       `json:"user_signing_keys,omitempty"`
+}
+
+// DeviceErrors maps from userID to a map from deviceID to the reason a device
+// was rejected.
+type DeviceErrors map[string]map[string]error
+
+// add records the error of the device deviceID of userID.
+func (e DeviceErrors) add(userID, deviceID string, err error) {
+	if e[userID] == nil {
+		e[userID] = map[string]error{}
+	}
+	e[userID][deviceID] = err
+}
+
+// Device is a device whose keys have been validated by a DeviceTracker.
+type Device struct {
+	UserID     string
+	DeviceID   string
+	Ed25519    Ed25519
+	Curve25519 Curve25519
+	Keys       *DeviceKeys
+}
+
+// DeviceTracker tracks the devices of the users we share encrypted rooms
+// with.  It is safe for concurrent use.
+type DeviceTracker struct {
+	mu           sync.Mutex
+	devices      map[string]map[string]*Device
+	senderKeys   map[Curve25519]*Device
+	crossSigning map[string]*PublicCrossSigningKeys
+	tracked      map[string]bool
+	outdated     map[string]bool
+}
+
+// NewDeviceTracker creates a new DeviceTracker which doesn't track any user.
+func NewDeviceTracker() *DeviceTracker {
+	return &DeviceTracker{
+		devices:      map[string]map[string]*Device{},
+		senderKeys:   map[Curve25519]*Device{},
+		crossSigning: map[string]*PublicCrossSigningKeys{},
+		tracked:      map[string]bool{},
+		outdated:     map[string]bool{},
+	}
+}
+
+// Track starts tracking the devices of the users.  Users that weren't tracked
+// before are marked as outdated.
+func (t *DeviceTracker) Track(userIDs ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, userID := range userIDs {
+		if !t.tracked[userID] {
+			t.tracked[userID] = true
+			t.outdated[userID] = true
+		}
+	}
+}
+
+// Untrack stops tracking the devices of the users and forgets their devices.
+func (t *DeviceTracker) Untrack(userIDs ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, userID := range userIDs {
+		for _, device := range t.devices[userID] {
+			delete(t.senderKeys, device.Curve25519)
+		}
+		delete(t.devices, userID)
+		delete(t.crossSigning, userID)
+		delete(t.tracked, userID)
+		delete(t.outdated, userID)
+	}
+}
+
+// DeviceListsChanged handles the device_lists of a /sync response.  Tracked
+// users in changed are marked as outdated and users in left are untracked.
+func (t *DeviceTracker) DeviceListsChanged(changed, left []string) {
+	t.mu.Lock()
+	for _, userID := range changed {
+		if t.tracked[userID] {
+			t.outdated[userID] = true
+		}
+	}
+	t.mu.Unlock()
+	t.Untrack(left...)
+}
+
+// OutdatedUsers returns the sorted list of users whose devices must be
+// queried with /keys/query.
+func (t *DeviceTracker) OutdatedUsers() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	userIDs := make([]string, 0, len(t.outdated))
+	for userID := range t.outdated {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+// IsOutdated returns true if the devices of the user must be queried.
+func (t *DeviceTracker) IsOutdated(userID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.outdated[userID]
+}
+
+// Ingest updates the tracked users from a /keys/query response.  The device
+// list of every tracked user in the response is replaced and the user is no
+// longer outdated.  Devices whose keys are invalid or aren't signed by their
+// own Ed25519 key, or whose keys changed since they were first seen, are
+// rejected and their previous keys, if any, are kept.  Invalid cross-signing
+// keys are dropped.  Returns the rejected devices.
+func (t *DeviceTracker) Ingest(resp *KeysQueryResponse) DeviceErrors {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rejected := DeviceErrors{}
+	for userID, devices := range resp.DeviceKeys {
+		if !t.tracked[userID] {
+			continue
+		}
+		old := t.devices[userID]
+		updated := map[string]*Device{}
+		for deviceID, keys := range devices {
+			device, err := t.validate(userID, deviceID, keys, old[deviceID])
+			if err != nil {
+				rejected.add(userID, deviceID, err)
+				if old[deviceID] != nil {
+					updated[deviceID] = old[deviceID]
+				}
+				continue
+			}
+			updated[deviceID] = device
+		}
+		for _, device := range old {
+			delete(t.senderKeys, device.Curve25519)
+		}
+		for _, device := range updated {
+			t.senderKeys[device.Curve25519] = device
+		}
+		t.devices[userID] = updated
+		t.crossSigning[userID] = &PublicCrossSigningKeys{
+			Master:      validCrossSigningKey(resp.MasterKeys[userID], userID, CrossSigningUsageMaster),
+			SelfSigning: validCrossSigningKey(resp.SelfSigningKeys[userID], userID, CrossSigningUsageSelfSigning),
+			UserSigning: validCrossSigningKey(resp.UserSigningKeys[userID], userID, CrossSigningUsageUserSigning),
+		}
+		delete(t.outdated, userID)
+	}
+	return rejected
+}
+
+// validate checks the keys of a device from a /keys/query response against
+// the previously known device, if any.
+func (t *DeviceTracker) validate(userID, deviceID string, keys *DeviceKeys, old *Device) (*Device, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("Device %s of %s has no keys", deviceID, userID)
+	}
+	if keys.UserID != userID || keys.DeviceID != deviceID {
+		return nil, fmt.Errorf("Device %s of %s was returned as device %s of %s", keys.DeviceID, keys.UserID, deviceID, userID)
+	}
+	err := keys.Verify()
+	if err != nil {
+		return nil, err
+	}
+	if old != nil && (old.Ed25519 != keys.Ed25519() || old.Curve25519 != keys.Curve25519()) {
+		return nil, fmt.Errorf("Keys of device %s of %s changed", deviceID, userID)
+	}
+	if existing, ok := t.senderKeys[keys.Curve25519()]; ok && (existing.UserID != userID || existing.DeviceID != deviceID) {
+		return nil, fmt.Errorf("Curve25519 key of device %s of %s is already used by device %s of %s", deviceID, userID, existing.DeviceID, existing.UserID)
+	}
+	return &Device{
+		UserID:     userID,
+		DeviceID:   deviceID,
+		Ed25519:    keys.Ed25519(),
+		Curve25519: keys.Curve25519(),
+		Keys:       keys,
+	}, nil
+}
+
+// Devices returns the known devices of the user sorted by device ID.
+func (t *DeviceTracker) Devices(userID string) []*Device {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	devices := make([]*Device, 0, len(t.devices[userID]))
+	for _, device := range t.devices[userID] {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	return devices
+}
+
+// Device returns the device deviceID of userID, or nil if it isn't known.
+func (t *DeviceTracker) Device(userID, deviceID string) *Device {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.devices[userID][deviceID]
+}
+
+// CrossSigningKeys returns the public cross-signing keys of the user from the
+// last /keys/query response, or nil if they aren't known.
+func (t *DeviceTracker) CrossSigningKeys(userID string) *PublicCrossSigningKeys {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.crossSigning[userID]
+}
+
+// LookupSenderKey returns the device whose Curve25519 identity key is
+// senderKey.  Returns false if no known device has that key.
+func (t *DeviceTracker) LookupSenderKey(senderKey Curve25519) (*Device, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	device, ok := t.senderKeys[senderKey]
+	return device, ok
+}
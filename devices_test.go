@@ -0,0 +1,222 @@
+package olm
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// newTestDeviceKeys returns the device keys of the Account signed by itself.
+func newTestDeviceKeys(t *testing.T, a *Account, userID, deviceID string) *DeviceKeys {
+	keys, err := a.DeviceKeys(userID, deviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestDeviceKeys(t *testing.T) {
+	a := NewAccount()
+	ed25519Key, curve25519Key := a.IdentityKeys()
+	keys, err := a.DeviceKeys("@alice:example.org", "DEVICEID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Ed25519() != ed25519Key || keys.Curve25519() != curve25519Key {
+		t.Fatal("DeviceKeys() has the wrong identity keys:", keys.Keys)
+	}
+
+	// Round-trip through JSON as the server would
+	var uploaded KeysUploadRequest
+	reparse(t, KeysUploadRequest{DeviceKeys: keys}, &uploaded)
+	ok, err := VerifySignatureJSON(uploaded.DeviceKeys, "@alice:example.org", "DEVICEID", ed25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("DeviceKeys() signature verification failed")
+	}
+	if err = uploaded.DeviceKeys.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unsigned data isn't covered by the signature
+	uploaded.DeviceKeys.Unsigned = map[string]interface{}{"device_display_name": "Alice's phone"}
+	if err = uploaded.DeviceKeys.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Any other change invalidates it
+	uploaded.DeviceKeys.Algorithms = []Algorithm{AlgorithmOlmV1}
+	ok, err = VerifySignatureJSON(uploaded.DeviceKeys, "@alice:example.org", "DEVICEID", ed25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("Signature of modified device keys should be invalid")
+	}
+}
+
+func TestDeviceTracker(t *testing.T) {
+	tracker := NewDeviceTracker()
+	tracker.Track("@alice:example.org", "@bob:example.org")
+	outdated := tracker.OutdatedUsers()
+	if len(outdated) != 2 || outdated[0] != "@alice:example.org" {
+		t.Fatal("OutdatedUsers() =", outdated)
+	}
+
+	alice1 := NewAccount()
+	alice2 := NewAccount()
+	bob := NewAccount()
+	alice1Keys := newTestDeviceKeys(t, alice1, "@alice:example.org", "ALICE1")
+	alice2Keys := newTestDeviceKeys(t, alice2, "@alice:example.org", "ALICE2")
+	bobKeys := newTestDeviceKeys(t, bob, "@bob:example.org", "BOB")
+
+	// Tamper with Bob's device so that its signature is invalid
+	badBobKeys := *bobKeys
+	badBobKeys.Algorithms = []Algorithm{AlgorithmOlmV1}
+
+	rejected := tracker.Ingest(&KeysQueryResponse{
+		DeviceKeys: map[string]map[string]*DeviceKeys{
+			"@alice:example.org": {"ALICE1": alice1Keys, "ALICE2": alice2Keys},
+			"@bob:example.org":   {"BOB": &badBobKeys},
+			"@carol:example.org": {"CAROL": bobKeys},
+		},
+	})
+	if len(rejected) != 1 || rejected["@bob:example.org"]["BOB"] == nil {
+		t.Fatal("Ingest() should reject Bob's tampered device, got", rejected)
+	}
+	t.Log("Rejected:", rejected["@bob:example.org"]["BOB"])
+	if len(tracker.OutdatedUsers()) != 0 {
+		t.Fatal("No user should be outdated after Ingest(), got", tracker.OutdatedUsers())
+	}
+	if tracker.Device("@bob:example.org", "BOB") != nil {
+		t.Fatal("Bob's tampered device shouldn't be known")
+	}
+	if len(tracker.Devices("@carol:example.org")) != 0 {
+		t.Fatal("Devices of untracked users shouldn't be stored")
+	}
+	if len(tracker.Devices("@alice:example.org")) != 2 {
+		t.Fatal("Alice should have 2 devices, got", tracker.Devices("@alice:example.org"))
+	}
+
+	_, alice2Curve25519 := alice2.IdentityKeys()
+	device, ok := tracker.LookupSenderKey(alice2Curve25519)
+	if !ok || device.UserID != "@alice:example.org" || device.DeviceID != "ALICE2" {
+		t.Fatal("LookupSenderKey() =", device, ok)
+	}
+
+	// Alice's second device is replaced by a new account with the same ID
+	tracker.DeviceListsChanged([]string{"@alice:example.org", "@carol:example.org"}, nil)
+	if !tracker.IsOutdated("@alice:example.org") || tracker.IsOutdated("@carol:example.org") {
+		t.Fatal("Only tracked users should become outdated, got", tracker.OutdatedUsers())
+	}
+	rejected = tracker.Ingest(&KeysQueryResponse{
+		DeviceKeys: map[string]map[string]*DeviceKeys{
+			"@alice:example.org": {
+				"ALICE2": newTestDeviceKeys(t, NewAccount(), "@alice:example.org", "ALICE2"),
+			},
+		},
+	})
+	if rejected["@alice:example.org"]["ALICE2"] == nil {
+		t.Fatal("Ingest() should reject a device whose keys changed")
+	}
+	device = tracker.Device("@alice:example.org", "ALICE2")
+	if device == nil || device.Curve25519 != alice2Curve25519 {
+		t.Fatal("Previous keys of a device whose keys changed should be kept, got", device)
+	}
+	if tracker.Device("@alice:example.org", "ALICE1") != nil {
+		t.Fatal("Devices missing from the response should be removed")
+	}
+
+	tracker.DeviceListsChanged(nil, []string{"@alice:example.org"})
+	if _, ok := tracker.LookupSenderKey(alice2Curve25519); ok {
+		t.Fatal("Devices of untracked users shouldn't be found by sender key")
+	}
+}
+
+func TestDeviceTrackerInvalidKeys(t *testing.T) {
+	tracker := NewDeviceTracker()
+	tracker.Track("@alice:example.org", "@evil:example.org")
+	alice := NewAccount()
+	aliceKeys, err := NewCrossSigningKeys("@alice:example.org").PublicKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	evil := NewCrossSigningKeys("@evil:example.org").Master.crossSigningKey("@evil:example.org", CrossSigningUsageMaster)
+	evil.Keys = map[string]Ed25519{"ed25519:AAAA": "AAAA"}
+	badDevice := newTestDeviceKeys(t, NewAccount(), "@alice:example.org", "BAD")
+	badDevice.Keys["curve25519:BAD"] = "not base64!"
+
+	// One invalid key mustn't make the whole response fail to decode
+	var resp KeysQueryResponse
+	reparse(t, &KeysQueryResponse{
+		DeviceKeys: map[string]map[string]*DeviceKeys{
+			"@alice:example.org": {
+				"ALICE": newTestDeviceKeys(t, alice, "@alice:example.org", "ALICE"),
+				"BAD":   badDevice,
+			},
+			"@evil:example.org": {},
+		},
+		MasterKeys:      map[string]*CrossSigningKey{"@alice:example.org": aliceKeys.Master, "@evil:example.org": evil},
+		SelfSigningKeys: map[string]*CrossSigningKey{"@alice:example.org": aliceKeys.SelfSigning},
+		UserSigningKeys: map[string]*CrossSigningKey{"@alice:example.org": aliceKeys.SelfSigning},
+	}, &resp)
+	rejected := tracker.Ingest(&resp)
+	if len(rejected) != 1 || len(rejected["@alice:example.org"]) != 1 || rejected["@alice:example.org"]["BAD"] == nil {
+		t.Fatal("Ingest() should only reject the device with an invalid key, got", rejected)
+	}
+	if tracker.Device("@alice:example.org", "ALICE") == nil {
+		t.Fatal("Valid devices should be kept")
+	}
+	keys := tracker.CrossSigningKeys("@alice:example.org")
+	if keys == nil || keys.Master == nil || keys.SelfSigning == nil {
+		t.Fatal("Valid cross-signing keys should be kept, got", keys)
+	}
+	if keys.UserSigning != nil {
+		t.Fatal("Cross-signing keys with the wrong usage should be dropped")
+	}
+	if keys := tracker.CrossSigningKeys("@evil:example.org"); keys == nil || keys.Master != nil {
+		t.Fatal("Invalid master key should be dropped, got", keys)
+	}
+}
+
+func TestDeviceKeysUnknownFields(t *testing.T) {
+	a := NewAccount()
+	keys := newTestDeviceKeys(t, a, "@alice:example.org", "ALICE")
+	// A field added by a newer version of the specification is signed
+	var obj map[string]interface{}
+	reparse(t, keys, &obj)
+	delete(obj, "signatures")
+	obj["dehydrated"] = true
+	obj["extra"] = map[string]interface{}{"n": 12345678901234567}
+	signed, err := a.SignJSON(obj, "@alice:example.org", "ALICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"device_keys": map[string]interface{}{"@alice:example.org": map[string]interface{}{"ALICE": signed}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp KeysQueryResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	device := resp.DeviceKeys["@alice:example.org"]["ALICE"]
+	if err := device.Verify(); err != nil {
+		t.Fatal("Verify() should check the JSON returned by the server, got", err)
+	}
+	tracker := NewDeviceTracker()
+	tracker.Track("@alice:example.org")
+	if rejected := tracker.Ingest(&resp); len(rejected) != 0 {
+		t.Fatal("Ingest() rejected the device", rejected)
+	}
+
+	// Changing the decoded keys invalidates them
+	_, curve := NewAccount().IdentityKeys()
+	device.Keys["curve25519:ALICE"] = string(curve)
+	if err := device.Verify(); err == nil {
+		t.Fatal("Verify() should fail for keys changed after decoding")
+	}
+}
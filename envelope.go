@@ -0,0 +1,209 @@
+package olm
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// PickleEnvelopeVersion is the version of the PickleEnvelope format.
+const PickleEnvelopeVersion = 1
+
+// PickleEnvelope is a self-describing JSON record holding a pickled object and
+// its metadata.  Only the metadata that applies to Type is set.
+type PickleEnvelope struct {
+	Version   int        `json:"version"`
+	Type      PickleType `json:"type"`
+	Pickle    string     `json:"pickle"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	// UserID and DeviceID identify the device of an Account.
+	UserID   string `json:"user_id,omitempty"`
+	DeviceID string `json:"device_id,omitempty"`
+
+	// SessionID is the ID of a Session or group session.
+	SessionID SessionID `json:"session_id,omitempty"`
+	// SenderKey is the Curve25519 identity key of the other device of a
+	// Session, or of the device that created an InboundGroupSession.
+	SenderKey Curve25519 `json:"sender_key,omitempty"`
+	// RoomID is the room of a group session.
+	RoomID string `json:"room_id,omitempty"`
+	// SenderClaimedKeys are the Ed25519 keys claimed by the device that
+	// created an InboundGroupSession.
+	SenderClaimedKeys map[string]Ed25519 `json:"sender_claimed_keys,omitempty"`
+	// ForwardingCurve25519KeyChain lists the devices through which an
+	// InboundGroupSession was forwarded.
+	ForwardingCurve25519KeyChain []Curve25519 `json:"forwarding_curve25519_key_chain,omitempty"`
+}
+
+// Marshaler is implemented by the objects that can be stored in a
+// PickleEnvelope.
+type Marshaler interface {
+	// MarshalPickle pickles the object with the key and returns the JSON
+	// encoded envelope.  The metadata not known to the object, such as the
+	// room ID, is copied from meta.
+	MarshalPickle(key *PickleKey, meta PickleEnvelope) ([]byte, error)
+}
+
+// marshalEnvelope pickles an object of type t with the ID id and returns the
+// JSON encoded envelope.  CreatedAt defaults to the current time.
+func marshalEnvelope(t PickleType, id SessionID, pickle func(key []byte) string, key *PickleKey, meta PickleEnvelope) ([]byte, error) {
+	raw, err := key.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	meta.Version = PickleEnvelopeVersion
+	meta.Type = t
+	meta.SessionID = id
+	meta.Pickle = pickle(raw)
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now().UTC()
+	}
+	return json.Marshal(meta)
+}
+
+// MarshalPickle implements Marshaler.
+func (a *Account) MarshalPickle(key *PickleKey, meta PickleEnvelope) ([]byte, error) {
+	return marshalEnvelope(PickleTypeAccount, "", a.Pickle, key, meta)
+}
+
+// MarshalPickle implements Marshaler.
+func (s *Session) MarshalPickle(key *PickleKey, meta PickleEnvelope) ([]byte, error) {
+	return marshalEnvelope(PickleTypeSession, s.ID(), s.Pickle, key, meta)
+}
+
+// MarshalPickle implements Marshaler.
+func (s *OutboundGroupSession) MarshalPickle(key *PickleKey, meta PickleEnvelope) ([]byte, error) {
+	return marshalEnvelope(PickleTypeOutboundGroupSession, s.ID(), s.Pickle, key, meta)
+}
+
+// MarshalPickle implements Marshaler.
+func (s *InboundGroupSession) MarshalPickle(key *PickleKey, meta PickleEnvelope) ([]byte, error) {
+	return marshalEnvelope(PickleTypeInboundGroupSession, s.ID(), s.Pickle, key, meta)
+}
+
+// UnmarshalPickleEnvelope decodes a JSON encoded PickleEnvelope.  Returns
+// error if the envelope was written by a newer version of this package, or
+// if its type is unknown, it has no pickle or its sender key is invalid.
+func UnmarshalPickleEnvelope(data []byte) (*PickleEnvelope, error) {
+	var e PickleEnvelope
+	err := json.Unmarshal(data, &e)
+	if err != nil {
+		return nil, err
+	}
+	if e.Version < 1 || e.Version > PickleEnvelopeVersion {
+		return nil, fmt.Errorf("Unsupported pickle envelope version %d", e.Version)
+	}
+	if _, ok := pickleVersions[e.Type]; !ok {
+		return nil, fmt.Errorf("Unknown pickle type %q", e.Type)
+	}
+	if len(e.Pickle) == 0 {
+		return nil, fmt.Errorf("Pickle envelope has no pickle")
+	}
+	if len(e.SenderKey) > 0 {
+		if _, err := e.SenderKey.Bytes(); err != nil {
+			return nil, err
+		}
+	}
+	return &e, nil
+}
+
+// unpickle checks the type of the envelope and returns the key to unpickle
+// it.
+func (e *PickleEnvelope) unpickle(t PickleType, key *PickleKey) ([]byte, error) {
+	if e.Type != t {
+		return nil, fmt.Errorf("Pickle envelope holds a %s, not a %s", e.Type, t)
+	}
+	return key.Bytes()
+}
+
+// checkID checks that the unpickled object has the session ID of the
+// envelope.
+func (e *PickleEnvelope) checkID(id SessionID) error {
+	if len(e.SessionID) > 0 && id != e.SessionID {
+		return fmt.Errorf("Pickle of %s %s holds session %s", e.Type, e.SessionID, id)
+	}
+	return nil
+}
+
+// Account unpickles the Account of the envelope.  Returns error on failure,
+// as AccountFromPickled, or if the envelope doesn't hold an Account.
+func (e *PickleEnvelope) Account(key *PickleKey) (*Account, error) {
+	raw, err := e.unpickle(PickleTypeAccount, key)
+	if err != nil {
+		return nil, err
+	}
+	return AccountFromPickled(e.Pickle, raw)
+}
+
+// Session unpickles the Session of the envelope.  Returns error on failure,
+// as SessionFromPickled, or if the envelope doesn't hold a Session or its
+// session ID doesn't match.
+func (e *PickleEnvelope) Session(key *PickleKey) (*Session, error) {
+	raw, err := e.unpickle(PickleTypeSession, key)
+	if err != nil {
+		return nil, err
+	}
+	s, err := SessionFromPickled(e.Pickle, raw)
+	if err != nil {
+		return nil, err
+	}
+	err = e.checkID(s.ID())
+	if err != nil {
+		s.Clear()
+		return nil, err
+	}
+	return s, nil
+}
+
+// OutboundGroupSession unpickles the OutboundGroupSession of the envelope.
+// Returns error on failure, as OutboundGroupSessionFromPickled, or if the
+// envelope doesn't hold an OutboundGroupSession or its session ID doesn't
+// match.
+func (e *PickleEnvelope) OutboundGroupSession(key *PickleKey) (*OutboundGroupSession, error) {
+	raw, err := e.unpickle(PickleTypeOutboundGroupSession, key)
+	if err != nil {
+		return nil, err
+	}
+	s, err := OutboundGroupSessionFromPickled(e.Pickle, raw)
+	if err != nil {
+		return nil, err
+	}
+	err = e.checkID(s.ID())
+	if err != nil {
+		s.Clear()
+		return nil, err
+	}
+	return s, nil
+}
+
+// InboundGroupSession unpickles the InboundGroupSession of the envelope.
+// Returns error on failure, as InboundGroupSessionFromPickled, or if the
+// envelope doesn't hold an InboundGroupSession or its session ID doesn't
+// match.
+func (e *PickleEnvelope) InboundGroupSession(key *PickleKey) (*InboundGroupSession, error) {
+	raw, err := e.unpickle(PickleTypeInboundGroupSession, key)
+	if err != nil {
+		return nil, err
+	}
+	s, err := InboundGroupSessionFromPickled(e.Pickle, raw)
+	if err != nil {
+		return nil, err
+	}
+	err = e.checkID(s.ID())
+	if err != nil {
+		s.Clear()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Inspect returns the metadata of the pickle of the envelope without
+// unpickling it, as InspectPickleAs.
+func (e *PickleEnvelope) Inspect(key *PickleKey) (*PickleInfo, error) {
+	raw, err := key.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return InspectPickleAs(e.Type, e.Pickle, raw)
+}
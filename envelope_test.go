@@ -0,0 +1,126 @@
+package olm
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestUnmarshalPickleEnvelope(t *testing.T) {
+	key, _ := NewPickleKey([]byte("pickle key"))
+	raw, _ := key.Bytes()
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	data, err := json.Marshal(PickleEnvelope{
+		Version:   PickleEnvelopeVersion,
+		Type:      PickleTypeSession,
+		Pickle:    pickleEncrypt(testSessionPickle(SessionPickleVersion), raw),
+		CreatedAt: created,
+		SenderKey: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(data))
+	e, err := UnmarshalPickleEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.CreatedAt.Equal(created) || e.SenderKey != "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8" {
+		t.Fatal("Wrong metadata", e)
+	}
+	info, err := e.Inspect(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != PickleTypeSession || !info.HasReceivedMessage {
+		t.Fatal("Wrong pickle info", info)
+	}
+	if _, err := e.Account(key); err == nil {
+		t.Fatal("Account() should refuse a session envelope")
+	}
+	if _, err := e.Session(&PickleKey{}); err == nil {
+		t.Fatal("Session() should refuse an empty key")
+	}
+
+	for _, invalid := range []string{
+		`{"version": 2, "type": "session", "pickle": "AAAA"}`,
+		`{"version": 0, "type": "session", "pickle": "AAAA"}`,
+		`{"version": 1, "type": "megolm", "pickle": "AAAA"}`,
+		`{"version": 1, "type": "session"}`,
+		`{"version": 1, "type": "session", "pickle": "AAAA", "sender_key": "AAAA"}`,
+	} {
+		if _, err := UnmarshalPickleEnvelope([]byte(invalid)); err == nil {
+			t.Fatal("UnmarshalPickleEnvelope() should fail for", invalid)
+		}
+	}
+}
+
+func TestPickleEnvelope(t *testing.T) {
+	key, _ := NewPickleKey([]byte("pickle key"))
+	var _ Marshaler = (*Account)(nil)
+	var _ Marshaler = (*Session)(nil)
+
+	a := NewAccount()
+	data, err := a.MarshalPickle(key, PickleEnvelope{UserID: "@alice:example.org", DeviceID: "ALICE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := UnmarshalPickleEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != PickleTypeAccount || e.UserID != "@alice:example.org" || e.CreatedAt.IsZero() {
+		t.Fatal("Wrong account envelope", string(data))
+	}
+	unpickled, err := e.Account(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpickled.IdentityKeysJSON() != a.IdentityKeysJSON() {
+		t.Fatal("Unpickled account doesn't match")
+	}
+	if _, err := a.MarshalPickle(&PickleKey{}, PickleEnvelope{}); err == nil {
+		t.Fatal("MarshalPickle() should refuse an empty key")
+	}
+
+	outbound := NewOutboundGroupSession()
+	data, err = outbound.MarshalPickle(key, PickleEnvelope{RoomID: "!room:example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = UnmarshalPickleEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.SessionID != outbound.ID() || e.RoomID != "!room:example.org" {
+		t.Fatal("Wrong outbound group session envelope", string(data))
+	}
+	if _, err := e.OutboundGroupSession(key); err != nil {
+		t.Fatal(err)
+	}
+
+	inbound, err := NewInboundGroupSession([]byte(outbound.SessionKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, senderKey := a.IdentityKeys()
+	data, err = inbound.MarshalPickle(key, PickleEnvelope{
+		RoomID:                       "!room:example.org",
+		SenderKey:                    senderKey,
+		ForwardingCurve25519KeyChain: []Curve25519{senderKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = UnmarshalPickleEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.SenderKey != senderKey || len(e.ForwardingCurve25519KeyChain) != 1 {
+		t.Fatal("Wrong inbound group session envelope", string(data))
+	}
+	e.SessionID = "other"
+	if s, err := e.InboundGroupSession(key); err == nil || s != nil {
+		t.Fatal("InboundGroupSession() should check the session ID, got", s, err)
+	}
+}
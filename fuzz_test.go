@@ -0,0 +1,211 @@
+//go:build go1.18
+// +build go1.18
+
+package olm
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// The fuzz tests check that the functions decoding untrusted input don't
+// crash, in Go or in C, and report every failure as an error.  Run one with:
+//
+//	go test -run '^$' -fuzz FuzzSessionDecrypt
+
+var fuzzPickleKey = []byte("fuzz pickle key")
+
+// fuzzSessions returns the pickle of Bob's Account, with Alice's Curve25519
+// identity key, and of Bob's in-bound Session after the first of the messages
+// sent by Alice.
+func fuzzSessions(f *testing.F) (bobPickle string, aliceKey Curve25519, sessionPickle string, messages []string, msgTypes []MsgType) {
+	alice := NewAccount()
+	bob := NewAccount()
+	outbound, first, inbound := testSessions(f, alice, bob)
+	_, aliceKey = alice.IdentityKeys()
+	if _, err := inbound.Decrypt(first, MsgTypePreKey); err != nil {
+		f.Fatal(err)
+	}
+	sessionPickle = inbound.Pickle(fuzzPickleKey)
+	messages = append(messages, first)
+	msgTypes = append(msgTypes, MsgTypePreKey)
+	for _, plaintext := range []string{"second", "third"} {
+		msgType, message := outbound.Encrypt(plaintext)
+		messages = append(messages, message)
+		msgTypes = append(msgTypes, msgType)
+	}
+	return bob.Pickle(fuzzPickleKey), aliceKey, sessionPickle, messages, msgTypes
+}
+
+func FuzzSessionDecrypt(f *testing.F) {
+	_, _, sessionPickle, messages, msgTypes := fuzzSessions(f)
+	for i, message := range messages {
+		f.Add(message, uint8(msgTypes[i]))
+	}
+	f.Add(testMessage(3, 16), uint8(MsgTypeMsg))
+	f.Fuzz(func(t *testing.T, message string, msgType uint8) {
+		s, err := SessionFromPickled(sessionPickle, fuzzPickleKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := s.Decrypt(message, MsgType(msgType%2))
+		if err != nil && plaintext != "" {
+			t.Fatal("Decrypt() returned a plain-text with an error", err)
+		}
+		if err != nil && s.Pickle(fuzzPickleKey) != sessionPickle {
+			t.Fatal("Failed Decrypt() changed the Session")
+		}
+	})
+}
+
+func FuzzNewInboundSession(f *testing.F) {
+	bobPickle, aliceKey, _, messages, _ := fuzzSessions(f)
+	f.Add(messages[0])
+	f.Add(testMessage(3, 0))
+	bob, err := AccountFromPickled(bobPickle, fuzzPickleKey)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, message string) {
+		s, err := bob.NewInboundSession(message)
+		if (s == nil) == (err == nil) {
+			t.Fatal("NewInboundSession() returned", s, err)
+		}
+		s, err = bob.NewInboundSessionFrom(aliceKey, message)
+		if (s == nil) == (err == nil) {
+			t.Fatal("NewInboundSessionFrom() returned", s, err)
+		}
+		if s != nil {
+			if ok, err := s.MatchesInboundSessionFrom(string(aliceKey), message); !ok || err != nil {
+				t.Fatal("MatchesInboundSessionFrom() failed for the message of the Session", err)
+			}
+		}
+	})
+}
+
+// fuzzGroupSessions returns the pickle of an InboundGroupSession, its session
+// key and export, and group messages.
+func fuzzGroupSessions(f *testing.F) (inboundPickle, sessionKey, export string, messages []string) {
+	outbound := NewOutboundGroupSession()
+	sessionKey = outbound.SessionKey()
+	inbound, err := NewInboundGroupSession([]byte(sessionKey))
+	if err != nil {
+		f.Fatal(err)
+	}
+	export, err = inbound.Export(0)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, plaintext := range []string{"zero", "one", "two"} {
+		messages = append(messages, outbound.Encrypt(plaintext))
+	}
+	return inbound.Pickle(fuzzPickleKey), sessionKey, export, messages
+}
+
+func FuzzInboundGroupSessionDecrypt(f *testing.F) {
+	inboundPickle, _, _, messages := fuzzGroupSessions(f)
+	for _, message := range messages {
+		f.Add(message)
+	}
+	f.Add(testMessage(3, 80))
+	f.Fuzz(func(t *testing.T, message string) {
+		s, err := InboundGroupSessionFromPickled(inboundPickle, fuzzPickleKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, index, err := s.Decrypt(message)
+		if err != nil && (plaintext != "" || index != 0) {
+			t.Fatal("Decrypt() returned a plain-text with an error", err)
+		}
+	})
+}
+
+func FuzzInboundGroupSessionImport(f *testing.F) {
+	_, sessionKey, export, _ := fuzzGroupSessions(f)
+	f.Add([]byte(sessionKey))
+	f.Add([]byte(export))
+	f.Fuzz(func(t *testing.T, key []byte) {
+		s, err := InboundGroupSessionImport(key)
+		if (s == nil) == (err == nil) {
+			t.Fatal("InboundGroupSessionImport() returned", s, err)
+		}
+		if s != nil {
+			if _, err := s.Export(uint32(s.FirstKnownIndex())); err != nil {
+				t.Fatal("Export() failed for an imported session", err)
+			}
+		}
+		s, err = NewInboundGroupSession(key)
+		if (s == nil) == (err == nil) {
+			t.Fatal("NewInboundGroupSession() returned", s, err)
+		}
+	})
+}
+
+// FuzzFromPickled fuzzes the decrypted pickles, so that the fuzzed input
+// gets past the MAC and reaches the decoding of the objects.
+func FuzzFromPickled(f *testing.F) {
+	bobPickle, _, sessionPickle, _, _ := fuzzSessions(f)
+	inboundPickle, _, _, _ := fuzzGroupSessions(f)
+	for _, pickled := range []string{
+		bobPickle,
+		sessionPickle,
+		inboundPickle,
+		NewOutboundGroupSession().Pickle(fuzzPickleKey),
+	} {
+		plaintext, err := pickleDecrypt(pickled, fuzzPickleKey)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(plaintext)
+		f.Add(plaintext[:len(plaintext)/2])
+	}
+	f.Fuzz(func(t *testing.T, plaintext []byte) {
+		pickled := pickleEncrypt(plaintext, fuzzPickleKey)
+		// Every loaded object must pickle again.
+		if a, err := AccountFromPickled(pickled, fuzzPickleKey); (a == nil) == (err == nil) {
+			t.Fatal("AccountFromPickled() returned", a, err)
+		} else if a != nil {
+			a.Pickle(fuzzPickleKey)
+		}
+		if s, err := SessionFromPickled(pickled, fuzzPickleKey); (s == nil) == (err == nil) {
+			t.Fatal("SessionFromPickled() returned", s, err)
+		} else if s != nil {
+			s.Pickle(fuzzPickleKey)
+		}
+		if s, err := OutboundGroupSessionFromPickled(pickled, fuzzPickleKey); (s == nil) == (err == nil) {
+			t.Fatal("OutboundGroupSessionFromPickled() returned", s, err)
+		} else if s != nil {
+			s.Pickle(fuzzPickleKey)
+		}
+		if s, err := InboundGroupSessionFromPickled(pickled, fuzzPickleKey); (s == nil) == (err == nil) {
+			t.Fatal("InboundGroupSessionFromPickled() returned", s, err)
+		} else if s != nil {
+			s.Pickle(fuzzPickleKey)
+		}
+	})
+}
+
+func FuzzVerifySignatureJSON(f *testing.F) {
+	a := NewAccount()
+	key, _ := a.IdentityKeys()
+	signed, err := a.SignJSON(signedObject{Name: "object"}, "@alice:example.org", "DEVICE")
+	if err != nil {
+		f.Fatal(err)
+	}
+	data, err := json.Marshal(signed)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data, string(key))
+	f.Add([]byte(`{"name":"object","signatures":{"@alice:example.org":{"ed25519:DEVICE":"AAAA"}}}`), string(key))
+	f.Fuzz(func(t *testing.T, data []byte, key string) {
+		var obj signedObject
+		if json.Unmarshal(data, &obj) != nil {
+			return
+		}
+		ok, err := VerifySignatureJSON(obj, "@alice:example.org", "DEVICE", Ed25519(key))
+		if ok && err != nil {
+			t.Fatal("VerifySignatureJSON() succeeded with an error", err)
+		}
+	})
+}
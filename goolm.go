@@ -0,0 +1,271 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Version returns the version number of libolm this pure Go implementation is
+// compatible with.
+func Version() (major, minor, patch uint8) {
+	return 3, 2, 16
+}
+
+// backend is the name of the implementation of the package.
+const backend = "goolm"
+
+// randomBytes returns n bytes from crypto/rand.
+func randomBytes(n int) []byte {
+	random := make([]byte, n)
+	_, err := crand.Read(random)
+	if err != nil {
+		panic("Couldn't get enough randomness from crypto/rand")
+	}
+	return random
+}
+
+// encodeOlmBase64 encodes b as unpadded base64, as libolm does.
+func encodeOlmBase64(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+// decodeOlmBase64 decodes unpadded base64, as libolm does.  Returns error on
+// failure.  If the base64 couldn't be decoded then the error will be
+// "INVALID_BASE64".
+func decodeOlmBase64(input string) ([]byte, error) {
+	b, err := base64.RawStdEncoding.DecodeString(input)
+	if err != nil {
+		return nil, fmt.Errorf("INVALID_BASE64")
+	}
+	return b, nil
+}
+
+// decodeOlmKey decodes a 32 byte key in unpadded base64.  Returns error on
+// failure.  If the base64 couldn't be decoded or doesn't hold 32 bytes then
+// the error will be "INVALID_BASE64".
+func decodeOlmKey(input string) ([]byte, error) {
+	b, err := decodeOlmBase64(input)
+	if err != nil || len(b) != curve25519KeyLen {
+		return nil, fmt.Errorf("INVALID_BASE64")
+	}
+	return b, nil
+}
+
+// curve25519KeyPair is a Curve25519 key pair.  The private key is stored
+// unclamped, as libolm does.
+type curve25519KeyPair struct {
+	public  [curve25519KeyLen]byte
+	private [curve25519KeyLen]byte
+}
+
+// newCurve25519KeyPair creates a key pair from 32 random bytes.
+func newCurve25519KeyPair(random []byte) curve25519KeyPair {
+	var k curve25519KeyPair
+	copy(k.private[:], random)
+	curve25519.ScalarBaseMult(&k.public, &k.private)
+	return k
+}
+
+// sharedSecret returns the Diffie-Hellman shared secret of the key pair and
+// their public key.  Unlike curve25519.X25519, a low order public key isn't
+// rejected, to behave as libolm does.
+func (k *curve25519KeyPair) sharedSecret(theirKey [curve25519KeyLen]byte) []byte {
+	var secret [curve25519KeyLen]byte
+	curve25519.ScalarMult(&secret, &k.private, &theirKey)
+	return secret[:]
+}
+
+// pickle writes the key pair.
+func (k *curve25519KeyPair) pickle(w *pickleWriter) {
+	w.bytes(k.public[:])
+	w.bytes(k.private[:])
+}
+
+// unpickle reads the key pair.
+func (k *curve25519KeyPair) unpickle(r *pickleReader) {
+	copy(k.public[:], r.bytes(curve25519KeyLen))
+	copy(k.private[:], r.bytes(curve25519KeyLen))
+}
+
+// ed25519KeyPair is an Ed25519 key pair.  The private key is stored in the
+// expanded form used by libolm: the clamped scalar followed by the prefix
+// used to derive the nonces.
+type ed25519KeyPair struct {
+	public  [ed25519KeyLen]byte
+	private [ed25519PrivateKeyLen]byte
+}
+
+// newEd25519KeyPair creates a key pair from a 32 byte seed.
+func newEd25519KeyPair(seed []byte) ed25519KeyPair {
+	var k ed25519KeyPair
+	expanded := sha512.Sum512(seed[:ed25519KeyLen])
+	expanded[0] &= 248
+	expanded[31] &= 63
+	expanded[31] |= 64
+	copy(k.private[:], expanded[:])
+	clearBytes(expanded[:])
+	s, err := edwards25519.NewScalar().SetBytesWithClamping(k.private[:32])
+	if err != nil {
+		panic(err)
+	}
+	copy(k.public[:], new(edwards25519.Point).ScalarBaseMult(s).Bytes())
+	return k
+}
+
+// sign returns the Ed25519 signature of the message.
+func (k *ed25519KeyPair) sign(message []byte) []byte {
+	h := sha512.New()
+	h.Write(k.private[32:])
+	h.Write(message)
+	r, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+	h.Reset()
+	h.Write(R)
+	h.Write(k.public[:])
+	h.Write(message)
+	hram, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	a, err := edwards25519.NewScalar().SetBytesWithClamping(k.private[:32])
+	if err != nil {
+		panic(err)
+	}
+	S := edwards25519.NewScalar().MultiplyAdd(hram, a, r)
+	return append(R, S.Bytes()...)
+}
+
+// pickle writes the key pair.
+func (k *ed25519KeyPair) pickle(w *pickleWriter) {
+	w.bytes(k.public[:])
+	w.bytes(k.private[:])
+}
+
+// unpickle reads the key pair.
+func (k *ed25519KeyPair) unpickle(r *pickleReader) {
+	copy(k.public[:], r.bytes(ed25519KeyLen))
+	copy(k.private[:], r.bytes(ed25519PrivateKeyLen))
+}
+
+// ed25519Verify checks the Ed25519 signature of the message.
+func ed25519Verify(publicKey, message, signature []byte) bool {
+	if len(publicKey) != ed25519KeyLen || len(signature) != ed25519SigLen {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(publicKey), message, signature)
+}
+
+// hmacSHA256 returns the HMAC-SHA-256 of the data.
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// hkdfSHA256 derives n bytes with HKDF-SHA-256.
+func hkdfSHA256(secret, salt []byte, info string, n int) []byte {
+	derived := make([]byte, n)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), derived)
+	if err != nil {
+		panic(err)
+	}
+	return derived
+}
+
+// Info strings used by the AES-SHA-256 ciphers of Olm and Megolm to derive
+// their keys.
+const (
+	olmCipherInfo    = "OLM_KEYS"
+	megolmCipherInfo = "MEGOLM_KEYS"
+)
+
+// aesSHA256Cipher is the cipher of Olm and Megolm messages: AES-256 in CBC
+// mode with PKCS#7 padding, authenticated by a truncated HMAC-SHA-256 over
+// the whole message.
+type aesSHA256Cipher struct {
+	aesKey, macKey, iv []byte
+}
+
+// newAESSHA256Cipher derives the keys of the cipher from the message key.
+func newAESSHA256Cipher(key []byte, info string) *aesSHA256Cipher {
+	keys := hkdfSHA256(key, nil, info, 80)
+	return &aesSHA256Cipher{aesKey: keys[:32], macKey: keys[32:64], iv: keys[64:]}
+}
+
+// aesSHA256CiphertextLen returns the length of the cipher-text of n bytes of
+// plain-text.
+func aesSHA256CiphertextLen(n int) int {
+	return (n/aes.BlockSize + 1) * aes.BlockSize
+}
+
+// encrypt returns the cipher-text of the plain-text.
+func (c *aesSHA256Cipher) encrypt(plaintext []byte) []byte {
+	block, err := aes.NewCipher(c.aesKey)
+	if err != nil {
+		panic(err)
+	}
+	padded := pkcs7Pad(append([]byte(nil), plaintext...), aes.BlockSize)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, c.iv).CryptBlocks(ciphertext, padded)
+	clearBytes(padded)
+	return ciphertext
+}
+
+// mac returns the truncated MAC of a message, without its MAC.
+func (c *aesSHA256Cipher) mac(message []byte) []byte {
+	return hmacSHA256(c.macKey, message)[:olmMACLen]
+}
+
+// decrypt checks the MAC at the end of the message and returns the
+// plain-text of the cipher-text it holds.  Returns false if the MAC is
+// invalid or the cipher-text can't be decrypted.  As in libolm, only the
+// length of the padding is checked.
+func (c *aesSHA256Cipher) decrypt(message, ciphertext []byte) ([]byte, bool) {
+	if len(message) < olmMACLen {
+		return nil, false
+	}
+	body := message[:len(message)-olmMACLen]
+	if !hmac.Equal(c.mac(body), message[len(body):]) {
+		return nil, false
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, false
+	}
+	block, err := aes.NewCipher(c.aesKey)
+	if err != nil {
+		panic(err)
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, c.iv).CryptBlocks(plaintext, ciphertext)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding > len(plaintext) {
+		clearBytes(plaintext)
+		return nil, false
+	}
+	return plaintext[:len(plaintext)-padding], true
+}
+
+// clear overwrites the keys of the cipher.
+func (c *aesSHA256Cipher) clear() {
+	clearBytes(c.aesKey)
+	clearBytes(c.macKey)
+	clearBytes(c.iv)
+}
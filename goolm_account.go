@@ -0,0 +1,357 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// maxFallbackKeys is the number of fallback keys an Account keeps: the
+// current key and the previous one.
+const maxFallbackKeys = 2
+
+// oneTimeKey is a one time key or fallback key of an Account.
+type oneTimeKey struct {
+	id        uint32
+	published bool
+	key       curve25519KeyPair
+}
+
+// keyID returns the ID of the key as published: its number in base64.
+func (k *oneTimeKey) keyID() string {
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], k.id)
+	return encodeOlmBase64(id[:])
+}
+
+// pickle writes the key.
+func (k *oneTimeKey) pickle(w *pickleWriter) {
+	w.uint32(k.id)
+	w.bool(k.published)
+	k.key.pickle(w)
+}
+
+// unpickle reads the key.
+func (k *oneTimeKey) unpickle(r *pickleReader) {
+	k.id = r.uint32()
+	k.published = r.bool()
+	k.key.unpickle(r)
+}
+
+// Account stores a device account for end to end encrypted messaging.
+type Account struct {
+	ed25519    ed25519KeyPair
+	curve25519 curve25519KeyPair
+	// oneTimeKeys is ordered from the newest key to the oldest, as in libolm.
+	oneTimeKeys []oneTimeKey
+	// fallbackKeys holds the current fallback key and the previous one, if
+	// any.  The pure Go implementation doesn't generate them, but keeps
+	// those of accounts pickled by libolm.
+	fallbackKeys     []oneTimeKey
+	nextOneTimeKeyID uint32
+}
+
+// Clear clears the memory used to back this Account.
+func (a *Account) Clear() error {
+	*a = Account{}
+	return nil
+}
+
+// Pickle returns an Account as a base64 string. Encrypts the Account using the
+// supplied key.
+func (a *Account) Pickle(key []byte) string {
+	w := &pickleWriter{}
+	w.uint32(AccountPickleVersion)
+	a.ed25519.pickle(w)
+	a.curve25519.pickle(w)
+	w.uint32(uint32(len(a.oneTimeKeys)))
+	for i := range a.oneTimeKeys {
+		a.oneTimeKeys[i].pickle(w)
+	}
+	w.uint8(uint8(len(a.fallbackKeys)))
+	for i := range a.fallbackKeys {
+		a.fallbackKeys[i].pickle(w)
+	}
+	w.uint32(a.nextOneTimeKeyID)
+	defer clearBytes(w.data)
+	return pickleEncrypt(w.data, key)
+}
+
+// AccountFromPickled loads an Account from a pickled base64 string.  Decrypts
+// the Account using the supplied key.  Returns error on failure.  If the key
+// doesn't match the one used to encrypt the Account then the error will be
+// "BAD_ACCOUNT_KEY".  If the base64 couldn't be decoded then the error will be
+// "INVALID_BASE64".
+func AccountFromPickled(pickled string, key []byte) (*Account, error) {
+	if len(pickled) == 0 {
+		return nil, fmt.Errorf("Empty input")
+	}
+	plaintext, err := pickleDecrypt(pickled, key)
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(plaintext)
+	r := &pickleReader{data: plaintext}
+	version := r.uint32()
+	if r.err == nil {
+		switch version {
+		case 1:
+			return nil, fmt.Errorf("BAD_LEGACY_ACCOUNT_PICKLE")
+		case 2, 3, AccountPickleVersion:
+		default:
+			return nil, fmt.Errorf("UNKNOWN_PICKLE_VERSION")
+		}
+	}
+	a := &Account{}
+	a.ed25519.unpickle(r)
+	a.curve25519.unpickle(r)
+	a.oneTimeKeys = make([]oneTimeKey, r.count(maxOneTimeKeys))
+	for i := range a.oneTimeKeys {
+		a.oneTimeKeys[i].unpickle(r)
+	}
+	switch version {
+	case 2:
+	case 3:
+		// Version 3 always stores two fallback keys and uses their
+		// published flag to tell whether they are set.
+		var keys [maxFallbackKeys]oneTimeKey
+		keys[0].unpickle(r)
+		keys[1].unpickle(r)
+		if keys[0].published {
+			a.fallbackKeys = keys[:1]
+			if keys[1].published {
+				a.fallbackKeys = keys[:2]
+			}
+		}
+	default:
+		n := int(r.uint8())
+		if n > maxFallbackKeys && r.err == nil {
+			r.err = fmt.Errorf("CORRUPTED_PICKLE")
+		}
+		if r.err == nil {
+			a.fallbackKeys = make([]oneTimeKey, n)
+		}
+		for i := range a.fallbackKeys {
+			a.fallbackKeys[i].unpickle(r)
+		}
+	}
+	a.nextOneTimeKeyID = r.uint32()
+	err = r.end()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// NewAccount creates a new Account.
+func NewAccount() *Account {
+	random := randomBytes(ed25519KeyLen + curve25519KeyLen)
+	defer clearBytes(random)
+	return &Account{
+		ed25519:    newEd25519KeyPair(random[:ed25519KeyLen]),
+		curve25519: newCurve25519KeyPair(random[ed25519KeyLen:]),
+	}
+}
+
+// IdentityKeysJSON returns the public parts of the identity keys for the Account.
+func (a *Account) IdentityKeysJSON() string {
+	return fmt.Sprintf(`{"curve25519":"%s","ed25519":"%s"}`,
+		encodeOlmBase64(a.curve25519.public[:]), encodeOlmBase64(a.ed25519.public[:]))
+}
+
+// Sign returns the signature of a message using the ed25519 key for this
+// Account.
+func (a *Account) Sign(message string) string {
+	if len(message) == 0 {
+		message = " "
+	}
+	return encodeOlmBase64(a.ed25519.sign([]byte(message)))
+}
+
+// OneTimeKeys returns the public parts of the unpublished one time keys for
+// the Account.
+//
+// The returned data is a struct with the single value "Curve25519", which is
+// itself an object mapping key id to base64-encoded Curve25519 key.
+func (a *Account) OneTimeKeys() OTKs {
+	oneTimeKeys := OTKs{Curve25519: map[string]Curve25519{}}
+	for i := range a.oneTimeKeys {
+		if !a.oneTimeKeys[i].published {
+			oneTimeKeys.Curve25519[a.oneTimeKeys[i].keyID()] = Curve25519(encodeOlmBase64(a.oneTimeKeys[i].key.public[:]))
+		}
+	}
+	return oneTimeKeys
+}
+
+// MarkKeysAsPublished marks the current set of one time keys as being
+// published.
+func (a *Account) MarkKeysAsPublished() {
+	for i := range a.oneTimeKeys {
+		a.oneTimeKeys[i].published = true
+	}
+	if len(a.fallbackKeys) > 0 {
+		a.fallbackKeys[0].published = true
+	}
+}
+
+// MaxNumberOfOneTimeKeys returns the largest number of one time keys this
+// Account can store.
+func (a *Account) MaxNumberOfOneTimeKeys() uint {
+	return maxOneTimeKeys
+}
+
+// GenOneTimeKeys generates a number of new one time keys.  If the total number
+// of keys stored by this Account exceeds MaxNumberOfOneTimeKeys then the old
+// keys are discarded.
+func (a *Account) GenOneTimeKeys(num uint) {
+	random := randomBytes(int(num) * curve25519KeyLen)
+	defer clearBytes(random)
+	for i := uint(0); i < num; i++ {
+		a.nextOneTimeKeyID++
+		k := oneTimeKey{
+			id:  a.nextOneTimeKeyID,
+			key: newCurve25519KeyPair(random[i*curve25519KeyLen:]),
+		}
+		if len(a.oneTimeKeys) == maxOneTimeKeys {
+			a.oneTimeKeys = a.oneTimeKeys[:maxOneTimeKeys-1]
+		}
+		a.oneTimeKeys = append([]oneTimeKey{k}, a.oneTimeKeys...)
+	}
+}
+
+// lookupKey returns the one time key or fallback key with the public key.
+func (a *Account) lookupKey(publicKey [curve25519KeyLen]byte) *oneTimeKey {
+	for i := range a.oneTimeKeys {
+		if a.oneTimeKeys[i].key.public == publicKey {
+			return &a.oneTimeKeys[i]
+		}
+	}
+	for i := range a.fallbackKeys {
+		if a.fallbackKeys[i].key.public == publicKey {
+			return &a.fallbackKeys[i]
+		}
+	}
+	return nil
+}
+
+// NewOutboundSession creates a new out-bound session for sending messages to a
+// given curve25519 identityKey and oneTimeKey.  Returns error on failure.  If the
+// keys couldn't be decoded as base64 then the error will be "INVALID_BASE64"
+func (a *Account) NewOutboundSession(theirIdentityKey, theirOneTimeKey Curve25519) (*Session, error) {
+	if len(theirIdentityKey) == 0 || len(theirOneTimeKey) == 0 {
+		return nil, fmt.Errorf("Empty input")
+	}
+	identityKey, err := decodeOlmKey(string(theirIdentityKey))
+	if err != nil {
+		return nil, err
+	}
+	oneTimeKey, err := decodeOlmKey(string(theirOneTimeKey))
+	if err != nil {
+		return nil, err
+	}
+	random := randomBytes(2 * curve25519KeyLen)
+	defer clearBytes(random)
+	baseKey := newCurve25519KeyPair(random[:curve25519KeyLen])
+	ratchetKey := newCurve25519KeyPair(random[curve25519KeyLen:])
+
+	s := &Session{}
+	s.aliceIdentityKey = a.curve25519.public
+	s.aliceBaseKey = baseKey.public
+	copy(s.bobOneTimeKey[:], oneTimeKey)
+	var bobIdentityKey [curve25519KeyLen]byte
+	copy(bobIdentityKey[:], identityKey)
+
+	var secret []byte
+	secret = append(secret, a.curve25519.sharedSecret(s.bobOneTimeKey)...)
+	secret = append(secret, baseKey.sharedSecret(bobIdentityKey)...)
+	secret = append(secret, baseKey.sharedSecret(s.bobOneTimeKey)...)
+	defer clearBytes(secret)
+	s.ratchet.initialiseAsAlice(secret, ratchetKey)
+	return s, nil
+}
+
+// newInboundSession creates a new in-bound session from a PRE_KEY message,
+// checking that it comes from theirIdentityKey if it isn't nil.
+func (a *Account) newInboundSession(theirIdentityKey []byte, oneTimeKeyMsg string) (*Session, error) {
+	m, err := decodePreKeyMessageBase64(oneTimeKeyMsg, theirIdentityKey != nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{}
+	if m.identityKey != nil {
+		if theirIdentityKey != nil && string(m.identityKey) != string(theirIdentityKey) {
+			return nil, fmt.Errorf("BAD_MESSAGE_KEY_ID")
+		}
+		copy(s.aliceIdentityKey[:], m.identityKey)
+	} else {
+		copy(s.aliceIdentityKey[:], theirIdentityKey)
+	}
+	copy(s.aliceBaseKey[:], m.baseKey)
+	copy(s.bobOneTimeKey[:], m.oneTimeKey)
+
+	inner := decodeOlmMessage(m.message)
+	if len(inner.ratchetKey) != curve25519KeyLen {
+		return nil, fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	var ratchetKey [curve25519KeyLen]byte
+	copy(ratchetKey[:], inner.ratchetKey)
+
+	ourOneTimeKey := a.lookupKey(s.bobOneTimeKey)
+	if ourOneTimeKey == nil {
+		return nil, fmt.Errorf("BAD_MESSAGE_KEY_ID")
+	}
+	var secret []byte
+	secret = append(secret, ourOneTimeKey.key.sharedSecret(s.aliceIdentityKey)...)
+	secret = append(secret, a.curve25519.sharedSecret(s.aliceBaseKey)...)
+	secret = append(secret, ourOneTimeKey.key.sharedSecret(s.aliceBaseKey)...)
+	defer clearBytes(secret)
+	s.ratchet.initialiseAsBob(secret, ratchetKey)
+	return s, nil
+}
+
+// NewInboundSession creates a new in-bound session for sending/receiving
+// messages from an incoming PRE_KEY message.  Returns error on failure.  If
+// the base64 couldn't be decoded then the error will be "INVALID_BASE64".  If
+// the message was for an unsupported protocol version then the error will be
+// "BAD_MESSAGE_VERSION".  If the message couldn't be decoded then then the
+// error will be "BAD_MESSAGE_FORMAT".  If the message refers to an unknown one
+// time key then the error will be "BAD_MESSAGE_KEY_ID".
+func (a *Account) NewInboundSession(oneTimeKeyMsg string) (*Session, error) {
+	if len(oneTimeKeyMsg) == 0 {
+		return nil, fmt.Errorf("Empty input")
+	}
+	return a.newInboundSession(nil, oneTimeKeyMsg)
+}
+
+// NewInboundSessionFrom creates a new in-bound session for sending/receiving
+// messages from an incoming PRE_KEY message.  Returns error on failure.  If
+// the base64 couldn't be decoded then the error will be "INVALID_BASE64".  If
+// the message was for an unsupported protocol version then the error will be
+// "BAD_MESSAGE_VERSION".  If the message couldn't be decoded then then the
+// error will be "BAD_MESSAGE_FORMAT".  If the message refers to an unknown one
+// time key then the error will be "BAD_MESSAGE_KEY_ID".
+func (a *Account) NewInboundSessionFrom(theirIdentityKey Curve25519, oneTimeKeyMsg string) (*Session, error) {
+	if len(theirIdentityKey) == 0 || len(oneTimeKeyMsg) == 0 {
+		return nil, fmt.Errorf("Empty input")
+	}
+	key, err := decodeOlmKey(string(theirIdentityKey))
+	if err != nil {
+		return nil, err
+	}
+	return a.newInboundSession(key, oneTimeKeyMsg)
+}
+
+// RemoveOneTimeKeys removes the one time keys that the session used from the
+// Account.  Returns error on failure.  If the Account doesn't have any
+// matching one time keys then the error will be "BAD_MESSAGE_KEY_ID".
+func (a *Account) RemoveOneTimeKeys(s *Session) error {
+	for i := range a.oneTimeKeys {
+		if a.oneTimeKeys[i].key.public == s.bobOneTimeKey {
+			a.oneTimeKeys = append(a.oneTimeKeys[:i], a.oneTimeKeys[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("BAD_MESSAGE_KEY_ID")
+}
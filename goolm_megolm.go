@@ -0,0 +1,468 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// Megolm ratchet sizes in bytes.
+const (
+	megolmRatchetParts   = 4
+	megolmRatchetPartLen = 32
+)
+
+// Versions of the session keys of OutboundGroupSession.SessionKey and
+// InboundGroupSession.Export.
+const (
+	sessionKeyVersion    = 2
+	sessionExportVersion = 1
+)
+
+// Lengths of the session keys in bytes.
+const (
+	sessionExportLen = 1 + 4 + megolmRatchetLen + ed25519KeyLen
+	sessionKeyLen    = sessionExportLen + ed25519SigLen
+)
+
+// megolmRatchet is the Megolm ratchet: four parts R(0) to R(3), where R(i)
+// is rehashed every 2^(8*(3-i)) messages and resets the following parts.
+type megolmRatchet struct {
+	data    [megolmRatchetParts][megolmRatchetPartLen]byte
+	counter uint32
+}
+
+// newMegolmRatchet returns a ratchet at counter from 128 bytes of data.
+func newMegolmRatchet(data []byte, counter uint32) megolmRatchet {
+	m := megolmRatchet{counter: counter}
+	for i := range m.data {
+		copy(m.data[i][:], data[i*megolmRatchetPartLen:])
+	}
+	return m
+}
+
+// bytes returns the data of the ratchet.
+func (m *megolmRatchet) bytes() []byte {
+	b := make([]byte, 0, megolmRatchetLen)
+	for i := range m.data {
+		b = append(b, m.data[i][:]...)
+	}
+	return b
+}
+
+// rehash sets R(to) to the HMAC of to keyed by R(from).
+func (m *megolmRatchet) rehash(from, to int) {
+	copy(m.data[to][:], hmacSHA256(m.data[from][:], []byte{byte(to)}))
+}
+
+// advance advances the ratchet by one step.
+func (m *megolmRatchet) advance() {
+	mask := uint32(0x00FFFFFF)
+	h := 0
+	m.counter++
+	// Find the first part that changes
+	for h < megolmRatchetParts {
+		if m.counter&mask == 0 {
+			break
+		}
+		h++
+		mask >>= 8
+	}
+	// and update R(h) to R(3) from R(h)
+	for i := megolmRatchetParts - 1; i >= h; i-- {
+		m.rehash(h, i)
+	}
+}
+
+// advanceTo advances the ratchet to index, as libolm does: an index before
+// the counter wraps around.
+func (m *megolmRatchet) advanceTo(index uint32) {
+	for j := 0; j < megolmRatchetParts; j++ {
+		shift := uint((megolmRatchetParts - j - 1) * 8)
+		mask := ^uint32(0) << shift
+		steps := ((index >> shift) - (m.counter >> shift)) & 0xFF
+		if steps == 0 {
+			// Only R(0) can be past index, when index wrapped around, which
+			// needs a full cycle of R(0).
+			if index < m.counter {
+				steps = 0x100
+			} else {
+				continue
+			}
+		}
+		// All the steps but the last only bump R(j),
+		for ; steps > 1; steps-- {
+			m.rehash(j, j)
+		}
+		// and the last one also resets R(j+1) to R(3).
+		for k := megolmRatchetParts - 1; k >= j; k-- {
+			m.rehash(j, k)
+		}
+		m.counter = index & mask
+	}
+}
+
+// pickle writes the ratchet.
+func (m *megolmRatchet) pickle(w *pickleWriter) {
+	data := m.bytes()
+	w.bytes(data)
+	clearBytes(data)
+	w.uint32(m.counter)
+}
+
+// unpickle reads the ratchet.
+func (m *megolmRatchet) unpickle(r *pickleReader) {
+	*m = newMegolmRatchet(r.bytes(megolmRatchetLen), 0)
+	m.counter = r.uint32()
+}
+
+// OutboundGroupSession stores an outbound encrypted messaging session for a
+// group.
+type OutboundGroupSession struct {
+	ratchet    megolmRatchet
+	signingKey ed25519KeyPair
+}
+
+// Clear clears the memory used to back this OutboundGroupSession.
+func (s *OutboundGroupSession) Clear() error {
+	*s = OutboundGroupSession{}
+	return nil
+}
+
+// Pickle returns an OutboundGroupSession as a base64 string.  Encrypts the
+// OutboundGroupSession using the supplied key.
+func (s *OutboundGroupSession) Pickle(key []byte) string {
+	w := &pickleWriter{}
+	w.uint32(OutboundGroupSessionPickleVersion)
+	s.ratchet.pickle(w)
+	s.signingKey.pickle(w)
+	defer clearBytes(w.data)
+	return pickleEncrypt(w.data, key)
+}
+
+// OutboundGroupSessionFromPickled loads an OutboundGroupSession from a pickled
+// base64 string.  Decrypts the OutboundGroupSession using the supplied key.
+// Returns error on failure.  If the key doesn't match the one used to encrypt
+// the OutboundGroupSession then the error will be "BAD_ACCOUNT_KEY".  If the
+// base64 couldn't be decoded then the error will be "INVALID_BASE64".
+func OutboundGroupSessionFromPickled(pickled string, key []byte) (*OutboundGroupSession, error) {
+	if len(pickled) == 0 {
+		return nil, fmt.Errorf("Empty input")
+	}
+	plaintext, err := pickleDecrypt(pickled, key)
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(plaintext)
+	r := &pickleReader{data: plaintext}
+	version := r.uint32()
+	if r.err == nil && version != OutboundGroupSessionPickleVersion {
+		return nil, fmt.Errorf("UNKNOWN_PICKLE_VERSION")
+	}
+	s := &OutboundGroupSession{}
+	s.ratchet.unpickle(r)
+	s.signingKey.unpickle(r)
+	err = r.end()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewOutboundGroupSession creates a new outbound group session.
+func NewOutboundGroupSession() *OutboundGroupSession {
+	random := randomBytes(megolmRatchetLen + ed25519KeyLen)
+	defer clearBytes(random)
+	return &OutboundGroupSession{
+		ratchet:    newMegolmRatchet(random[:megolmRatchetLen], 0),
+		signingKey: newEd25519KeyPair(random[megolmRatchetLen:]),
+	}
+}
+
+// encryptMsgLen returns the size of the next message in bytes for the given
+// number of plain-text bytes.
+func (s *OutboundGroupSession) encryptMsgLen(plainTextLen int) uint {
+	return uint(base64Len(groupMessageLen(s.ratchet.counter, aesSHA256CiphertextLen(plainTextLen))))
+}
+
+// encrypt encrypts the plain-text and returns the encoded message.
+func (s *OutboundGroupSession) encrypt(plaintext []byte) []byte {
+	key := s.ratchet.bytes()
+	defer clearBytes(key)
+	c := newAESSHA256Cipher(key, megolmCipherInfo)
+	defer c.clear()
+	message := encodeGroupMessage(s.ratchet.counter, c.encrypt(plaintext))
+	body := message[:len(message)-olmMACLen-ed25519SigLen]
+	copy(message[len(body):], c.mac(body))
+	signed := message[:len(message)-ed25519SigLen]
+	copy(message[len(signed):], s.signingKey.sign(signed))
+	s.ratchet.advance()
+	return message
+}
+
+// Encrypt encrypts a message using the Session.  Returns the encrypted message
+// as base64.
+func (s *OutboundGroupSession) Encrypt(plaintext string) string {
+	if len(plaintext) == 0 {
+		plaintext = " "
+	}
+	return encodeOlmBase64(s.encrypt([]byte(plaintext)))
+}
+
+// encryptInto encrypts the plain-text into message, which must be at least
+// encryptMsgLen(len(plaintext)) bytes long.  Returns the number of bytes
+// written.  Returns error on failure.
+func (s *OutboundGroupSession) encryptInto(plaintext, message []byte) (uint, error) {
+	if uint(len(message)) < s.encryptMsgLen(len(plaintext)) {
+		return 0, fmt.Errorf("OUTPUT_BUFFER_TOO_SMALL")
+	}
+	raw := s.encrypt(plaintext)
+	base64.RawStdEncoding.Encode(message, raw)
+	return uint(base64Len(len(raw))), nil
+}
+
+// ID returns a base64-encoded identifier for this session.
+func (s *OutboundGroupSession) ID() SessionID {
+	return SessionID(encodeOlmBase64(s.signingKey.public[:]))
+}
+
+// MessageIndex returns the message index for this session.  Each message is
+// sent with an increasing index; this returns the index for the next message.
+func (s *OutboundGroupSession) MessageIndex() uint {
+	return uint(s.ratchet.counter)
+}
+
+// SessionKey returns the base64-encoded current ratchet key for this session.
+func (s *OutboundGroupSession) SessionKey() string {
+	key := make([]byte, 0, sessionKeyLen)
+	key = append(key, sessionKeyVersion)
+	key = append(key, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(key[1:], s.ratchet.counter)
+	data := s.ratchet.bytes()
+	key = append(key, data...)
+	clearBytes(data)
+	key = append(key, s.signingKey.public[:]...)
+	key = append(key, s.signingKey.sign(key)...)
+	defer clearBytes(key)
+	return encodeOlmBase64(key)
+}
+
+// InboundGroupSession stores an inbound encrypted messaging session for a
+// group.
+type InboundGroupSession struct {
+	initialRatchet megolmRatchet
+	latestRatchet  megolmRatchet
+	signingKey     [ed25519KeyLen]byte
+	verified       bool
+}
+
+// Clear clears the memory used to back this InboundGroupSession.
+func (s *InboundGroupSession) Clear() error {
+	*s = InboundGroupSession{}
+	return nil
+}
+
+// Pickle returns an InboundGroupSession as a base64 string.  Encrypts the
+// InboundGroupSession using the supplied key.
+func (s *InboundGroupSession) Pickle(key []byte) string {
+	w := &pickleWriter{}
+	w.uint32(InboundGroupSessionPickleVersion)
+	s.initialRatchet.pickle(w)
+	s.latestRatchet.pickle(w)
+	w.bytes(s.signingKey[:])
+	w.bool(s.verified)
+	defer clearBytes(w.data)
+	return pickleEncrypt(w.data, key)
+}
+
+// InboundGroupSessionFromPickled loads an InboundGroupSession from a pickled
+// base64 string.  Decrypts the InboundGroupSession using the supplied key.
+// Returns error on failure.  If the key doesn't match the one used to encrypt
+// the InboundGroupSession then the error will be "BAD_ACCOUNT_KEY".  If the
+// base64 couldn't be decoded then the error will be "INVALID_BASE64".
+func InboundGroupSessionFromPickled(pickled string, key []byte) (*InboundGroupSession, error) {
+	if len(pickled) == 0 {
+		return nil, fmt.Errorf("Empty input")
+	}
+	plaintext, err := pickleDecrypt(pickled, key)
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(plaintext)
+	r := &pickleReader{data: plaintext}
+	version := r.uint32()
+	if r.err == nil && version != 1 && version != InboundGroupSessionPickleVersion {
+		return nil, fmt.Errorf("UNKNOWN_PICKLE_VERSION")
+	}
+	s := &InboundGroupSession{}
+	s.initialRatchet.unpickle(r)
+	s.latestRatchet.unpickle(r)
+	copy(s.signingKey[:], r.bytes(ed25519KeyLen))
+	// Version 1 sessions were always created from signed session keys.
+	s.verified = true
+	if version >= 2 {
+		s.verified = r.bool()
+	}
+	err = r.end()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newInboundGroupSession creates an InboundGroupSession from a session key
+// in base64, which is signed unless it was exported.
+func newInboundGroupSession(sessionKey []byte, exported bool) (*InboundGroupSession, error) {
+	raw, err := decodeOlmBase64(string(sessionKey))
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(raw)
+	version, expectedLen := byte(sessionKeyVersion), sessionKeyLen
+	if exported {
+		version, expectedLen = sessionExportVersion, sessionExportLen
+	}
+	if len(raw) != expectedLen || raw[0] != version {
+		return nil, fmt.Errorf("BAD_SESSION_KEY")
+	}
+	counter := binary.BigEndian.Uint32(raw[1:5])
+	s := &InboundGroupSession{
+		initialRatchet: newMegolmRatchet(raw[5:5+megolmRatchetLen], counter),
+		latestRatchet:  newMegolmRatchet(raw[5:5+megolmRatchetLen], counter),
+	}
+	copy(s.signingKey[:], raw[5+megolmRatchetLen:])
+	if !exported {
+		if !ed25519Verify(s.signingKey[:], raw[:sessionExportLen], raw[sessionExportLen:]) {
+			return nil, fmt.Errorf("BAD_SIGNATURE")
+		}
+		s.verified = true
+	}
+	return s, nil
+}
+
+// NewInboundGroupSession creates a new inbound group session from a key
+// exported from OutboundGroupSession.SessionKey().  Returns error on failure.
+// If the sessionKey is not valid base64 the error will be "INVALID_BASE64".
+// If the session_key is invalid the error will be "BAD_SESSION_KEY".  If its
+// signature is invalid the error will be "BAD_SIGNATURE".
+func NewInboundGroupSession(sessionKey []byte) (*InboundGroupSession, error) {
+	if len(sessionKey) == 0 {
+		// As with the libolm bindings.
+		sessionKey = []byte(" ")
+	}
+	return newInboundGroupSession(sessionKey, false)
+}
+
+// InboundGroupSessionImport imports an inbound group session from a previous
+// export.  Returns error on failure.  If the sessionKey is not valid base64
+// the error will be "INVALID_BASE64".  If the session_key is invalid the
+// error will be "BAD_SESSION_KEY".
+func InboundGroupSessionImport(sessionKey []byte) (*InboundGroupSession, error) {
+	if len(sessionKey) == 0 {
+		// As with the libolm bindings.
+		sessionKey = []byte(" ")
+	}
+	return newInboundGroupSession(sessionKey, true)
+}
+
+// Decrypt decrypts a message using the InboundGroupSession.  Returns the the
+// plain-text and message index on success.  Returns error on failure.  If the
+// base64 couldn't be decoded then the error will be "INVALID_BASE64".  If the
+// message is for an unsupported version of the protocol then the error will be
+// "BAD_MESSAGE_VERSION".  If the message couldn't be decoded then the error
+// will be BAD_MESSAGE_FORMAT".  If the signature or MAC on the message was
+// invalid then the error will be "BAD_SIGNATURE" or "BAD_MESSAGE_MAC".  If we
+// do not have a session key corresponding to the message's index (ie, it was
+// sent before the session key was shared with us) the error will be
+// "UNKNOWN_MESSAGE_INDEX".
+func (s *InboundGroupSession) Decrypt(message string) (string, uint32, error) {
+	if len(message) == 0 {
+		return "", 0, fmt.Errorf("Empty input")
+	}
+	raw, err := decodeOlmBase64(message)
+	if err != nil {
+		return "", 0, err
+	}
+	m := decodeGroupMessage(raw)
+	if m.version != olmProtocolVersion {
+		return "", 0, fmt.Errorf("BAD_MESSAGE_VERSION")
+	}
+	if !m.hasMessageIndex || m.ciphertext == nil {
+		return "", 0, fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	signed := raw[:len(raw)-ed25519SigLen]
+	if !ed25519Verify(s.signingKey[:], signed, raw[len(signed):]) {
+		return "", 0, fmt.Errorf("BAD_SIGNATURE")
+	}
+
+	// Use the latest ratchet if the message isn't before it, otherwise a
+	// copy of the initial ratchet.
+	var ratchet *megolmRatchet
+	if m.messageIndex-s.latestRatchet.counter < 1<<31 {
+		ratchet = &s.latestRatchet
+	} else if m.messageIndex-s.initialRatchet.counter >= 1<<31 {
+		return "", 0, fmt.Errorf("UNKNOWN_MESSAGE_INDEX")
+	} else {
+		initial := s.initialRatchet
+		ratchet = &initial
+	}
+	ratchet.advanceTo(m.messageIndex)
+	key := ratchet.bytes()
+	defer clearBytes(key)
+	c := newAESSHA256Cipher(key, megolmCipherInfo)
+	defer c.clear()
+	plaintext, ok := c.decrypt(signed, m.ciphertext)
+	if !ok {
+		return "", 0, fmt.Errorf("BAD_MESSAGE_MAC")
+	}
+	// The session key is known to be valid once a message is decrypted.
+	s.verified = true
+	return string(plaintext), m.messageIndex, nil
+}
+
+// ID returns a base64-encoded identifier for this session.
+func (s *InboundGroupSession) ID() SessionID {
+	return SessionID(encodeOlmBase64(s.signingKey[:]))
+}
+
+// FirstKnownIndex returns the first message index we know how to decrypt.
+func (s *InboundGroupSession) FirstKnownIndex() uint {
+	return uint(s.initialRatchet.counter)
+}
+
+// IsVerified check if the session has been verified as a valid session.  (A
+// session is verified either because the original session share was signed, or
+// because we have subsequently successfully decrypted a message.)
+func (s *InboundGroupSession) IsVerified() uint {
+	if s.verified {
+		return 1
+	}
+	return 0
+}
+
+// Export returns the base64-encoded ratchet key for this session, at the given
+// index, in a format which can be used by
+// InboundGroupSession.InboundGroupSessionImport().  Returns error on failure.
+// if we do not have a session key corresponding to the given index (ie, it was
+// sent before the session key was shared with us) the error will be
+// "UNKNOWN_MESSAGE_INDEX".
+func (s *InboundGroupSession) Export(messageIndex uint32) (string, error) {
+	if messageIndex-s.initialRatchet.counter >= 1<<31 {
+		return "", fmt.Errorf("UNKNOWN_MESSAGE_INDEX")
+	}
+	ratchet := s.initialRatchet
+	ratchet.advanceTo(messageIndex)
+	key := make([]byte, 0, sessionExportLen)
+	key = append(key, sessionExportVersion)
+	key = append(key, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(key[1:], ratchet.counter)
+	data := ratchet.bytes()
+	key = append(key, data...)
+	clearBytes(data)
+	key = append(key, s.signingKey[:]...)
+	defer clearBytes(key)
+	return encodeOlmBase64(key), nil
+}
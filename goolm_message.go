@@ -0,0 +1,148 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+// appendVarint appends n as a varint.
+func appendVarint(b []byte, n uint32) []byte {
+	for n >= 0x80 {
+		b = append(b, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(b, byte(n))
+}
+
+// varintLen returns the length of n as a varint.
+func varintLen(n uint32) int {
+	l := 1
+	for n >= 0x80 {
+		n >>= 7
+		l++
+	}
+	return l
+}
+
+// appendBytesField appends a length-delimited field.
+func appendBytesField(b []byte, tag byte, value []byte) []byte {
+	b = append(b, tag)
+	b = appendVarint(b, uint32(len(value)))
+	return append(b, value...)
+}
+
+// appendVarintField appends a varint field.
+func appendVarintField(b []byte, tag byte, n uint32) []byte {
+	return appendVarint(append(b, tag), n)
+}
+
+// olmMessage is a normal Olm message.
+type olmMessage struct {
+	version    byte
+	ratchetKey []byte
+	counter    uint32
+	hasCounter bool
+	ciphertext []byte
+}
+
+// encodeOlmMessage encodes a message, leaving room for its MAC at the end.
+func encodeOlmMessage(ratchetKey []byte, counter uint32, ciphertext []byte) []byte {
+	b := []byte{olmProtocolVersion}
+	b = appendBytesField(b, ratchetKeyTag, ratchetKey)
+	b = appendVarintField(b, counterTag, counter)
+	b = appendBytesField(b, ciphertextTag, ciphertext)
+	return append(b, make([]byte, olmMACLen)...)
+}
+
+// decodeOlmMessage decodes a message ending with its MAC.  The fields of a
+// message that can't be decoded are left empty.
+func decodeOlmMessage(b []byte) *olmMessage {
+	m := &olmMessage{}
+	if len(b) <= olmMACLen {
+		return m
+	}
+	b = b[:len(b)-olmMACLen]
+	m.version = b[0]
+	for _, f := range decodeFields(b[1:]) {
+		switch f.tag {
+		case ratchetKeyTag:
+			m.ratchetKey = f.bytes
+		case counterTag:
+			m.counter = f.varint
+			m.hasCounter = true
+		case ciphertextTag:
+			m.ciphertext = f.bytes
+		}
+	}
+	return m
+}
+
+// preKeyMessage is an Olm PRE_KEY message.
+type preKeyMessage struct {
+	version     byte
+	oneTimeKey  []byte
+	baseKey     []byte
+	identityKey []byte
+	message     []byte
+}
+
+// encodePreKeyMessage encodes a PRE_KEY message wrapping an encoded message.
+func encodePreKeyMessage(oneTimeKey, baseKey, identityKey, message []byte) []byte {
+	b := []byte{olmProtocolVersion}
+	b = appendBytesField(b, oneTimeKeyTag, oneTimeKey)
+	b = appendBytesField(b, baseKeyTag, baseKey)
+	b = appendBytesField(b, identityKeyTag, identityKey)
+	return appendBytesField(b, messageTag, message)
+}
+
+// decodePreKeyMessage decodes a PRE_KEY message.
+func decodePreKeyMessage(b []byte) *preKeyMessage {
+	m := &preKeyMessage{}
+	if len(b) == 0 {
+		return m
+	}
+	m.version = b[0]
+	for _, f := range decodeFields(b[1:]) {
+		switch f.tag {
+		case oneTimeKeyTag:
+			m.oneTimeKey = f.bytes
+		case baseKeyTag:
+			m.baseKey = f.bytes
+		case identityKeyTag:
+			m.identityKey = f.bytes
+		case messageTag:
+			m.message = f.bytes
+		}
+	}
+	return m
+}
+
+// checkFields checks that the message has the fields needed to start an
+// in-bound session.  The identity key may be omitted if it's known.
+func (m *preKeyMessage) checkFields(haveTheirIdentityKey bool) bool {
+	if m.identityKey == nil && !haveTheirIdentityKey {
+		return false
+	}
+	if m.identityKey != nil && len(m.identityKey) != curve25519KeyLen {
+		return false
+	}
+	return m.message != nil && len(m.baseKey) == curve25519KeyLen && len(m.oneTimeKey) == curve25519KeyLen
+}
+
+// groupMessageLen returns the length of an encoded group message.
+func groupMessageLen(messageIndex uint32, ciphertextLen int) int {
+	return 1 + 1 + varintLen(messageIndex) + 1 + varintLen(uint32(ciphertextLen)) + ciphertextLen + olmMACLen + ed25519SigLen
+}
+
+// encodeGroupMessage encodes a group message, leaving room for its MAC and
+// signature at the end.
+func encodeGroupMessage(messageIndex uint32, ciphertext []byte) []byte {
+	b := make([]byte, 0, groupMessageLen(messageIndex, len(ciphertext)))
+	b = append(b, olmProtocolVersion)
+	b = appendVarintField(b, groupMessageIndexTag, messageIndex)
+	b = appendBytesField(b, groupCiphertextTag, ciphertext)
+	return append(b, make([]byte, olmMACLen+ed25519SigLen)...)
+}
+
+// base64Len returns the length of n bytes in unpadded base64.
+func base64Len(n int) int {
+	return (n*4 + 2) / 3
+}
@@ -0,0 +1,303 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"fmt"
+)
+
+// Info strings used by the Olm ratchet to derive its keys.
+const (
+	olmRootInfo    = "OLM_ROOT"
+	olmRatchetInfo = "OLM_RATCHET"
+)
+
+// maxMessageGap is the largest number of message keys the ratchet derives to
+// decrypt a message.
+const maxMessageGap = 2000
+
+// Seeds of the HMACs advancing chain keys and deriving message keys.
+var (
+	messageKeySeed = []byte{0x01}
+	chainKeySeed   = []byte{0x02}
+)
+
+// chainKey is a key of a sending or receiving chain.
+type chainKey struct {
+	key   [32]byte
+	index uint32
+}
+
+// next returns the next key of the chain.
+func (c chainKey) next() chainKey {
+	n := chainKey{index: c.index + 1}
+	copy(n.key[:], hmacSHA256(c.key[:], chainKeySeed))
+	return n
+}
+
+// messageKey returns the message key derived from the chain key.
+func (c chainKey) messageKey() messageKey {
+	m := messageKey{index: c.index}
+	copy(m.key[:], hmacSHA256(c.key[:], messageKeySeed))
+	return m
+}
+
+// pickle writes the chain key.
+func (c *chainKey) pickle(w *pickleWriter) {
+	w.bytes(c.key[:])
+	w.uint32(c.index)
+}
+
+// unpickle reads the chain key.
+func (c *chainKey) unpickle(r *pickleReader) {
+	copy(c.key[:], r.bytes(32))
+	c.index = r.uint32()
+}
+
+// messageKey is the key of a single message.
+type messageKey chainKey
+
+// senderChain is the chain of our current ratchet key.
+type senderChain struct {
+	ratchetKey curve25519KeyPair
+	chainKey   chainKey
+}
+
+// receiverChain is the chain of one of their ratchet keys.
+type receiverChain struct {
+	ratchetKey [curve25519KeyLen]byte
+	chainKey   chainKey
+}
+
+// skippedMessageKey is the key of a message not received yet.
+type skippedMessageKey struct {
+	ratchetKey [curve25519KeyLen]byte
+	messageKey messageKey
+}
+
+// ratchet is the Olm double ratchet.  As in libolm, the lists are ordered
+// from the newest entry to the oldest, and the oldest entry is dropped when
+// a list is full.
+type ratchet struct {
+	rootKey            [32]byte
+	senderChains       []senderChain
+	receiverChains     []receiverChain
+	skippedMessageKeys []skippedMessageKey
+}
+
+// initialiseAsAlice initialises the ratchet of the session creator.
+func (r *ratchet) initialiseAsAlice(secret []byte, ratchetKey curve25519KeyPair) {
+	derived := hkdfSHA256(secret, nil, olmRootInfo, 64)
+	copy(r.rootKey[:], derived[:32])
+	c := senderChain{ratchetKey: ratchetKey}
+	copy(c.chainKey.key[:], derived[32:])
+	r.senderChains = []senderChain{c}
+	clearBytes(derived)
+}
+
+// initialiseAsBob initialises the ratchet of the session receiver.
+func (r *ratchet) initialiseAsBob(secret []byte, theirRatchetKey [curve25519KeyLen]byte) {
+	derived := hkdfSHA256(secret, nil, olmRootInfo, 64)
+	copy(r.rootKey[:], derived[:32])
+	c := receiverChain{ratchetKey: theirRatchetKey}
+	copy(c.chainKey.key[:], derived[32:])
+	r.receiverChains = []receiverChain{c}
+	clearBytes(derived)
+}
+
+// advanceRootKey derives the next root key and the chain key of a new chain
+// from our and their ratchet keys.
+func (r *ratchet) advanceRootKey(ourKey *curve25519KeyPair, theirKey [curve25519KeyLen]byte) (rootKey [32]byte, c chainKey) {
+	secret := ourKey.sharedSecret(theirKey)
+	derived := hkdfSHA256(secret, r.rootKey[:], olmRatchetInfo, 64)
+	copy(rootKey[:], derived[:32])
+	copy(c.key[:], derived[32:])
+	clearBytes(secret)
+	clearBytes(derived)
+	return
+}
+
+// encrypt encrypts the plain-text and returns the encoded message.
+func (r *ratchet) encrypt(plaintext []byte) []byte {
+	if len(r.senderChains) == 0 {
+		c := senderChain{ratchetKey: newCurve25519KeyPair(randomBytes(curve25519KeyLen))}
+		// As in libolm, a session without receiver chains uses a zero key.
+		var theirKey [curve25519KeyLen]byte
+		if len(r.receiverChains) > 0 {
+			theirKey = r.receiverChains[0].ratchetKey
+		}
+		r.rootKey, c.chainKey = r.advanceRootKey(&c.ratchetKey, theirKey)
+		r.senderChains = []senderChain{c}
+	}
+	chain := &r.senderChains[0]
+	key := chain.chainKey.messageKey()
+	chain.chainKey = chain.chainKey.next()
+
+	c := newAESSHA256Cipher(key.key[:], olmCipherInfo)
+	defer c.clear()
+	message := encodeOlmMessage(chain.ratchetKey.public[:], key.index, c.encrypt(plaintext))
+	body := message[:len(message)-olmMACLen]
+	copy(message[len(body):], c.mac(body))
+	return message
+}
+
+// decryptWithKey decrypts the message with a message key.
+func decryptWithKey(key messageKey, raw []byte, m *olmMessage) ([]byte, bool) {
+	c := newAESSHA256Cipher(key.key[:], olmCipherInfo)
+	defer c.clear()
+	return c.decrypt(raw, m.ciphertext)
+}
+
+// decryptWithChain decrypts the message with a key of the chain, without
+// changing the chain.
+func decryptWithChain(c chainKey, raw []byte, m *olmMessage) ([]byte, bool) {
+	if m.counter < c.index || m.counter-c.index > maxMessageGap {
+		return nil, false
+	}
+	for c.index < m.counter {
+		c = c.next()
+	}
+	return decryptWithKey(c.messageKey(), raw, m)
+}
+
+// decrypt decrypts an encoded message.  Returns error on failure.  If the
+// message is for an unsupported version of the protocol then the error will
+// be "BAD_MESSAGE_VERSION".  If the message couldn't be decoded then the
+// error will be "BAD_MESSAGE_FORMAT".  If the MAC on the message was invalid
+// then the error will be "BAD_MESSAGE_MAC".
+func (r *ratchet) decrypt(raw []byte) ([]byte, error) {
+	m := decodeOlmMessage(raw)
+	// libolm checks the ciphertext first, when computing the maximum
+	// plain-text length.
+	if m.ciphertext == nil {
+		return nil, fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	if m.version != olmProtocolVersion {
+		return nil, fmt.Errorf("BAD_MESSAGE_VERSION")
+	}
+	if !m.hasCounter || m.ratchetKey == nil || m.ciphertext == nil || len(m.ratchetKey) != curve25519KeyLen {
+		return nil, fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	var theirKey [curve25519KeyLen]byte
+	copy(theirKey[:], m.ratchetKey)
+
+	var chain *receiverChain
+	for i := range r.receiverChains {
+		if r.receiverChains[i].ratchetKey == theirKey {
+			chain = &r.receiverChains[i]
+			break
+		}
+	}
+
+	var plaintext []byte
+	ok := false
+	switch {
+	case chain == nil:
+		// They have started using a new ratchet key, which they shouldn't
+		// do before we reply to them.
+		if len(r.senderChains) == 0 || m.counter > maxMessageGap {
+			break
+		}
+		_, c := r.advanceRootKey(&r.senderChains[0].ratchetKey, theirKey)
+		plaintext, ok = decryptWithChain(c, raw, m)
+	case chain.chainKey.index > m.counter:
+		// The chain has moved past the message, its key may have been
+		// skipped.
+		for i, skipped := range r.skippedMessageKeys {
+			if skipped.messageKey.index != m.counter || skipped.ratchetKey != theirKey {
+				continue
+			}
+			plaintext, ok = decryptWithKey(skipped.messageKey, raw, m)
+			if ok {
+				r.skippedMessageKeys = append(r.skippedMessageKeys[:i], r.skippedMessageKeys[i+1:]...)
+				return plaintext, nil
+			}
+		}
+	default:
+		plaintext, ok = decryptWithChain(chain.chainKey, raw, m)
+	}
+	if !ok {
+		return nil, fmt.Errorf("BAD_MESSAGE_MAC")
+	}
+
+	if chain == nil {
+		// Derive the new chain and discard our ratchet key, a new one will
+		// be generated for the next message we send.
+		c := receiverChain{ratchetKey: theirKey}
+		r.rootKey, c.chainKey = r.advanceRootKey(&r.senderChains[0].ratchetKey, theirKey)
+		r.insertReceiverChain(c)
+		chain = &r.receiverChains[0]
+		r.senderChains = nil
+	}
+	for chain.chainKey.index < m.counter {
+		skipped := skippedMessageKey{ratchetKey: chain.ratchetKey, messageKey: chain.chainKey.messageKey()}
+		r.insertSkippedMessageKey(skipped)
+		chain.chainKey = chain.chainKey.next()
+	}
+	chain.chainKey = chain.chainKey.next()
+	return plaintext, nil
+}
+
+// insertReceiverChain inserts a chain at the front, dropping the oldest
+// chain if the list is full.
+func (r *ratchet) insertReceiverChain(c receiverChain) {
+	if len(r.receiverChains) == maxReceiverChains {
+		r.receiverChains = r.receiverChains[:maxReceiverChains-1]
+	}
+	r.receiverChains = append([]receiverChain{c}, r.receiverChains...)
+}
+
+// insertSkippedMessageKey appends a key, overwriting the last key if the list
+// is full, as libolm's List::insert does.
+func (r *ratchet) insertSkippedMessageKey(k skippedMessageKey) {
+	if len(r.skippedMessageKeys) == maxSkippedMessageKey {
+		r.skippedMessageKeys[maxSkippedMessageKey-1] = k
+		return
+	}
+	r.skippedMessageKeys = append(r.skippedMessageKeys, k)
+}
+
+// pickle writes the ratchet.
+func (r *ratchet) pickle(w *pickleWriter) {
+	w.bytes(r.rootKey[:])
+	w.uint32(uint32(len(r.senderChains)))
+	for i := range r.senderChains {
+		r.senderChains[i].ratchetKey.pickle(w)
+		r.senderChains[i].chainKey.pickle(w)
+	}
+	w.uint32(uint32(len(r.receiverChains)))
+	for i := range r.receiverChains {
+		w.bytes(r.receiverChains[i].ratchetKey[:])
+		r.receiverChains[i].chainKey.pickle(w)
+	}
+	w.uint32(uint32(len(r.skippedMessageKeys)))
+	for i := range r.skippedMessageKeys {
+		w.bytes(r.skippedMessageKeys[i].ratchetKey[:])
+		(*chainKey)(&r.skippedMessageKeys[i].messageKey).pickle(w)
+	}
+}
+
+// unpickle reads the ratchet.  Pickles with the chain index version hold
+// two unused integers at the end.
+func (r *ratchet) unpickle(pr *pickleReader, includesChainIndex bool) {
+	copy(r.rootKey[:], pr.bytes(32))
+	r.senderChains = make([]senderChain, pr.count(maxSenderChains))
+	for i := range r.senderChains {
+		r.senderChains[i].ratchetKey.unpickle(pr)
+		r.senderChains[i].chainKey.unpickle(pr)
+	}
+	r.receiverChains = make([]receiverChain, pr.count(maxReceiverChains))
+	for i := range r.receiverChains {
+		copy(r.receiverChains[i].ratchetKey[:], pr.bytes(curve25519KeyLen))
+		r.receiverChains[i].chainKey.unpickle(pr)
+	}
+	r.skippedMessageKeys = make([]skippedMessageKey, pr.count(maxSkippedMessageKey))
+	for i := range r.skippedMessageKeys {
+		copy(r.skippedMessageKeys[i].ratchetKey[:], pr.bytes(curve25519KeyLen))
+		(*chainKey)(&r.skippedMessageKeys[i].messageKey).unpickle(pr)
+	}
+	if includesChainIndex {
+		pr.bytes(8)
+	}
+}
@@ -0,0 +1,211 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Session stores an end to end encrypted messaging session.
+type Session struct {
+	receivedMessage  bool
+	aliceIdentityKey [curve25519KeyLen]byte
+	aliceBaseKey     [curve25519KeyLen]byte
+	bobOneTimeKey    [curve25519KeyLen]byte
+	ratchet          ratchet
+}
+
+// Clear clears the memory used to back this Session.
+func (s *Session) Clear() error {
+	*s = Session{}
+	return nil
+}
+
+// Pickle returns a Session as a base64 string.  Encrypts the Session using the
+// supplied key.
+func (s *Session) Pickle(key []byte) string {
+	w := &pickleWriter{}
+	w.uint32(SessionPickleVersion)
+	w.bool(s.receivedMessage)
+	w.bytes(s.aliceIdentityKey[:])
+	w.bytes(s.aliceBaseKey[:])
+	w.bytes(s.bobOneTimeKey[:])
+	s.ratchet.pickle(w)
+	defer clearBytes(w.data)
+	return pickleEncrypt(w.data, key)
+}
+
+// SessionFromPickled loads a Session from a pickled base64 string.  Decrypts
+// the Session using the supplied key.  Returns error on failure.  If the key
+// doesn't match the one used to encrypt the Session then the error will be
+// "BAD_ACCOUNT_KEY".  If the base64 couldn't be decoded then the error will be
+// "INVALID_BASE64".
+func SessionFromPickled(pickled string, key []byte) (*Session, error) {
+	if len(pickled) == 0 {
+		return nil, fmt.Errorf("Empty input")
+	}
+	plaintext, err := pickleDecrypt(pickled, key)
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(plaintext)
+	r := &pickleReader{data: plaintext}
+	version := r.uint32()
+	if r.err == nil && version != SessionPickleVersion && version != sessionChainIndex {
+		return nil, fmt.Errorf("UNKNOWN_PICKLE_VERSION")
+	}
+	s := &Session{}
+	s.receivedMessage = r.bool()
+	copy(s.aliceIdentityKey[:], r.bytes(curve25519KeyLen))
+	copy(s.aliceBaseKey[:], r.bytes(curve25519KeyLen))
+	copy(s.bobOneTimeKey[:], r.bytes(curve25519KeyLen))
+	s.ratchet.unpickle(r, version == sessionChainIndex)
+	err = r.end()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ID returns an identifier for this Session.  Will be the same for both ends
+// of the conversation.
+func (s *Session) ID() SessionID {
+	h := sha256.New()
+	h.Write(s.aliceIdentityKey[:])
+	h.Write(s.aliceBaseKey[:])
+	h.Write(s.bobOneTimeKey[:])
+	return SessionID(encodeOlmBase64(h.Sum(nil)))
+}
+
+// HasReceivedMessage returns true if this session has received any message.
+func (s *Session) HasReceivedMessage() bool {
+	return s.receivedMessage
+}
+
+// decodePreKeyMessageBase64 decodes a PRE_KEY message in base64 and checks its
+// fields.
+func decodePreKeyMessageBase64(oneTimeKeyMsg string, haveTheirIdentityKey bool) (*preKeyMessage, error) {
+	raw, err := decodeOlmBase64(oneTimeKeyMsg)
+	if err != nil {
+		return nil, err
+	}
+	m := decodePreKeyMessage(raw)
+	if m.version != olmProtocolVersion {
+		return nil, fmt.Errorf("BAD_MESSAGE_VERSION")
+	}
+	if !m.checkFields(haveTheirIdentityKey) {
+		return nil, fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	return m, nil
+}
+
+// matchesInboundSession checks the keys of a PRE_KEY message.  Like libolm, it
+// doesn't check the version, and a message without the keys doesn't match.
+func (s *Session) matchesInboundSession(theirIdentityKey []byte, oneTimeKeyMsg string) (bool, error) {
+	raw, err := decodeOlmBase64(oneTimeKeyMsg)
+	if err != nil {
+		return false, err
+	}
+	m := decodePreKeyMessage(raw)
+	if !m.checkFields(theirIdentityKey != nil) {
+		return false, nil
+	}
+	same := true
+	if m.identityKey != nil {
+		same = same && bytes.Equal(m.identityKey, s.aliceIdentityKey[:])
+	}
+	if theirIdentityKey != nil {
+		same = same && bytes.Equal(theirIdentityKey, s.aliceIdentityKey[:])
+	}
+	same = same && bytes.Equal(m.baseKey, s.aliceBaseKey[:])
+	same = same && bytes.Equal(m.oneTimeKey, s.bobOneTimeKey[:])
+	return same, nil
+}
+
+// MatchesInboundSession checks if the PRE_KEY message is for this in-bound
+// Session.  This can happen if multiple messages are sent to this Account
+// before this Account sends a message in reply.  Returns true if the session
+// matches.  Returns false if the session does not match.  Returns error on
+// failure.  If the base64 couldn't be decoded then the error will be
+// "INVALID_BASE64".  A message that couldn't be decoded doesn't match.
+func (s *Session) MatchesInboundSession(oneTimeKeyMsg string) (bool, error) {
+	if len(oneTimeKeyMsg) == 0 {
+		return false, fmt.Errorf("Empty input")
+	}
+	return s.matchesInboundSession(nil, oneTimeKeyMsg)
+}
+
+// MatchesInboundSessionFrom checks if the PRE_KEY message is for this in-bound
+// Session.  This can happen if multiple messages are sent to this Account
+// before this Account sends a message in reply.  Returns true if the session
+// matches.  Returns false if the session does not match.  Returns error on
+// failure.  If the base64 couldn't be decoded then the error will be
+// "INVALID_BASE64".  A message that couldn't be decoded doesn't match.
+func (s *Session) MatchesInboundSessionFrom(theirIdentityKey, oneTimeKeyMsg string) (bool, error) {
+	if len(theirIdentityKey) == 0 || len(oneTimeKeyMsg) == 0 {
+		return false, fmt.Errorf("Empty input")
+	}
+	key, err := decodeOlmKey(theirIdentityKey)
+	if err != nil {
+		return false, err
+	}
+	return s.matchesInboundSession(key, oneTimeKeyMsg)
+}
+
+// EncryptMsgType returns the type of the next message that Encrypt will
+// return.  Returns MsgTypePreKey if the message will be a PRE_KEY message.
+// Returns MsgTypeMsg if the message will be a normal message.
+func (s *Session) EncryptMsgType() MsgType {
+	if s.receivedMessage {
+		return MsgTypeMsg
+	}
+	return MsgTypePreKey
+}
+
+// Encrypt encrypts a message using the Session.  Returns the encrypted message
+// as base64.
+func (s *Session) Encrypt(plaintext string) (MsgType, string) {
+	if len(plaintext) == 0 {
+		plaintext = " "
+	}
+	messageType := s.EncryptMsgType()
+	message := s.ratchet.encrypt([]byte(plaintext))
+	if messageType == MsgTypePreKey {
+		message = encodePreKeyMessage(s.bobOneTimeKey[:], s.aliceBaseKey[:], s.aliceIdentityKey[:], message)
+	}
+	return messageType, encodeOlmBase64(message)
+}
+
+// Decrypt decrypts a message using the Session.  Returns the the plain-text on
+// success.  Returns error on failure.  If the base64 couldn't be decoded then
+// the error will be "INVALID_BASE64".  If the message is for an unsupported
+// version of the protocol then the error will be "BAD_MESSAGE_VERSION".  If
+// the message couldn't be decoded then the error will be BAD_MESSAGE_FORMAT".
+// If the MAC on the message was invalid then the error will be
+// "BAD_MESSAGE_MAC".
+func (s *Session) Decrypt(message string, msgType MsgType) (string, error) {
+	if len(message) == 0 {
+		return "", fmt.Errorf("Empty input")
+	}
+	raw, err := decodeOlmBase64(message)
+	if err != nil {
+		return "", err
+	}
+	if msgType == MsgTypePreKey {
+		// As in libolm, only the inner message is checked.
+		m := decodePreKeyMessage(raw)
+		if m.message == nil {
+			return "", fmt.Errorf("BAD_MESSAGE_FORMAT")
+		}
+		raw = m.message
+	}
+	plaintext, err := s.ratchet.decrypt(raw)
+	if err != nil {
+		return "", err
+	}
+	s.receivedMessage = true
+	return string(plaintext), nil
+}
@@ -0,0 +1,125 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestGoolmEd25519(t *testing.T) {
+	// RFC 8032, section 7.1, test 3
+	seed := []byte{
+		0xc5, 0xaa, 0x8d, 0xf4, 0x3f, 0x9f, 0x83, 0x7b, 0xed, 0xb7, 0x44, 0x2f, 0x31, 0xdc, 0xb7, 0xb1,
+		0x66, 0xd3, 0x85, 0x35, 0x07, 0x6f, 0x09, 0x4b, 0x85, 0xce, 0x3a, 0x2e, 0x0b, 0x44, 0x58, 0xf7,
+	}
+	message := []byte{0xaf, 0x82}
+	k := newEd25519KeyPair(seed)
+	expected := ed25519.NewKeyFromSeed(seed)
+	if !bytes.Equal(k.public[:], expected.Public().(ed25519.PublicKey)) {
+		t.Fatal("Wrong public key", k.public)
+	}
+	signature := k.sign(message)
+	if !bytes.Equal(signature, ed25519.Sign(expected, message)) {
+		t.Fatal("Wrong signature", signature)
+	}
+	if !ed25519Verify(k.public[:], message, signature) || ed25519Verify(k.public[:], []byte("other"), signature) {
+		t.Fatal("ed25519Verify() doesn't check the signature")
+	}
+}
+
+func TestGoolmMegolmRatchet(t *testing.T) {
+	data := bytes.Repeat([]byte{0x42}, megolmRatchetLen)
+	for _, index := range []uint32{1, 0xFF, 0x100, 0x101, 0x1FF, 0x10000, 0x10101} {
+		stepped := newMegolmRatchet(data, 0)
+		for i := uint32(0); i < index; i++ {
+			stepped.advance()
+		}
+		jumped := newMegolmRatchet(data, 0)
+		jumped.advanceTo(index)
+		if stepped != jumped {
+			t.Fatal("advance() and advanceTo() disagree at index", index)
+		}
+	}
+	// advanceTo() from an intermediate index
+	r1 := newMegolmRatchet(data, 0)
+	r1.advanceTo(0x1234)
+	r1.advanceTo(0x12345)
+	r2 := newMegolmRatchet(data, 0)
+	r2.advanceTo(0x12345)
+	if r1 != r2 {
+		t.Fatal("advanceTo() depends on the intermediate index")
+	}
+}
+
+func TestGoolmMessageEncoding(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, curve25519KeyLen)
+	raw := encodeOlmMessage(key, 300, []byte("ciphertext"))
+	m := decodeOlmMessage(raw)
+	if m.version != olmProtocolVersion || !bytes.Equal(m.ratchetKey, key) || !m.hasCounter || m.counter != 300 || string(m.ciphertext) != "ciphertext" {
+		t.Fatal("Wrong decoded message", m)
+	}
+	// Unknown fields are skipped and truncated fields ignored.
+	raw = append([]byte{olmProtocolVersion, 0x28, 0x05, 0x32, 0x01, 0xFF}, raw[1:]...)
+	if m = decodeOlmMessage(raw); m.counter != 300 || string(m.ciphertext) != "ciphertext" {
+		t.Fatal("Unknown fields weren't skipped", m)
+	}
+	if m = decodeOlmMessage([]byte{olmProtocolVersion, ciphertextTag, 0x7F, 0, 0, 0, 0, 0, 0, 0, 0}); m.ciphertext != nil {
+		t.Fatal("Truncated field was decoded", m)
+	}
+
+	raw = encodeGroupMessage(1<<20, []byte("ciphertext"))
+	if len(raw) != groupMessageLen(1<<20, len("ciphertext")) {
+		t.Fatal("Wrong group message length", len(raw))
+	}
+	g := decodeGroupMessage(raw)
+	if g.version != olmProtocolVersion || !g.hasMessageIndex || g.messageIndex != 1<<20 || string(g.ciphertext) != "ciphertext" {
+		t.Fatal("Wrong decoded group message", g)
+	}
+}
+
+func TestGoolmSessionOutOfOrder(t *testing.T) {
+	alice := NewAccount()
+	bob := NewAccount()
+	bob.GenOneTimeKeys(1)
+	_, bobKey := bob.IdentityKeys()
+	var otk Curve25519
+	for _, otk = range bob.OneTimeKeys().Curve25519 {
+	}
+	aliceSession, err := alice.NewOutboundSession(bobKey, otk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgType, first := aliceSession.Encrypt("first")
+	bobSession, err := bob.NewInboundSession(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := bobSession.Decrypt(first, msgType); err != nil || plaintext != "first" {
+		t.Fatal("Decrypt() failed", plaintext, err)
+	}
+	_, reply := bobSession.Encrypt("reply")
+	if _, err := aliceSession.Decrypt(reply, MsgTypeMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []string
+	for i := 0; i < 5; i++ {
+		_, m := aliceSession.Encrypt(string(rune('a' + i)))
+		messages = append(messages, m)
+	}
+	for _, i := range []int{4, 0, 2, 1, 3} {
+		plaintext, err := bobSession.Decrypt(messages[i], MsgTypeMsg)
+		if err != nil || plaintext != string(rune('a'+i)) {
+			t.Fatal("Out of order Decrypt() failed for message", i, plaintext, err)
+		}
+	}
+	if _, err := bobSession.Decrypt(messages[2], MsgTypeMsg); err == nil || err.Error() != "BAD_MESSAGE_MAC" {
+		t.Fatal("Replayed message should fail with BAD_MESSAGE_MAC, got", err)
+	}
+	if len(bobSession.ratchet.skippedMessageKeys) != 0 {
+		t.Fatal("Skipped message keys weren't removed", len(bobSession.ratchet.skippedMessageKeys))
+	}
+}
@@ -0,0 +1,50 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// Utility stores the necessary state to perform hash and signature
+// verification operations.  The pure Go implementation has no state.
+type Utility struct{}
+
+// Clear clears the memory used to back this utility.
+func (u *Utility) Clear() error {
+	return nil
+}
+
+// NewUtility creates a new utility.
+func NewUtility() *Utility {
+	return &Utility{}
+}
+
+// Sha256 calculates the SHA-256 hash of the input and encodes it as base64.
+func (u *Utility) Sha256(input string) string {
+	if len(input) == 0 {
+		input = " "
+	}
+	hash := sha256.Sum256([]byte(input))
+	return encodeOlmBase64(hash[:])
+}
+
+// VerifySignature verifies an ed25519 signature.  Returns true if the verification
+// suceeds or false otherwise.  Returns error on failure.  If the key was too
+// small then the error will be "INVALID_BASE64".
+func (u *Utility) VerifySignature(message string, key Ed25519, signature string) (bool, error) {
+	if len(message) == 0 || len(key) == 0 || len(signature) == 0 {
+		return false, fmt.Errorf("Empty input")
+	}
+	publicKey, err := decodeOlmKey(string(key))
+	if err != nil {
+		return false, err
+	}
+	sig, err := decodeOlmBase64(signature)
+	if err != nil {
+		return false, nil
+	}
+	return ed25519Verify(publicKey, []byte(message), sig), nil
+}
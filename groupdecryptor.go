@@ -0,0 +1,122 @@
+package olm
+
+import (
+	"encoding/base64"
+	"sort"
+)
+
+// DefaultCheckpointInterval is the default number of messages between the
+// checkpoints of a GroupDecryptor.
+const DefaultCheckpointInterval = 64
+
+// groupCheckpoint is a copy of an InboundGroupSession starting at index.
+type groupCheckpoint struct {
+	index   uint32
+	session *InboundGroupSession
+}
+
+// GroupDecryptor decrypts the messages of an InboundGroupSession at any index
+// without changing the session.  InboundGroupSession.Decrypt advances the
+// ratchet from the first known index for every message older than the latest
+// one decrypted, which makes decrypting the history of a room backwards slow.
+// GroupDecryptor keeps checkpoints, copies of the session starting every
+// interval messages which are created when a message after them is first
+// decrypted, and decrypts each message from the checkpoint before it.  A
+// GroupDecryptor isn't safe for concurrent use.
+type GroupDecryptor struct {
+	interval uint32
+	// checkpoints are sorted by index, starting at the first known index of
+	// the session.
+	checkpoints []groupCheckpoint
+}
+
+// newCheckpoint returns a copy of the InboundGroupSession s starting at index.
+func newCheckpoint(s *InboundGroupSession, index uint32) (*InboundGroupSession, error) {
+	export, err := s.Export(index)
+	if err != nil {
+		return nil, err
+	}
+	return InboundGroupSessionImport([]byte(export))
+}
+
+// NewGroupDecryptor returns a GroupDecryptor for the InboundGroupSession s,
+// with checkpoints every interval messages.  An interval of 0 selects
+// DefaultCheckpointInterval.  Returns error on failure.
+func NewGroupDecryptor(s *InboundGroupSession, interval uint32) (*GroupDecryptor, error) {
+	if interval == 0 {
+		interval = DefaultCheckpointInterval
+	}
+	first := uint32(s.FirstKnownIndex())
+	session, err := newCheckpoint(s, first)
+	if err != nil {
+		return nil, err
+	}
+	return &GroupDecryptor{
+		interval:    interval,
+		checkpoints: []groupCheckpoint{{first, session}},
+	}, nil
+}
+
+// groupMessageIndex returns the index of a group message in base64.  Returns
+// false if the message can't be decoded.
+func groupMessageIndex(message string) (uint32, bool) {
+	raw, err := base64.RawStdEncoding.DecodeString(message)
+	if err != nil {
+		return 0, false
+	}
+	m := decodeGroupMessage(raw)
+	if m.version != olmProtocolVersion || !m.hasMessageIndex || m.ciphertext == nil {
+		return 0, false
+	}
+	return m.messageIndex, true
+}
+
+// Decrypt decrypts a message like InboundGroupSession.Decrypt, from the
+// checkpoint before the message index.  Returns the plain-text and message
+// index on success.  Returns error on failure, with the errors of
+// InboundGroupSession.Decrypt.  If the checkpoint couldn't be created then the
+// error is the one of InboundGroupSession.Export or InboundGroupSessionImport.
+func (d *GroupDecryptor) Decrypt(message string) (string, uint32, error) {
+	first := d.checkpoints[0]
+	index, ok := groupMessageIndex(message)
+	if !ok || index < first.index {
+		// Let the session report the error.
+		return first.session.Decrypt(message)
+	}
+	start := first.index + (index-first.index)/d.interval*d.interval
+	i := sort.Search(len(d.checkpoints), func(i int) bool {
+		return d.checkpoints[i].index > start
+	}) - 1
+	if d.checkpoints[i].index == start {
+		return d.checkpoints[i].session.Decrypt(message)
+	}
+	session, err := newCheckpoint(d.checkpoints[i].session, start)
+	if err != nil {
+		return "", 0, err
+	}
+	// Only keep the checkpoint once the message is authenticated, so that
+	// forged messages can't make the GroupDecryptor grow.
+	plaintext, index, err := session.Decrypt(message)
+	if err != nil {
+		session.Clear()
+		return "", 0, err
+	}
+	i++
+	d.checkpoints = append(d.checkpoints, groupCheckpoint{})
+	copy(d.checkpoints[i+1:], d.checkpoints[i:])
+	d.checkpoints[i] = groupCheckpoint{start, session}
+	return plaintext, index, nil
+}
+
+// Clear clears the memory used to back the checkpoints of this
+// GroupDecryptor.
+func (d *GroupDecryptor) Clear() error {
+	for _, c := range d.checkpoints {
+		err := c.session.Clear()
+		if err != nil {
+			return err
+		}
+	}
+	d.checkpoints = nil
+	return nil
+}
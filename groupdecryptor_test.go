@@ -0,0 +1,113 @@
+package olm
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// groupHistory returns the messages sent by an out-bound group session and an
+// InboundGroupSession created at firstIndex.
+func groupHistory(t testing.TB, n int, firstIndex uint32) ([]string, *InboundGroupSession) {
+	outbound := NewOutboundGroupSession()
+	inbound, err := NewInboundGroupSession([]byte(outbound.SessionKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for i := 0; i < n; i++ {
+		messages = append(messages, outbound.Encrypt(fmt.Sprintf("message %d", i)))
+	}
+	if firstIndex == 0 {
+		return messages, inbound
+	}
+	export, err := inbound.Export(firstIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbound, err = InboundGroupSessionImport([]byte(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages, inbound
+}
+
+func TestGroupDecryptor(t *testing.T) {
+	const n = 300
+	messages, inbound := groupHistory(t, n, 10)
+	pickled := inbound.Pickle([]byte("key"))
+	d, err := NewGroupDecryptor(inbound, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Backwards, then in random order.
+	var order []int
+	for i := n - 1; i >= 10; i-- {
+		order = append(order, i)
+	}
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n - 10) {
+		order = append(order, 10+i)
+	}
+	for _, i := range order {
+		plaintext, index, err := d.Decrypt(messages[i])
+		if err != nil || plaintext != fmt.Sprintf("message %d", i) || index != uint32(i) {
+			t.Fatal("Decrypt() failed for message", i, plaintext, index, err)
+		}
+	}
+	if len(d.checkpoints) != (n-10+15)/16 {
+		t.Fatal("Wrong number of checkpoints", len(d.checkpoints))
+	}
+	for i, c := range d.checkpoints {
+		if c.index != 10+uint32(i)*16 {
+			t.Fatal("Wrong checkpoint", i, c.index)
+		}
+	}
+	if inbound.Pickle([]byte("key")) != pickled {
+		t.Fatal("GroupDecryptor changed the InboundGroupSession")
+	}
+
+	for _, test := range []struct {
+		name    string
+		message string
+	}{
+		{"unknown index", messages[5]},
+		{"invalid base64", "AAAAA"},
+		{"wrong version", testMessage(2, 80)},
+		{"missing fields", testMessage(3, 80)},
+		{"bad signature", tamper(t, messages[20])},
+	} {
+		_, _, expected := inbound.Decrypt(test.message)
+		_, _, err := d.Decrypt(test.message)
+		if expected == nil || errString(err) != errString(expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, expected, err)
+		}
+	}
+	if err := d.Clear(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupDecryptorForgedMessages(t *testing.T) {
+	const n = 200
+	messages, inbound := groupHistory(t, n, 0)
+	d, err := NewGroupDecryptor(inbound, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Messages with a bad signature don't create checkpoints.
+	for i := 4; i < n; i += 4 {
+		if _, _, err := d.Decrypt(tamper(t, messages[i])); err == nil {
+			t.Fatal("Decrypt() should fail for tampered message", i)
+		}
+	}
+	if len(d.checkpoints) != 1 {
+		t.Fatal("Forged messages created checkpoints", len(d.checkpoints))
+	}
+	plaintext, index, err := d.Decrypt(messages[n-1])
+	if err != nil || plaintext != fmt.Sprintf("message %d", n-1) || index != n-1 {
+		t.Fatal("Decrypt() failed", plaintext, index, err)
+	}
+	if len(d.checkpoints) != 2 {
+		t.Fatal("Wrong number of checkpoints", len(d.checkpoints))
+	}
+}
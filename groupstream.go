@@ -0,0 +1,133 @@
+package olm
+
+import (
+	"fmt"
+	"io"
+)
+
+// DefaultMaxGroupPlaintextLen is the default maximum length in bytes of a
+// plain-text encrypted by a GroupStreamEncrypter.
+const DefaultMaxGroupPlaintextLen = 65536
+
+// GroupStreamEncrypter encrypts large plain-texts read from an io.Reader with
+// an OutboundGroupSession and writes the cipher-text to an io.Writer, without
+// the copies made by OutboundGroupSession.Encrypt.  A Megolm message can't be
+// split, so the plain-text and the cipher-text are held in memory once each,
+// which is bounded by MaxPlaintextLen.
+type GroupStreamEncrypter struct {
+	Session *OutboundGroupSession
+	// MaxPlaintextLen is the maximum length of a plain-text in bytes.
+	// Defaults to DefaultMaxGroupPlaintextLen.
+	MaxPlaintextLen int
+}
+
+// maxPlaintextLen returns the configured MaxPlaintextLen or its default.
+func (e *GroupStreamEncrypter) maxPlaintextLen() int {
+	if e.MaxPlaintextLen <= 0 {
+		return DefaultMaxGroupPlaintextLen
+	}
+	return e.MaxPlaintextLen
+}
+
+// checkLen returns error if plaintextLen is negative or above the maximum.
+func (e *GroupStreamEncrypter) checkLen(plaintextLen int) error {
+	if plaintextLen < 0 {
+		return fmt.Errorf("Invalid plain-text length %d", plaintextLen)
+	}
+	if plaintextLen > e.maxPlaintextLen() {
+		return fmt.Errorf("Plain-text of %d bytes exceeds the maximum of %d bytes", plaintextLen, e.maxPlaintextLen())
+	}
+	return nil
+}
+
+// CiphertextLen returns the exact length in bytes of the cipher-text Encrypt
+// writes for a plain-text of plaintextLen bytes.  Returns error if
+// plaintextLen exceeds MaxPlaintextLen.
+func (e *GroupStreamEncrypter) CiphertextLen(plaintextLen int) (int, error) {
+	err := e.checkLen(plaintextLen)
+	if err != nil {
+		return 0, err
+	}
+	if plaintextLen == 0 {
+		plaintextLen = 1
+	}
+	return int(e.Session.encryptMsgLen(plaintextLen)), nil
+}
+
+// Encrypt reads a plain-text of exactly plaintextLen bytes from r, encrypts
+// it as the next message of the Session and writes the base64 cipher-text to
+// w.  As with OutboundGroupSession.Encrypt an empty plain-text is encrypted as
+// a single space.  Returns the number of bytes written, which is
+// CiphertextLen(plaintextLen).  Returns error if plaintextLen exceeds
+// MaxPlaintextLen, if r ends early or on failure.
+func (e *GroupStreamEncrypter) Encrypt(w io.Writer, r io.Reader, plaintextLen int) (int, error) {
+	err := e.checkLen(plaintextLen)
+	if err != nil {
+		return 0, err
+	}
+	plaintext := make([]byte, plaintextLen)
+	defer clearBytes(plaintext)
+	_, err = io.ReadFull(r, plaintext)
+	if err != nil {
+		return 0, err
+	}
+	return e.encrypt(w, plaintext)
+}
+
+// encrypt encrypts the plain-text and writes the cipher-text to w.
+func (e *GroupStreamEncrypter) encrypt(w io.Writer, plaintext []byte) (int, error) {
+	messageLen, err := e.CiphertextLen(len(plaintext))
+	if err != nil {
+		return 0, err
+	}
+	if len(plaintext) == 0 {
+		plaintext = []byte(" ")
+	}
+	message := make([]byte, messageLen)
+	n, err := e.Session.encryptInto(plaintext, message)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(message[:n])
+}
+
+// EncryptAll reads the plain-text from r until EOF and encrypts it like
+// Encrypt.  Returns error without encrypting anything if the plain-text
+// exceeds MaxPlaintextLen.
+func (e *GroupStreamEncrypter) EncryptAll(w io.Writer, r io.Reader) (int, error) {
+	max := e.maxPlaintextLen()
+	plaintext := make([]byte, 0, 512)
+	defer func() { clearBytes(plaintext[:cap(plaintext)]) }()
+	for {
+		if len(plaintext) == cap(plaintext) {
+			// One byte more than max is enough to detect an overlong input
+			grownCap := 2 * cap(plaintext)
+			if grownCap > max+1 {
+				grownCap = max + 1
+			}
+			grown := make([]byte, len(plaintext), grownCap)
+			copy(grown, plaintext)
+			clearBytes(plaintext)
+			plaintext = grown
+		}
+		n, err := r.Read(plaintext[len(plaintext):cap(plaintext)])
+		plaintext = plaintext[:len(plaintext)+n]
+		if len(plaintext) > max {
+			return 0, e.checkLen(len(plaintext))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return e.encrypt(w, plaintext)
+}
+
+// clearBytes overwrites b with zeros.
+func clearBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,91 @@
+package olm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// endlessReader returns as many bytes as asked for and counts them.
+type endlessReader struct {
+	requested int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	r.requested += len(p)
+	return len(p), nil
+}
+
+func TestGroupStreamEncrypterLimit(t *testing.T) {
+	e := &GroupStreamEncrypter{MaxPlaintextLen: 16}
+	if _, err := e.CiphertextLen(17); err == nil {
+		t.Fatal("CiphertextLen() should refuse plain-texts above the maximum")
+	}
+	if _, err := e.CiphertextLen(-1); err == nil {
+		t.Fatal("CiphertextLen() should refuse negative lengths")
+	}
+	var out bytes.Buffer
+	_, err := e.EncryptAll(&out, strings.NewReader(strings.Repeat("x", 17)))
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Fatal("EncryptAll() should refuse plain-texts above the maximum, got", err)
+	}
+	_, err = e.Encrypt(&out, strings.NewReader("x"), 17)
+	if err == nil || out.Len() != 0 {
+		t.Fatal("Encrypt() should refuse plain-texts above the maximum, got", err)
+	}
+	e.MaxPlaintextLen = 1000
+	r := &endlessReader{}
+	_, err = e.EncryptAll(&out, r)
+	if err == nil || r.requested > e.MaxPlaintextLen+1 {
+		t.Fatalf("EncryptAll() read %d bytes past the maximum, got %v", r.requested-e.MaxPlaintextLen, err)
+	}
+	if (&GroupStreamEncrypter{}).maxPlaintextLen() != DefaultMaxGroupPlaintextLen {
+		t.Fatal("MaxPlaintextLen should default to DefaultMaxGroupPlaintextLen")
+	}
+}
+
+func TestGroupStreamEncrypter(t *testing.T) {
+	outbound := NewOutboundGroupSession()
+	inbound, err := NewInboundGroupSession([]byte(outbound.SessionKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &GroupStreamEncrypter{Session: outbound, MaxPlaintextLen: 1 << 20}
+
+	for i, plaintext := range []string{"", "Hello", strings.Repeat("large state event ", 50000)} {
+		expectedLen, err := e.CiphertextLen(len(plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		n, err := e.Encrypt(&out, strings.NewReader(plaintext), len(plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != expectedLen || out.Len() != expectedLen {
+			t.Fatal("Expected", expectedLen, "bytes of cipher-text, got", n, out.Len())
+		}
+		decrypted, index, err := inbound.Decrypt(out.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext == "" {
+			plaintext = " "
+		}
+		if decrypted != plaintext || index != uint32(i) {
+			t.Fatal("Decrypted message doesn't match", index)
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := e.Encrypt(&out, strings.NewReader("short"), 10); err == nil {
+		t.Fatal("Encrypt() should fail if the reader ends early")
+	}
+	if _, err := e.EncryptAll(&out, strings.NewReader("Hello again")); err != nil {
+		t.Fatal(err)
+	}
+	decrypted, _, err := inbound.Decrypt(out.String())
+	if err != nil || decrypted != "Hello again" {
+		t.Fatal("EncryptAll() round trip failed", decrypted, err)
+	}
+}
@@ -0,0 +1,259 @@
+package olm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	keyExportHeader     = "-----BEGIN MEGOLM SESSION DATA-----"
+	keyExportFooter     = "-----END MEGOLM SESSION DATA-----"
+	keyExportVersion    = 0x01
+	keyExportSaltLen    = 16
+	keyExportIVLen      = 16
+	keyExportMACLen     = sha256.Size
+	keyExportLineLength = 96
+	// keyExportMinLen is the length of the version byte, salt, IV, round
+	// count and MAC wrapped around the cipher-text.
+	keyExportMinLen = 1 + keyExportSaltLen + keyExportIVLen + 4 + keyExportMACLen
+)
+
+// DefaultKeyExportRounds is the number of PBKDF2 rounds used by Element when
+// exporting room keys.
+const DefaultKeyExportRounds = 500000
+
+// MaxKeyExportRounds is the largest number of PBKDF2 rounds accepted, so that
+// a crafted export can't make ImportKeys run for hours.
+const MaxKeyExportRounds = 10000000
+
+// ExportedSession is an InboundGroupSession as it appears in a Megolm session
+// export file or in the session data of a server-side key backup.
+type ExportedSession struct {
+	Algorithm                    Algorithm          `json:"algorithm"`
+	ForwardingCurve25519KeyChain []Curve25519       `json:"forwarding_curve25519_key_chain"`
+	RoomID                       string             `json:"room_id"`
+	SenderKey                    Curve25519         `json:"sender_key"`
+	SenderClaimedKeys            map[string]Ed25519 `json:"sender_claimed_keys"`
+	SessionID                    SessionID          `json:"session_id"`
+	SessionKey                   string             `json:"session_key"`
+}
+
+// NewExportedSession exports an InboundGroupSession at its first known index
+// together with the metadata needed to import it on another device.
+// senderKey and signingKey are the Curve25519 and Ed25519 identity keys of the
+// device that created the session.  Returns error on failure.
+func NewExportedSession(s *InboundGroupSession, roomID string, senderKey Curve25519, signingKey Ed25519) (*ExportedSession, error) {
+	sessionKey, err := s.Export(uint32(s.FirstKnownIndex()))
+	if err != nil {
+		return nil, err
+	}
+	return &ExportedSession{
+		Algorithm:                    AlgorithmMegolmV1,
+		ForwardingCurve25519KeyChain: []Curve25519{},
+		RoomID:                       roomID,
+		SenderKey:                    senderKey,
+		SenderClaimedKeys:            map[string]Ed25519{"ed25519": signingKey},
+		SessionID:                    s.ID(),
+		SessionKey:                   sessionKey,
+	}, nil
+}
+
+// Session creates an InboundGroupSession from the exported session key.
+// Returns error on failure.  If the exported session uses an algorithm other
+// than AlgorithmMegolmV1 or its session ID doesn't match the imported session
+// an error is returned.
+func (e *ExportedSession) Session() (*InboundGroupSession, error) {
+	if e.Algorithm != AlgorithmMegolmV1 {
+		return nil, fmt.Errorf("Unsupported algorithm %s", e.Algorithm)
+	}
+	s, err := InboundGroupSessionImport([]byte(e.SessionKey))
+	if err != nil {
+		return nil, err
+	}
+	if s.ID() != e.SessionID {
+		s.Clear()
+		return nil, fmt.Errorf("Session ID mismatch: expected %s, got %s", e.SessionID, s.ID())
+	}
+	return s, nil
+}
+
+// keyExportKeys derives the AES-256 and HMAC-SHA-256 keys of a session export
+// from the passphrase.
+func keyExportKeys(passphrase string, salt []byte, rounds uint32) (aesKey, hmacKey []byte) {
+	key := pbkdf2.Key([]byte(passphrase), salt, int(rounds), 64, sha512.New)
+	return key[:32], key[32:]
+}
+
+// ExportKeys exports the InboundGroupSessions at their first known index and
+// encrypts them with the passphrase into the armored "MEGOLM SESSION DATA"
+// format used by Element and other clients to export room keys.  rounds is
+// the number of PBKDF2 rounds; DefaultKeyExportRounds is a sensible choice.
+// An InboundGroupSession doesn't know its room or sender, so the room ID and
+// sender keys of the export are empty; use NewExportedSession and
+// ExportSessions to include them.  Returns error on failure.
+func ExportKeys(sessions []*InboundGroupSession, passphrase string, rounds uint32) ([]byte, error) {
+	exported := make([]*ExportedSession, 0, len(sessions))
+	for _, s := range sessions {
+		sessionKey, err := s.Export(uint32(s.FirstKnownIndex()))
+		if err != nil {
+			return nil, err
+		}
+		exported = append(exported, &ExportedSession{
+			Algorithm:                    AlgorithmMegolmV1,
+			ForwardingCurve25519KeyChain: []Curve25519{},
+			SenderClaimedKeys:            map[string]Ed25519{},
+			SessionID:                    s.ID(),
+			SessionKey:                   sessionKey,
+		})
+	}
+	return ExportSessions(exported, passphrase, rounds)
+}
+
+// ExportSessions encrypts the exported sessions, with their room IDs and
+// sender keys, with the passphrase into the armored "MEGOLM SESSION DATA"
+// format.  rounds is the number of PBKDF2 rounds, at most MaxKeyExportRounds;
+// DefaultKeyExportRounds is a sensible choice.  Returns error on failure.
+func ExportSessions(sessions []*ExportedSession, passphrase string, rounds uint32) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("Empty passphrase")
+	}
+	if rounds == 0 || rounds > MaxKeyExportRounds {
+		return nil, fmt.Errorf("Invalid number of rounds")
+	}
+	if sessions == nil {
+		sessions = []*ExportedSession{}
+	}
+	plaintext, err := json.Marshal(sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	random := make([]byte, keyExportSaltLen+keyExportIVLen)
+	_, err = crand.Read(random)
+	if err != nil {
+		panic("Couldn't get enough randomness from crypto/rand")
+	}
+	salt, iv := random[:keyExportSaltLen], random[keyExportSaltLen:]
+	// Clear bit 63 of the counter so that it can't overflow on platforms
+	// which only use the lower 64 bits.
+	iv[8] &= 0x7f
+	aesKey, hmacKey := keyExportKeys(passphrase, salt, rounds)
+
+	var buf bytes.Buffer
+	buf.WriteByte(keyExportVersion)
+	buf.Write(salt)
+	buf.Write(iv)
+	binary.Write(&buf, binary.BigEndian, rounds)
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, plaintext)
+	buf.Write(ciphertext)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(buf.Bytes())
+	buf.Write(mac.Sum(nil))
+
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+	var out bytes.Buffer
+	out.WriteString(keyExportHeader)
+	out.WriteByte('\n')
+	for len(encoded) > keyExportLineLength {
+		out.WriteString(encoded[:keyExportLineLength])
+		out.WriteByte('\n')
+		encoded = encoded[keyExportLineLength:]
+	}
+	if len(encoded) > 0 {
+		out.WriteString(encoded)
+		out.WriteByte('\n')
+	}
+	out.WriteString(keyExportFooter)
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+// ImportKeys decrypts a "MEGOLM SESSION DATA" export with the passphrase and
+// returns the sessions it contains.  Use ExportedSession.Session to turn them
+// into InboundGroupSessions.  Returns error on failure, or if the export uses
+// more than MaxKeyExportRounds rounds.  If the passphrase is wrong or the file
+// was modified the error will be "BAD_MESSAGE_MAC".
+func ImportKeys(data []byte, passphrase string) ([]*ExportedSession, error) {
+	plaintext, err := decryptKeyExport(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*ExportedSession
+	err = json.Unmarshal(plaintext, &sessions)
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// decryptKeyExport decrypts the payload of a "MEGOLM SESSION DATA" export.
+func decryptKeyExport(data []byte, passphrase string) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Empty input")
+	}
+	text := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(text, keyExportHeader) {
+		return nil, fmt.Errorf("Missing header line")
+	}
+	if !strings.HasSuffix(text, keyExportFooter) {
+		return nil, fmt.Errorf("Missing footer line")
+	}
+	text = text[len(keyExportHeader) : len(text)-len(keyExportFooter)]
+	encoded := strings.Join(strings.Fields(text), "")
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("INVALID_BASE64")
+	}
+	if len(raw) < keyExportMinLen {
+		return nil, fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	if raw[0] != keyExportVersion {
+		return nil, fmt.Errorf("BAD_MESSAGE_VERSION")
+	}
+
+	salt := raw[1 : 1+keyExportSaltLen]
+	iv := raw[1+keyExportSaltLen : 1+keyExportSaltLen+keyExportIVLen]
+	rounds := binary.BigEndian.Uint32(raw[1+keyExportSaltLen+keyExportIVLen:])
+	if rounds == 0 {
+		return nil, fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	if rounds > MaxKeyExportRounds {
+		return nil, fmt.Errorf("Key export uses %d rounds, more than %d", rounds, MaxKeyExportRounds)
+	}
+	body := raw[:len(raw)-keyExportMACLen]
+	ciphertext := body[keyExportMinLen-keyExportMACLen:]
+	aesKey, hmacKey := keyExportKeys(passphrase, salt, rounds)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), raw[len(body):]) {
+		return nil, fmt.Errorf("BAD_MESSAGE_MAC")
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+	return plaintext, nil
+}
@@ -0,0 +1,169 @@
+package olm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyExport(t *testing.T) {
+	exported := []*ExportedSession{{
+		Algorithm:                    AlgorithmMegolmV1,
+		ForwardingCurve25519KeyChain: []Curve25519{},
+		RoomID:                       "!room:example.org",
+		SenderKey:                    "wo76WcYtb0Vk/pBOdmduiGJ0wIEjW4IBMbbQn7aSnTo",
+		SenderClaimedKeys:            map[string]Ed25519{"ed25519": "TdbnI8JjtbJW1h9dISHcZ7LTpMYIjKFiEBfKp8hxCeI"},
+		SessionID:                    "SESSIONID",
+		SessionKey:                   "SESSIONKEY",
+	}}
+	data, err := ExportSessions(exported, "passphrase", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("ExportSessions():", string(data))
+	if !strings.HasPrefix(string(data), "-----BEGIN MEGOLM SESSION DATA-----\n") {
+		t.Fatal("Export doesn't start with the header line")
+	}
+
+	imported, err := ImportKeys(data, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 1 {
+		t.Fatalf("ImportKeys() returned %d sessions, expected 1", len(imported))
+	}
+	if imported[0].RoomID != exported[0].RoomID ||
+		imported[0].SessionKey != exported[0].SessionKey ||
+		imported[0].SenderClaimedKeys["ed25519"] != exported[0].SenderClaimedKeys["ed25519"] {
+		t.Fatalf("ImportKeys(ExportSessions()) = %+v != %+v", imported[0], exported[0])
+	}
+
+	// Wrong passphrase
+	_, err = ImportKeys(data, "wrong")
+	if err == nil || err.Error() != "BAD_MESSAGE_MAC" {
+		t.Fatal("ImportKeys() with a wrong passphrase should fail with BAD_MESSAGE_MAC, got", err)
+	}
+
+	// Truncated file
+	_, err = ImportKeys(data[:len(data)/2], "passphrase")
+	if err == nil {
+		t.Fatal("ImportKeys() of a truncated export should fail")
+	}
+}
+
+func TestKeyExportSession(t *testing.T) {
+	a := NewAccount()
+	signingKey, senderKey := a.IdentityKeys()
+	outbound := NewOutboundGroupSession()
+	inbound, err := NewInboundGroupSession([]byte(outbound.SessionKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := outbound.Encrypt("HELLO WORLD")
+
+	exported, err := NewExportedSession(inbound, "!room:example.org", senderKey, signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ExportSessions([]*ExportedSession{exported}, "passphrase", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportKeys(data, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := imported[0].Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID() != outbound.ID() {
+		t.Fatal("Imported session ID doesn't match")
+	}
+	plaintext, _, err := s.Decrypt(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "HELLO WORLD" {
+		t.Fatalf("Decrypt() = \"%s\" != \"HELLO WORLD\"", plaintext)
+	}
+}
+
+func TestExportKeys(t *testing.T) {
+	outbound := NewOutboundGroupSession()
+	outbound.Encrypt("skipped")
+	inbound, err := NewInboundGroupSession([]byte(outbound.SessionKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := outbound.Encrypt("HELLO WORLD")
+
+	data, err := ExportKeys([]*InboundGroupSession{inbound}, "passphrase", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportKeys(data, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 1 || imported[0].SessionID != outbound.ID() || imported[0].Algorithm != AlgorithmMegolmV1 {
+		t.Fatalf("ImportKeys(ExportKeys()) = %+v", imported)
+	}
+	s, err := imported[0].Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.FirstKnownIndex() != 1 {
+		t.Fatal("Wrong first known index", s.FirstKnownIndex())
+	}
+	plaintext, _, err := s.Decrypt(message)
+	if err != nil || plaintext != "HELLO WORLD" {
+		t.Fatal("Decrypt() failed", plaintext, err)
+	}
+
+	data, err = ExportKeys(nil, "passphrase", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported, err := ImportKeys(data, "passphrase"); err != nil || len(imported) != 0 {
+		t.Fatal("ImportKeys() of an empty export failed", imported, err)
+	}
+}
+
+// TestKeyExportVector decrypts a test vector of Element's export encryption,
+// with the salt "saltsaltsaltsalt" and 10 rounds.
+func TestKeyExportVector(t *testing.T) {
+	data := "-----BEGIN MEGOLM SESSION DATA-----\n" +
+		"AXNhbHRzYWx0c2FsdHNhbHSIiIiIiIiIiIiIiIiIiIiIAAAACmIRUW2OjZ3L2l6j9h0lHlV3M2dx\n" +
+		"cissyYBxjsfsAndErh065A8=\n" +
+		"-----END MEGOLM SESSION DATA-----"
+	plaintext, err := decryptKeyExport([]byte(data), "password")
+	if err != nil || string(plaintext) != "plain" {
+		t.Fatalf("decryptKeyExport() = %q, %v", plaintext, err)
+	}
+	if _, err := decryptKeyExport([]byte(data), "wrong"); err == nil || err.Error() != "BAD_MESSAGE_MAC" {
+		t.Fatal("Expected BAD_MESSAGE_MAC, got", err)
+	}
+}
+
+func TestKeyExportRounds(t *testing.T) {
+	raw := make([]byte, keyExportMinLen)
+	raw[0] = keyExportVersion
+	copy(raw[1+keyExportSaltLen+keyExportIVLen:], []byte{0xff, 0xff, 0xff, 0xff})
+	var data bytes.Buffer
+	data.WriteString(keyExportHeader + "\n")
+	data.WriteString(base64.StdEncoding.EncodeToString(raw) + "\n")
+	data.WriteString(keyExportFooter + "\n")
+	start := time.Now()
+	if _, err := ImportKeys(data.Bytes(), "passphrase"); err == nil || !strings.Contains(err.Error(), "rounds") {
+		t.Fatal("ImportKeys() should refuse too many rounds, got", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("ImportKeys() ran PBKDF2 before checking the rounds")
+	}
+	if _, err := ExportKeys(nil, "passphrase", MaxKeyExportRounds+1); err == nil {
+		t.Fatal("ExportKeys() should refuse too many rounds")
+	}
+}
@@ -0,0 +1,164 @@
+package olm
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// keyLen is the length in bytes of Ed25519 and Curve25519 public keys.
+const keyLen = 32
+
+// decodeKey decodes a public key in unpadded base64.  The encoding must be
+// canonical, so that two equal keys are always equal strings.  Returns error
+// "INVALID_BASE64" if the key isn't valid unpadded base64 or isn't 32 bytes.
+func decodeKey(key string) ([]byte, error) {
+	raw, err := base64.RawStdEncoding.Strict().DecodeString(key)
+	if err != nil || len(raw) != keyLen {
+		return nil, fmt.Errorf("INVALID_BASE64")
+	}
+	return raw, nil
+}
+
+// encodeKey encodes a 32 byte public key in unpadded base64.
+func encodeKey(raw []byte) (string, error) {
+	if len(raw) != keyLen {
+		return "", fmt.Errorf("Key must be %d bytes, got %d", keyLen, len(raw))
+	}
+	return base64.RawStdEncoding.EncodeToString(raw), nil
+}
+
+// unmarshalKey decodes a JSON string holding a public key.  The key isn't
+// validated, so that one invalid key doesn't make a whole response fail to
+// decode; it must be checked with Bytes where it is used.
+func unmarshalKey(data []byte) (string, error) {
+	var key string
+	err := json.Unmarshal(data, &key)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// fingerprint formats the key in groups of four characters for display.
+func fingerprint(key string) string {
+	var groups []string
+	for len(key) > 4 {
+		groups = append(groups, key[:4])
+		key = key[4:]
+	}
+	return strings.Join(append(groups, key), " ")
+}
+
+// NewEd25519 validates an Ed25519 public key in unpadded base64.  Returns
+// error "INVALID_BASE64" if the key isn't valid unpadded base64 or isn't 32
+// bytes.
+func NewEd25519(key string) (Ed25519, error) {
+	_, err := decodeKey(key)
+	if err != nil {
+		return "", err
+	}
+	return Ed25519(key), nil
+}
+
+// Ed25519FromBytes encodes a 32 byte Ed25519 public key.  Returns error if the
+// key isn't 32 bytes.
+func Ed25519FromBytes(raw []byte) (Ed25519, error) {
+	key, err := encodeKey(raw)
+	return Ed25519(key), err
+}
+
+// Bytes returns the raw Ed25519 public key.  Returns error "INVALID_BASE64"
+// if the key isn't valid.
+func (k Ed25519) Bytes() ([]byte, error) {
+	return decodeKey(string(k))
+}
+
+// Fingerprint returns the key in groups of four characters for display.
+func (k Ed25519) Fingerprint() string {
+	return fingerprint(string(k))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (k Ed25519) MarshalText() ([]byte, error) {
+	return []byte(k), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.  The key isn't
+// validated.
+func (k *Ed25519) UnmarshalText(text []byte) error {
+	*k = Ed25519(text)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (k Ed25519) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(k))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.  The key isn't validated.
+func (k *Ed25519) UnmarshalJSON(data []byte) error {
+	key, err := unmarshalKey(data)
+	if err != nil {
+		return err
+	}
+	*k = Ed25519(key)
+	return nil
+}
+
+// NewCurve25519 validates a Curve25519 public key in unpadded base64.
+// Returns error "INVALID_BASE64" if the key isn't valid unpadded base64 or
+// isn't 32 bytes.
+func NewCurve25519(key string) (Curve25519, error) {
+	_, err := decodeKey(key)
+	if err != nil {
+		return "", err
+	}
+	return Curve25519(key), nil
+}
+
+// Curve25519FromBytes encodes a 32 byte Curve25519 public key.  Returns error
+// if the key isn't 32 bytes.
+func Curve25519FromBytes(raw []byte) (Curve25519, error) {
+	key, err := encodeKey(raw)
+	return Curve25519(key), err
+}
+
+// Bytes returns the raw Curve25519 public key.  Returns error
+// "INVALID_BASE64" if the key isn't valid.
+func (k Curve25519) Bytes() ([]byte, error) {
+	return decodeKey(string(k))
+}
+
+// Fingerprint returns the key in groups of four characters for display.
+func (k Curve25519) Fingerprint() string {
+	return fingerprint(string(k))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (k Curve25519) MarshalText() ([]byte, error) {
+	return []byte(k), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.  The key isn't
+// validated.
+func (k *Curve25519) UnmarshalText(text []byte) error {
+	*k = Curve25519(text)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (k Curve25519) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(k))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.  The key isn't validated.
+func (k *Curve25519) UnmarshalJSON(data []byte) error {
+	key, err := unmarshalKey(data)
+	if err != nil {
+		return err
+	}
+	*k = Curve25519(key)
+	return nil
+}
@@ -0,0 +1,100 @@
+package olm
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestKeys(t *testing.T) {
+	raw := make([]byte, 32)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+	const encoded = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8"
+
+	ed, err := Ed25519FromBytes(raw)
+	if err != nil || ed != encoded {
+		t.Fatal("Ed25519FromBytes() =", ed, err)
+	}
+	curve, err := Curve25519FromBytes(raw)
+	if err != nil || curve != encoded {
+		t.Fatal("Curve25519FromBytes() =", curve, err)
+	}
+	if _, err := Curve25519FromBytes(raw[:31]); err == nil {
+		t.Fatal("Curve25519FromBytes() should reject short keys")
+	}
+	decoded, err := curve.Bytes()
+	if err != nil || !bytes.Equal(decoded, raw) {
+		t.Fatal("Bytes() =", decoded, err)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+		"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh",
+		"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh9",
+		"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8AAAA",
+		"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwd-_8",
+	} {
+		if _, err := NewEd25519(invalid); err == nil || err.Error() != "INVALID_BASE64" {
+			t.Fatalf("NewEd25519(%q) should fail with INVALID_BASE64, got %v", invalid, err)
+		}
+		if _, err := NewCurve25519(invalid); err == nil || err.Error() != "INVALID_BASE64" {
+			t.Fatalf("NewCurve25519(%q) should fail with INVALID_BASE64, got %v", invalid, err)
+		}
+	}
+
+	if fp := ed.Fingerprint(); fp != "AAEC AwQF BgcI CQoL DA0O DxAR EhMU FRYX GBka Gxwd Hh8" {
+		t.Fatal("Fingerprint() =", fp)
+	}
+}
+
+func TestKeysJSON(t *testing.T) {
+	const encoded = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8"
+	type keys struct {
+		Ed25519    Ed25519                `json:"ed25519"`
+		Curve25519 Curve25519             `json:"curve25519"`
+		ByKey      map[Curve25519]Ed25519 `json:"by_key"`
+		Empty      Curve25519             `json:"empty"`
+	}
+	in := keys{
+		Ed25519:    encoded,
+		Curve25519: encoded,
+		ByKey:      map[Curve25519]Ed25519{encoded: encoded},
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out keys
+	err = json.Unmarshal(data, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Ed25519 != encoded || out.Curve25519 != encoded || out.ByKey[encoded] != encoded || out.Empty != "" {
+		t.Fatal("JSON round trip failed", string(data))
+	}
+
+	// Keys are validated where they are used, not while decoding
+	out = keys{}
+	err = json.Unmarshal([]byte(`{"ed25519": "AAAA", "curve25519": "not base64!", "by_key": {"AAAA": "AAAA"}}`), &out)
+	if err != nil || out.Ed25519 != "AAAA" || out.Curve25519 != "not base64!" || out.ByKey["AAAA"] != "AAAA" {
+		t.Fatal("Unmarshal() should decode invalid keys as-is", out, err)
+	}
+	if _, err := out.Curve25519.Bytes(); err == nil {
+		t.Fatal("Bytes() should fail for an invalid key")
+	}
+	if err := json.Unmarshal([]byte(`{"ed25519": 1}`), &out); err == nil {
+		t.Fatal("Unmarshal() should fail for a key that isn't a string")
+	}
+
+	text, err := Curve25519(encoded).MarshalText()
+	if err != nil || string(text) != encoded {
+		t.Fatal("MarshalText() =", string(text), err)
+	}
+	var curve Curve25519
+	if err := curve.UnmarshalText([]byte("AAAA")); err != nil || curve != "AAAA" {
+		t.Fatal("UnmarshalText() =", curve, err)
+	}
+}
@@ -0,0 +1,116 @@
+package olm
+
+// The format of Olm and Megolm messages.  The pure Go backend encodes and
+// decodes them, GroupDecryptor reads the index of Megolm messages with both
+// backends.
+
+// olmProtocolVersion is the version of the Olm and Megolm messages.
+const olmProtocolVersion = 3
+
+// Lengths of the keys, MACs and signatures in bytes.
+const (
+	curve25519KeyLen = 32
+	ed25519KeyLen    = 32
+	ed25519SigLen    = 64
+	olmMACLen        = 8
+)
+
+// Tags of the fields of Olm and Megolm messages.  The messages are encoded
+// like protocol buffers, after a version byte.
+const (
+	ratchetKeyTag        = 0x0A
+	counterTag           = 0x10
+	ciphertextTag        = 0x22
+	oneTimeKeyTag        = 0x0A
+	baseKeyTag           = 0x12
+	identityKeyTag       = 0x1A
+	messageTag           = 0x22
+	groupMessageIndexTag = 0x08
+	groupCiphertextTag   = 0x12
+)
+
+// skipVarint returns the length of the varint at the start of b.  An
+// unterminated varint runs to the end of b.
+func skipVarint(b []byte) int {
+	for i, c := range b {
+		if c&0x80 == 0 {
+			return i + 1
+		}
+	}
+	return len(b)
+}
+
+// decodeVarint decodes a varint, truncating it to 32 bits as libolm does.
+func decodeVarint(b []byte) uint32 {
+	var n uint32
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<7 | uint32(b[i]&0x7F)
+	}
+	return n
+}
+
+// messageField is a field of a decoded message.
+type messageField struct {
+	tag    byte
+	varint uint32
+	bytes  []byte
+}
+
+// decodeFields decodes the fields of a message after its version byte, as
+// libolm does: a length-delimited field running past the end stops the
+// decoding, and unknown fields are skipped.
+func decodeFields(b []byte) []messageField {
+	var fields []messageField
+	for len(b) > 0 {
+		tag := b[0]
+		n := skipVarint(b)
+		b = b[n:]
+		switch tag & 0x7 {
+		case 0:
+			n = skipVarint(b)
+			fields = append(fields, messageField{tag: tag, varint: decodeVarint(b[:n])})
+			b = b[n:]
+		case 2:
+			n = skipVarint(b)
+			length := uint64(decodeVarint(b[:n]))
+			b = b[n:]
+			if n > 5 || length > uint64(len(b)) {
+				return fields
+			}
+			fields = append(fields, messageField{tag: tag, bytes: b[:length]})
+			b = b[length:]
+		default:
+			return fields
+		}
+	}
+	return fields
+}
+
+// groupMessage is a Megolm message.
+type groupMessage struct {
+	version         byte
+	messageIndex    uint32
+	hasMessageIndex bool
+	ciphertext      []byte
+}
+
+// decodeGroupMessage decodes a group message ending with its MAC and
+// signature.
+func decodeGroupMessage(b []byte) *groupMessage {
+	m := &groupMessage{}
+	if len(b) <= olmMACLen+ed25519SigLen {
+		return m
+	}
+	b = b[:len(b)-olmMACLen-ed25519SigLen]
+	m.version = b[0]
+	for _, f := range decodeFields(b[1:]) {
+		switch f.tag {
+		case groupMessageIndexTag:
+			m.messageIndex = f.varint
+			m.hasMessageIndex = true
+		case groupCiphertextTag:
+			m.ciphertext = f.bytes
+		}
+	}
+	return m
+}
@@ -1,3 +1,6 @@
+//go:build !goolm
+// +build !goolm
+
 package olm
 
 // #cgo LDFLAGS: -lolm -lstdc++ -L${SRCDIR}/olm/build/
@@ -12,22 +15,11 @@ import (
 	crand "crypto/rand"
 	"encoding/json"
 	"fmt"
-	"github.com/fatih/structs"
 	"unsafe"
 )
 
-// Signatures is the data structure used to sign JSON objects.  It maps from
-// userID to a map from <algorithm:deviceID> to signature.
-type Signatures map[string]map[string]string
-
-// SessionID is the identifier of an Olm/Megolm session
-type SessionID string
-
-// Ed25519 is the base64 representation of an Ed25519 public key
-type Ed25519 string
-
-// Curve25519 is the base64 representation of an Curve25519 public key
-type Curve25519 string
+// backend is the name of the implementation of the package.
+const backend = "libolm"
 
 // Version returns the version number of the olm library.
 func Version() (major, minor, patch uint8) {
@@ -171,9 +163,7 @@ func (s *Session) HasReceivedMessage() bool {
 // before this Account sends a message in reply.  Returns true if the session
 // matches.  Returns false if the session does not match.  Returns error on
 // failure.  If the base64 couldn't be decoded then the error will be
-// "INVALID_BASE64".  If the message was for an unsupported protocol version
-// then the error will be "BAD_MESSAGE_VERSION".  If the message couldn't be
-// decoded then then the error will be "BAD_MESSAGE_FORMAT".
+// "INVALID_BASE64".  A message that couldn't be decoded doesn't match.
 func (s *Session) MatchesInboundSession(oneTimeKeyMsg string) (bool, error) {
 	if len(oneTimeKeyMsg) == 0 {
 		return false, fmt.Errorf("Empty input")
@@ -196,9 +186,7 @@ func (s *Session) MatchesInboundSession(oneTimeKeyMsg string) (bool, error) {
 // before this Account sends a message in reply.  Returns true if the session
 // matches.  Returns false if the session does not match.  Returns error on
 // failure.  If the base64 couldn't be decoded then the error will be
-// "INVALID_BASE64".  If the message was for an unsupported protocol version
-// then the error will be "BAD_MESSAGE_VERSION".  If the message couldn't be
-// decoded then then the error will be "BAD_MESSAGE_FORMAT".
+// "INVALID_BASE64".  A message that couldn't be decoded doesn't match.
 func (s *Session) MatchesInboundSessionFrom(theirIdentityKey, oneTimeKeyMsg string) (bool, error) {
 	if len(theirIdentityKey) == 0 || len(oneTimeKeyMsg) == 0 {
 		return false, fmt.Errorf("Empty input")
@@ -218,22 +206,6 @@ func (s *Session) MatchesInboundSessionFrom(theirIdentityKey, oneTimeKeyMsg stri
 	}
 }
 
-type Algorithm string
-
-const (
-	AlgorithmNone     Algorithm = ""
-	AlgorithmOlmV1    Algorithm = "m.olm.v1.curve25519-aes-sha2"
-	AlgorithmMegolmV1 Algorithm = "m.megolm.v1.aes-sha2"
-)
-
-type MsgType uint
-
-// cgo doesn't handle static const
-const (
-	MsgTypePreKey MsgType = 0
-	MsgTypeMsg    MsgType = 1
-)
-
 // EncryptMsgType returns the type of the next message that Encrypt will
 // return.  Returns MsgTypePreKey if the message will be a PRE_KEY message.
 // Returns MsgTypeMsg if the message will be a normal message.  Returns error
@@ -311,7 +283,7 @@ func (s *Session) Decrypt(message string, msgType MsgType) (string, error) {
 // SessionFromPickled loads a Session from a pickled base64 string.  Decrypts
 // the Session using the supplied key.  Returns error on failure.  If the key
 // doesn't match the one used to encrypt the Session then the error will be
-// "BAD_SESSION_KEY".  If the base64 couldn't be decoded then the error will be
+// "BAD_ACCOUNT_KEY".  If the base64 couldn't be decoded then the error will be
 // "INVALID_BASE64".
 func SessionFromPickled(pickled string, key []byte) (*Session, error) {
 	if len(pickled) == 0 {
@@ -488,18 +460,6 @@ func (a *Account) IdentityKeysJSON() string {
 	}
 }
 
-// IdentityKeys returns the public parts of the Ed25519 and Curve25519 identity
-// keys for the Account.
-func (a *Account) IdentityKeys() (Ed25519, Curve25519) {
-	identityKeysJSON := a.IdentityKeysJSON()
-	identityKeys := map[string]string{}
-	err := json.Unmarshal([]byte(identityKeysJSON), &identityKeys)
-	if err != nil {
-		panic(err)
-	}
-	return Ed25519(identityKeys["ed25519"]), Curve25519(identityKeys["curve25519"])
-}
-
 // Sign returns the signature of a message using the ed25519 key for this
 // Account.
 func (a *Account) Sign(message string) string {
@@ -520,49 +480,6 @@ func (a *Account) Sign(message string) string {
 	}
 }
 
-// SignJSON signs the JSON object _obj following the Matrix specification:
-// https://matrix.org/speculator/spec/drafts%2Fe2e/appendices.html#signing-json
-// If the _obj is a struct, the `json` tags will be honored.
-func (a *Account) SignJSON(_obj interface{}, userID, deviceID string) (interface{}, error) {
-	s := structs.New(_obj)
-	s.TagName = "json"
-	obj := s.Map()
-	_signatures, ok := obj["signatures"]
-	if ok {
-		delete(obj, "signatures")
-	}
-	signatures, ok := _signatures.(Signatures)
-	if !ok {
-		return nil, fmt.Errorf("signatures key of JSON object is an invalid type")
-	}
-	if signatures == nil {
-		signatures = make(map[string]map[string]string)
-	}
-	unsigned, ok := obj["unsigned"]
-	if ok {
-		delete(obj, "unsigned")
-	}
-	objJSON, err := json.Marshal(obj)
-	if err != nil {
-		return nil, err
-	}
-	//fmt.Printf("\n\n%v\n\n", obj)
-	//fmt.Printf("\n\n%v\n\n", string(objJSON))
-	signature := a.Sign(string(objJSON))
-	algorithmDeviceID := fmt.Sprintf("ed25519:%s", deviceID)
-	signatures[userID] = map[string]string{algorithmDeviceID: signature}
-	obj["signatures"] = signatures
-	if unsigned != nil {
-		obj["unsigned"] = unsigned
-	}
-
-	return obj, nil
-}
-
-type OTKs struct {
-	Curve25519 map[string]Curve25519 `json:"curve25519"`
-}
-
 // OneTimeKeys returns the public parts of the unpublished one time keys for
 // the Account.
 //
@@ -800,50 +717,6 @@ func (u *Utility) VerifySignature(message string, key Ed25519, signature string)
 	}
 }
 
-// VerifySignatureJSON verifies the signature in the JSON object _obj following
-// the Matrix specification:
-// https://matrix.org/speculator/spec/drafts%2Fe2e/appendices.html#signing-json
-// If the _obj is a struct, the `json` tags will be honored.
-func (u *Utility) VerifySignatureJSON(_obj interface{}, userID, deviceID string, key Ed25519) (bool, error) {
-	s := structs.New(_obj)
-	s.TagName = "json"
-	obj := s.Map()
-	_signatures, ok := obj["signatures"]
-	if !ok {
-		return false, fmt.Errorf("JSON object doesn't contain signatures key")
-	}
-	signatures, ok := _signatures.(map[string]map[string]string)
-	if !ok {
-		return false, fmt.Errorf("signatures key of JSON object is an invalid type")
-	}
-	signatureDevices, ok := signatures[userID]
-	if !ok {
-		return false, fmt.Errorf("JSON object isn't signed by user %s", userID)
-	}
-	signature, ok := signatureDevices[fmt.Sprintf("ed25519:%s", deviceID)]
-	if !ok {
-		return false, fmt.Errorf("JSON object isn't signed by user's device %s", deviceID)
-	}
-	delete(obj, "unsigned")
-	objJSON, err := json.Marshal(obj)
-	if err != nil {
-		return false, err
-	}
-	return u.VerifySignature(string(objJSON), key, signature)
-}
-
-// VerifySignatureJSON verifies the signature in the JSON object _obj following
-// the Matrix specification:
-// https://matrix.org/speculator/spec/drafts%2Fe2e/appendices.html#signing-json
-// This function is a wrapper over Utility.VerifySignatureJSON that creates and
-// destroys the Utility object transparently.
-// If the _obj is a struct, the `json` tags will be honored.
-func VerifySignatureJSON(_obj interface{}, userID, deviceID string, key Ed25519) (bool, error) {
-	u := NewUtility()
-	defer u.Clear()
-	return u.VerifySignatureJSON(_obj, userID, deviceID, key)
-}
-
 // OutboundGroupSession stores an outbound encrypted messaging session for a
 // group.
 type OutboundGroupSession C.OlmOutboundGroupSession
@@ -907,7 +780,7 @@ func (s *OutboundGroupSession) Pickle(key []byte) string {
 // OutboundGroupSessionFromPickled loads an OutboundGroupSession from a pickled
 // base64 string.  Decrypts the OutboundGroupSession using the supplied key.
 // Returns error on failure.  If the key doesn't match the one used to encrypt
-// the OutboundGroupSession then the error will be "BAD_SESSION_KEY".  If the
+// the OutboundGroupSession then the error will be "BAD_ACCOUNT_KEY".  If the
 // base64 couldn't be decoded then the error will be "INVALID_BASE64".
 func OutboundGroupSessionFromPickled(pickled string, key []byte) (*OutboundGroupSession, error) {
 	if len(pickled) == 0 {
@@ -982,6 +855,22 @@ func (s *OutboundGroupSession) Encrypt(plaintext string) string {
 	}
 }
 
+// encryptInto encrypts the plain-text into message, which must be at least
+// encryptMsgLen(len(plaintext)) bytes long.  Returns the number of bytes
+// written.  Returns error on failure.
+func (s *OutboundGroupSession) encryptInto(plaintext, message []byte) (uint, error) {
+	r := C.olm_group_encrypt(
+		(*C.OlmOutboundGroupSession)(s),
+		(*C.uint8_t)(&plaintext[0]),
+		C.size_t(len(plaintext)),
+		(*C.uint8_t)(&message[0]),
+		C.size_t(len(message)))
+	if r == errorVal() {
+		return 0, s.lastError()
+	}
+	return uint(r), nil
+}
+
 // sessionIdLen returns the number of bytes needed to store a session ID.
 func (s *OutboundGroupSession) sessionIdLen() uint {
 	return uint(C.olm_outbound_group_session_id_length((*C.OlmOutboundGroupSession)(s)))
@@ -1089,7 +978,7 @@ func (s *InboundGroupSession) Pickle(key []byte) string {
 // InboundGroupSessionFromPickled loads an InboundGroupSession from a pickled
 // base64 string.  Decrypts the InboundGroupSession using the supplied key.
 // Returns error on failure.  If the key doesn't match the one used to encrypt
-// the InboundGroupSession then the error will be "BAD_SESSION_KEY".  If the
+// the InboundGroupSession then the error will be "BAD_ACCOUNT_KEY".  If the
 // base64 couldn't be decoded then the error will be "INVALID_BASE64".
 func InboundGroupSessionFromPickled(pickled string, key []byte) (*InboundGroupSession, error) {
 	if len(pickled) == 0 {
@@ -1116,8 +1005,8 @@ func InboundGroupSessionFromPickled(pickled string, key []byte) (*InboundGroupSe
 // NewInboundGroupSession creates a new inbound group session from a key
 // exported from OutboundGroupSession.SessionKey().  Returns error on failure.
 // If the sessionKey is not valid base64 the error will be
-// "OLM_INVALID_BASE64".  If the session_key is invalid the error will be
-// "OLM_BAD_SESSION_KEY".
+// "INVALID_BASE64".  If the session_key is invalid the error will be
+// "BAD_SESSION_KEY".
 func NewInboundGroupSession(sessionKey []byte) (*InboundGroupSession, error) {
 	if len(sessionKey) == 0 {
 		sessionKey = []byte(" ")
@@ -1136,8 +1025,8 @@ func NewInboundGroupSession(sessionKey []byte) (*InboundGroupSession, error) {
 
 // InboundGroupSessionImport imports an inbound group session from a previous
 // export.  Returns error on failure.  If the sessionKey is not valid base64
-// the error will be "OLM_INVALID_BASE64".  If the session_key is invalid the
-// error will be "OLM_BAD_SESSION_KEY".
+// the error will be "INVALID_BASE64".  If the session_key is invalid the
+// error will be "BAD_SESSION_KEY".
 func InboundGroupSessionImport(sessionKey []byte) (*InboundGroupSession, error) {
 	if len(sessionKey) == 0 {
 		sessionKey = []byte(" ")
@@ -1184,7 +1073,7 @@ func (s *InboundGroupSession) decryptMaxPlaintextLen(message string) (uint, erro
 // will be BAD_MESSAGE_FORMAT".  If the MAC on the message was invalid then the
 // error will be "BAD_MESSAGE_MAC".  If we do not have a session key
 // corresponding to the message's index (ie, it was sent before the session key
-// was shared with us) the error will be "OLM_UNKNOWN_MESSAGE_INDEX".
+// was shared with us) the error will be "UNKNOWN_MESSAGE_INDEX".
 func (s *InboundGroupSession) Decrypt(message string) (string, uint32, error) {
 	if len(message) == 0 {
 		return "", 0, fmt.Errorf("Empty input")
@@ -1252,7 +1141,7 @@ func (s *InboundGroupSession) exportLen() uint {
 // InboundGroupSession using the supplied key.  Returns error on failure.
 // if we do not have a session key corresponding to the given index (ie, it was
 // sent before the session key was shared with us) the error will be
-// "OLM_UNKNOWN_MESSAGE_INDEX".
+// "UNKNOWN_MESSAGE_INDEX".
 func (s *InboundGroupSession) Export(messageIndex uint32) (string, error) {
 	key := make([]byte, s.exportLen())
 	r := C.olm_export_inbound_group_session(
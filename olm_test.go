@@ -1,6 +1,10 @@
 package olm
 
-import "testing"
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
 
 //import (
 //	"encoding/json"
@@ -142,6 +146,35 @@ func TestSession(t *testing.T) {
 	}
 }
 
+// TestSessionSkippedMessageKeys checks that the keys of skipped messages are
+// kept as libolm does: up to 40 of them, the last one being overwritten once
+// the list is full.
+func TestSessionSkippedMessageKeys(t *testing.T) {
+	outbound, first, inbound := testSessions(t, NewAccount(), NewAccount())
+	if _, err := inbound.Decrypt(first, MsgTypePreKey); err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for i := 1; i <= 45; i++ {
+		_, message := outbound.Encrypt(fmt.Sprint(i))
+		messages = append(messages, message)
+	}
+	// Skips the messages 1 to 44.
+	if plaintext, err := inbound.Decrypt(messages[44], MsgTypePreKey); err != nil || plaintext != "45" {
+		t.Fatal("Decrypt() failed", plaintext, err)
+	}
+	for i := 1; i <= 44; i++ {
+		plaintext, err := inbound.Decrypt(messages[i-1], MsgTypePreKey)
+		if i < 40 || i == 44 {
+			if err != nil || plaintext != fmt.Sprint(i) {
+				t.Fatal("Decrypt() failed for skipped message", i, plaintext, err)
+			}
+		} else if err == nil || err.Error() != "BAD_MESSAGE_MAC" {
+			t.Fatal("Expected BAD_MESSAGE_MAC for overwritten message", i, "got", err)
+		}
+	}
+}
+
 func TestUtility(t *testing.T) {
 	u := NewUtility()
 
@@ -161,7 +194,7 @@ func TestUtility(t *testing.T) {
 		t.Fatal(err)
 	}
 	if !ok {
-		t.Log("Signature verification shouldn't have failed")
+		t.Fatal("Signature verification shouldn't have failed")
 	}
 
 	// Verify an incorrect signed message
@@ -171,6 +204,543 @@ func TestUtility(t *testing.T) {
 		t.Fatal(err)
 	}
 	if ok {
-		t.Log("Signature verification should have failed")
+		t.Fatal("Signature verification should have failed")
+	}
+}
+
+// errorTest is an error case of a function: run must return an error with the
+// message expected.
+type errorTest struct {
+	name     string
+	run      func() error
+	expected string
+}
+
+func runErrorTests(t *testing.T, tests []errorTest) {
+	for _, test := range tests {
+		err := test.run()
+		if err == nil {
+			t.Errorf("%s: expected %q, got no error", test.name, test.expected)
+		} else if err.Error() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, err)
+		}
+	}
+}
+
+// testMessage returns a message in base64 of the protocol version followed by
+// n zero bytes.
+func testMessage(version byte, n int) string {
+	return base64.RawStdEncoding.EncodeToString(append([]byte{version}, make([]byte, n)...))
+}
+
+// testCiphertextMessage returns a normal message in base64 of the protocol
+// version with only a one byte ciphertext, followed by a zero MAC.
+func testCiphertextMessage(version byte) string {
+	return base64.RawStdEncoding.EncodeToString(append([]byte{version, 0x22, 1, 0}, make([]byte, 8)...))
+}
+
+// tamper returns the base64 message with its last byte flipped.
+func tamper(t *testing.T, message string) string {
+	raw, err := base64.RawStdEncoding.DecodeString(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 1
+	return base64.RawStdEncoding.EncodeToString(raw)
+}
+
+// testSessions returns an out-bound Session from alice to bob, with the first
+// PRE_KEY message, and the in-bound Session of bob for it.
+func testSessions(t testing.TB, alice, bob *Account) (*Session, string, *Session) {
+	bob.GenOneTimeKeys(1)
+	var otk Curve25519
+	for _, otk = range bob.OneTimeKeys().Curve25519 {
+	}
+	bob.MarkKeysAsPublished()
+	_, bobKey := bob.IdentityKeys()
+	outbound, err := alice.NewOutboundSession(bobKey, otk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, message := outbound.Encrypt("first")
+	inbound, err := bob.NewInboundSession(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outbound, message, inbound
+}
+
+func TestAccountKeys(t *testing.T) {
+	a := NewAccount()
+	if a.MaxNumberOfOneTimeKeys() != 100 {
+		t.Fatal("Wrong MaxNumberOfOneTimeKeys()", a.MaxNumberOfOneTimeKeys())
+	}
+	if len(a.OneTimeKeys().Curve25519) != 0 {
+		t.Fatal("New Account has one time keys")
+	}
+	for _, test := range []struct {
+		generate, expected uint
+	}{{0, 0}, {3, 3}, {5, 8}, {200, 100}} {
+		a.GenOneTimeKeys(test.generate)
+		if n := uint(len(a.OneTimeKeys().Curve25519)); n != test.expected {
+			t.Fatalf("GenOneTimeKeys(%d): expected %d keys, got %d", test.generate, test.expected, n)
+		}
+	}
+	a.MarkKeysAsPublished()
+	if len(a.OneTimeKeys().Curve25519) != 0 {
+		t.Fatal("MarkKeysAsPublished() didn't publish the keys")
+	}
+
+	ed25519Key, curve25519Key := a.IdentityKeys()
+	if len(ed25519Key) != 43 || len(curve25519Key) != 43 {
+		t.Fatal("Wrong identity keys", ed25519Key, curve25519Key)
+	}
+	u := NewUtility()
+	signature := a.Sign("message")
+	if signature != a.Sign("message") {
+		t.Fatal("Ed25519 signatures should be deterministic")
+	}
+	if ok, err := u.VerifySignature("message", ed25519Key, signature); !ok || err != nil {
+		t.Fatal("Sign() signature doesn't verify", err)
+	}
+	if a.Clear() != nil || u.Clear() != nil {
+		t.Fatal("Clear() failed")
+	}
+}
+
+func TestPickleErrors(t *testing.T) {
+	key := []byte("key")
+	a := NewAccount()
+	s, _, _ := testSessions(t, NewAccount(), a)
+	outbound := NewOutboundGroupSession()
+	inbound, err := NewInboundGroupSession([]byte(outbound.SessionKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaders := []struct {
+		name       string
+		pickled    string
+		fromPickle func(pickled string, key []byte) (interface{ Pickle([]byte) string }, error)
+	}{
+		{"Account", a.Pickle(key), func(p string, k []byte) (interface{ Pickle([]byte) string }, error) {
+			return AccountFromPickled(p, k)
+		}},
+		{"Session", s.Pickle(key), func(p string, k []byte) (interface{ Pickle([]byte) string }, error) {
+			return SessionFromPickled(p, k)
+		}},
+		{"OutboundGroupSession", outbound.Pickle(key), func(p string, k []byte) (interface{ Pickle([]byte) string }, error) {
+			return OutboundGroupSessionFromPickled(p, k)
+		}},
+		{"InboundGroupSession", inbound.Pickle(key), func(p string, k []byte) (interface{ Pickle([]byte) string }, error) {
+			return InboundGroupSessionFromPickled(p, k)
+		}},
+	}
+	for _, l := range loaders {
+		l := l
+		loaded, err := l.fromPickle(l.pickled, key)
+		if err != nil {
+			t.Fatal(l.name, err)
+		}
+		if loaded.Pickle(key) != l.pickled {
+			t.Fatal(l.name, "pickle(unpickle(pickle)) != pickle")
+		}
+		otherType := a.Pickle(key)
+		expectedOtherType := "UNKNOWN_PICKLE_VERSION"
+		if l.name == "Account" {
+			otherType = s.Pickle(key)
+			expectedOtherType = "BAD_LEGACY_ACCOUNT_PICKLE"
+		}
+		runErrorTests(t, []errorTest{
+			{l.name + " empty", func() error {
+				_, err := l.fromPickle("", key)
+				return err
+			}, "Empty input"},
+			{l.name + " wrong key", func() error {
+				_, err := l.fromPickle(l.pickled, []byte("wrong key"))
+				return err
+			}, "BAD_ACCOUNT_KEY"},
+			{l.name + " invalid base64", func() error {
+				_, err := l.fromPickle("AAAAA", key)
+				return err
+			}, "INVALID_BASE64"},
+			{l.name + " other type", func() error {
+				_, err := l.fromPickle(otherType, key)
+				return err
+			}, expectedOtherType},
+		})
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	alice := NewAccount()
+	bob := NewAccount()
+	outbound, first, inbound := testSessions(t, alice, bob)
+	_, aliceKey := alice.IdentityKeys()
+	_, otherMessage, _ := testSessions(t, NewAccount(), NewAccount())
+
+	if outbound.HasReceivedMessage() || outbound.EncryptMsgType() != MsgTypePreKey {
+		t.Fatal("Out-bound Session should send PRE_KEY messages")
+	}
+	_, bobKey := bob.IdentityKeys()
+	for _, test := range []struct {
+		message     string
+		from        Curve25519
+		matches     bool
+		matchesFrom bool
+		expectedErr string
+	}{
+		{first, aliceKey, true, true, ""},
+		{otherMessage, aliceKey, false, false, ""},
+		{first, bobKey, true, false, ""},
+		{"", aliceKey, false, false, "Empty input"},
+		{"AAAAA", aliceKey, false, false, "INVALID_BASE64"},
+		{testMessage(3, 0), aliceKey, false, false, ""},
+	} {
+		ok, err := inbound.MatchesInboundSession(test.message)
+		if ok != test.matches || errString(err) != test.expectedErr {
+			t.Errorf("MatchesInboundSession(%q): got %v %v", test.message, ok, err)
+		}
+		ok, err = inbound.MatchesInboundSessionFrom(string(test.from), test.message)
+		if ok != test.matchesFrom || errString(err) != test.expectedErr {
+			t.Errorf("MatchesInboundSessionFrom(%q, %q): got %v %v", test.from, test.message, ok, err)
+		}
+	}
+
+	if plaintext, err := inbound.Decrypt(first, MsgTypePreKey); err != nil || plaintext != "first" {
+		t.Fatal("Decrypt() failed", plaintext, err)
+	}
+	if !inbound.HasReceivedMessage() || inbound.EncryptMsgType() != MsgTypeMsg {
+		t.Fatal("In-bound Session should send normal messages")
+	}
+	msgType, message := outbound.Encrypt("second")
+	runErrorTests(t, []errorTest{
+		{"Decrypt() empty", func() error {
+			_, err := inbound.Decrypt("", MsgTypeMsg)
+			return err
+		}, "Empty input"},
+		{"Decrypt() invalid base64", func() error {
+			_, err := inbound.Decrypt("AAAAA", MsgTypeMsg)
+			return err
+		}, "INVALID_BASE64"},
+		{"Decrypt() missing ciphertext", func() error {
+			_, err := inbound.Decrypt(testMessage(2, 16), MsgTypeMsg)
+			return err
+		}, "BAD_MESSAGE_FORMAT"},
+		{"Decrypt() wrong version", func() error {
+			_, err := inbound.Decrypt(testCiphertextMessage(2), MsgTypeMsg)
+			return err
+		}, "BAD_MESSAGE_VERSION"},
+		{"Decrypt() missing fields", func() error {
+			_, err := inbound.Decrypt(testCiphertextMessage(3), MsgTypeMsg)
+			return err
+		}, "BAD_MESSAGE_FORMAT"},
+		{"Decrypt() missing PRE_KEY fields", func() error {
+			_, err := inbound.Decrypt(testMessage(3, 0), MsgTypePreKey)
+			return err
+		}, "BAD_MESSAGE_FORMAT"},
+		{"Decrypt() tampered", func() error {
+			_, err := inbound.Decrypt(tamper(t, message), msgType)
+			return err
+		}, "BAD_MESSAGE_MAC"},
+		{"Decrypt() replayed", func() error {
+			_, err := inbound.Decrypt(first, MsgTypePreKey)
+			return err
+		}, "BAD_MESSAGE_MAC"},
+	})
+	// A failed decryption doesn't change the Session.
+	if plaintext, err := inbound.Decrypt(message, msgType); err != nil || plaintext != "second" {
+		t.Fatal("Decrypt() failed", plaintext, err)
+	}
+}
+
+func TestAccountErrors(t *testing.T) {
+	alice := NewAccount()
+	bob := NewAccount()
+	_, message, inbound := testSessions(t, alice, bob)
+	_, bobKey := bob.IdentityKeys()
+	_, otherMessage, _ := testSessions(t, NewAccount(), NewAccount())
+	runErrorTests(t, []errorTest{
+		{"NewOutboundSession() empty", func() error {
+			_, err := alice.NewOutboundSession("", "")
+			return err
+		}, "Empty input"},
+		{"NewOutboundSession() short key", func() error {
+			_, err := alice.NewOutboundSession("AAAA", bobKey)
+			return err
+		}, "INVALID_BASE64"},
+		{"NewInboundSession() empty", func() error {
+			_, err := bob.NewInboundSession("")
+			return err
+		}, "Empty input"},
+		{"NewInboundSession() invalid base64", func() error {
+			_, err := bob.NewInboundSession("AAAAA")
+			return err
+		}, "INVALID_BASE64"},
+		{"NewInboundSession() missing fields", func() error {
+			_, err := bob.NewInboundSession(testMessage(3, 0))
+			return err
+		}, "BAD_MESSAGE_FORMAT"},
+		{"NewInboundSession() unknown one time key", func() error {
+			_, err := bob.NewInboundSession(otherMessage)
+			return err
+		}, "BAD_MESSAGE_KEY_ID"},
+		{"NewInboundSessionFrom() empty", func() error {
+			_, err := bob.NewInboundSessionFrom("", message)
+			return err
+		}, "Empty input"},
+		{"NewInboundSessionFrom() wrong identity key", func() error {
+			_, err := bob.NewInboundSessionFrom(bobKey, message)
+			return err
+		}, "BAD_MESSAGE_KEY_ID"},
+	})
+
+	if err := bob.RemoveOneTimeKeys(inbound); err != nil {
+		t.Fatal(err)
+	}
+	runErrorTests(t, []errorTest{
+		{"RemoveOneTimeKeys() twice", func() error {
+			return bob.RemoveOneTimeKeys(inbound)
+		}, "BAD_MESSAGE_KEY_ID"},
+		{"NewInboundSession() removed one time key", func() error {
+			_, err := bob.NewInboundSession(message)
+			return err
+		}, "BAD_MESSAGE_KEY_ID"},
+	})
+}
+
+func TestGroupSession(t *testing.T) {
+	outbound := NewOutboundGroupSession()
+	if outbound.MessageIndex() != 0 {
+		t.Fatal("Wrong MessageIndex()", outbound.MessageIndex())
+	}
+	sessionKey := outbound.SessionKey()
+	var messages []string
+	for i := 0; i < 5; i++ {
+		messages = append(messages, outbound.Encrypt(string(rune('a'+i))))
+	}
+	if outbound.MessageIndex() != 5 {
+		t.Fatal("Wrong MessageIndex()", outbound.MessageIndex())
+	}
+
+	inbound, err := NewInboundGroupSession([]byte(sessionKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inbound.ID() != outbound.ID() || inbound.FirstKnownIndex() != 0 || inbound.IsVerified() != 1 {
+		t.Fatal("Wrong InboundGroupSession", inbound.ID(), inbound.FirstKnownIndex(), inbound.IsVerified())
+	}
+	// Decrypt out of order, and twice.
+	for _, i := range []int{3, 0, 4, 1, 2, 3} {
+		plaintext, index, err := inbound.Decrypt(messages[i])
+		if err != nil || plaintext != string(rune('a'+i)) || index != uint32(i) {
+			t.Fatal("Decrypt() failed for message", i, plaintext, index, err)
+		}
+	}
+
+	export, err := inbound.Export(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := InboundGroupSessionImport([]byte(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.ID() != outbound.ID() || imported.FirstKnownIndex() != 2 || imported.IsVerified() != 0 {
+		t.Fatal("Wrong imported InboundGroupSession", imported.ID(), imported.FirstKnownIndex(), imported.IsVerified())
+	}
+	if plaintext, index, err := imported.Decrypt(messages[4]); err != nil || plaintext != "e" || index != 4 {
+		t.Fatal("Decrypt() failed", plaintext, index, err)
+	}
+	if imported.IsVerified() != 1 {
+		t.Fatal("Decrypt() didn't verify the imported session")
+	}
+	if reexport, err := imported.Export(2); err != nil || reexport != export {
+		t.Fatal("Export() of the imported session differs", err)
+	}
+	runErrorTests(t, []errorTest{
+		{"Decrypt() before the first known index", func() error {
+			_, _, err := imported.Decrypt(messages[1])
+			return err
+		}, "UNKNOWN_MESSAGE_INDEX"},
+		{"Export() before the first known index", func() error {
+			_, err := imported.Export(1)
+			return err
+		}, "UNKNOWN_MESSAGE_INDEX"},
+	})
+	if outbound.Clear() != nil || inbound.Clear() != nil || imported.Clear() != nil {
+		t.Fatal("Clear() failed")
+	}
+}
+
+func TestGroupSessionErrors(t *testing.T) {
+	outbound := NewOutboundGroupSession()
+	sessionKey := outbound.SessionKey()
+	message := outbound.Encrypt("message")
+	inbound, err := NewInboundGroupSession([]byte(sessionKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	export, err := inbound.Export(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runErrorTests(t, []errorTest{
+		{"NewInboundGroupSession() empty", func() error {
+			_, err := NewInboundGroupSession(nil)
+			return err
+		}, "INVALID_BASE64"},
+		{"NewInboundGroupSession() invalid base64", func() error {
+			_, err := NewInboundGroupSession([]byte("AAAAA"))
+			return err
+		}, "INVALID_BASE64"},
+		{"NewInboundGroupSession() short key", func() error {
+			_, err := NewInboundGroupSession([]byte("AAAA"))
+			return err
+		}, "BAD_SESSION_KEY"},
+		{"NewInboundGroupSession() export", func() error {
+			_, err := NewInboundGroupSession([]byte(export))
+			return err
+		}, "BAD_SESSION_KEY"},
+		{"NewInboundGroupSession() bad signature", func() error {
+			_, err := NewInboundGroupSession([]byte(tamper(t, sessionKey)))
+			return err
+		}, "BAD_SIGNATURE"},
+		{"InboundGroupSessionImport() empty", func() error {
+			_, err := InboundGroupSessionImport(nil)
+			return err
+		}, "INVALID_BASE64"},
+		{"InboundGroupSessionImport() invalid base64", func() error {
+			_, err := InboundGroupSessionImport([]byte("AAAAA"))
+			return err
+		}, "INVALID_BASE64"},
+		{"InboundGroupSessionImport() session key", func() error {
+			_, err := InboundGroupSessionImport([]byte(sessionKey))
+			return err
+		}, "BAD_SESSION_KEY"},
+		{"Decrypt() empty", func() error {
+			_, _, err := inbound.Decrypt("")
+			return err
+		}, "Empty input"},
+		{"Decrypt() invalid base64", func() error {
+			_, _, err := inbound.Decrypt("AAAAA")
+			return err
+		}, "INVALID_BASE64"},
+		{"Decrypt() wrong version", func() error {
+			_, _, err := inbound.Decrypt(testMessage(2, 80))
+			return err
+		}, "BAD_MESSAGE_VERSION"},
+		{"Decrypt() missing fields", func() error {
+			_, _, err := inbound.Decrypt(testMessage(3, 80))
+			return err
+		}, "BAD_MESSAGE_FORMAT"},
+		{"Decrypt() bad signature", func() error {
+			_, _, err := inbound.Decrypt(tamper(t, message))
+			return err
+		}, "BAD_SIGNATURE"},
+	})
+}
+
+// signedObject is a JSON object signed by TestSignJSON.
+type signedObject struct {
+	Name       string                 `json:"name"`
+	Unsigned   map[string]interface{} `json:"unsigned,omitempty"`
+	Signatures Signatures             `json:"signatures,omitempty"`
+}
+
+func TestSignJSON(t *testing.T) {
+	a := NewAccount()
+	ed25519Key, _ := a.IdentityKeys()
+	signed, err := a.SignJSON(signedObject{Name: "object", Unsigned: map[string]interface{}{"age": 1}}, "@alice:example.org", "DEVICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj signedObject
+	reparse(t, signed, &obj)
+	if obj.Unsigned["age"] == nil {
+		t.Fatal("SignJSON() dropped the unsigned key")
+	}
+	u := NewUtility()
+	for _, test := range []struct {
+		name             string
+		modify           func(o *signedObject)
+		userID, deviceID string
+		key              Ed25519
+		expected         bool
+		expectedErr      string
+	}{
+		{"signed", func(o *signedObject) {}, "@alice:example.org", "DEVICE", ed25519Key, true, ""},
+		{"unsigned changed", func(o *signedObject) { o.Unsigned = nil }, "@alice:example.org", "DEVICE", ed25519Key, true, ""},
+		{"changed", func(o *signedObject) { o.Name = "other" }, "@alice:example.org", "DEVICE", ed25519Key, false, ""},
+		{"wrong key", func(o *signedObject) {}, "@alice:example.org", "DEVICE", Ed25519(newEd25519Key()), false, ""},
+		{"short key", func(o *signedObject) {}, "@alice:example.org", "DEVICE", "AAAA", false, "INVALID_BASE64"},
+		{"other user", func(o *signedObject) {}, "@bob:example.org", "DEVICE", ed25519Key, false, "JSON object isn't signed by user @bob:example.org"},
+		{"other device", func(o *signedObject) {}, "@alice:example.org", "OTHER", ed25519Key, false, "JSON object isn't signed by user's device OTHER"},
+		{"no signatures", func(o *signedObject) { o.Signatures = nil }, "@alice:example.org", "DEVICE", ed25519Key, false, "JSON object doesn't contain signatures key"},
+	} {
+		o := obj
+		test.modify(&o)
+		ok, err := u.VerifySignatureJSON(o, test.userID, test.deviceID, test.key)
+		if ok != test.expected || errString(err) != test.expectedErr {
+			t.Errorf("%s: Utility.VerifySignatureJSON() got %v %v", test.name, ok, err)
+		}
+		ok, err = VerifySignatureJSON(o, test.userID, test.deviceID, test.key)
+		if ok != test.expected || errString(err) != test.expectedErr {
+			t.Errorf("%s: VerifySignatureJSON() got %v %v", test.name, ok, err)
+		}
+	}
+}
+
+func TestSignJSONKeepsSignatures(t *testing.T) {
+	a, b := NewAccount(), NewAccount()
+	aKey, _ := a.IdentityKeys()
+	bKey, _ := b.IdentityKeys()
+	signed, err := a.SignJSON(signedObject{Name: "object"}, "@alice:example.org", "ALICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err = b.SignJSON(signed, "@alice:example.org", "BOB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deviceID, key := range map[string]Ed25519{"ALICE": aKey, "BOB": bKey} {
+		ok, err := VerifySignatureJSON(signed, "@alice:example.org", deviceID, key)
+		if err != nil || !ok {
+			t.Errorf("VerifySignatureJSON() of %s got %v %v", deviceID, ok, err)
+		}
+	}
+}
+
+// newEd25519Key returns the Ed25519 identity key of a new Account.
+func newEd25519Key() Ed25519 {
+	key, _ := NewAccount().IdentityKeys()
+	return key
+}
+
+func TestUtilityErrors(t *testing.T) {
+	u := NewUtility()
+	a := NewAccount()
+	key, _ := a.IdentityKeys()
+	signature := a.Sign("message")
+	for _, test := range []struct {
+		name               string
+		message, signature string
+		key                Ed25519
+		expected           bool
+		expectedErr        string
+	}{
+		{"valid", "message", signature, key, true, ""},
+		{"other message", "other", signature, key, false, ""},
+		{"other key", "message", signature, newEd25519Key(), false, ""},
+		{"tampered", "message", tamper(t, signature), key, false, ""},
+		{"empty", "", signature, key, false, "Empty input"},
+		{"short key", "message", signature, "AAAA", false, "INVALID_BASE64"},
+	} {
+		ok, err := u.VerifySignature(test.message, test.key, test.signature)
+		if ok != test.expected || errString(err) != test.expectedErr {
+			t.Errorf("%s: VerifySignature() got %v %v", test.name, ok, err)
+		}
+	}
+	if u.Sha256("") != u.Sha256(" ") {
+		t.Fatal("Sha256() of empty input should hash a space")
 	}
 }
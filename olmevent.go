@@ -0,0 +1,87 @@
+package olm
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// OlmPayload is the plain-text of an Olm encrypted to-device event.
+type OlmPayload struct {
+	Type          string             `json:"type"`
+	Content       interface{}        `json:"content"`
+	Sender        string             `json:"sender"`
+	SenderDevice  string             `json:"sender_device,omitempty"`
+	Recipient     string             `json:"recipient"`
+	RecipientKeys map[string]Ed25519 `json:"recipient_keys"`
+	Keys          map[string]Ed25519 `json:"keys"`
+}
+
+// OlmCiphertext is the cipher-text of an Olm encrypted event for one
+// recipient device.
+type OlmCiphertext struct {
+	Type MsgType `json:"type"`
+	Body string  `json:"body"`
+}
+
+// OlmEncryptedContent is the content of an m.room.encrypted to-device event
+// using AlgorithmOlmV1.  The cipher-text maps from the Curve25519 key of the
+// recipient device to the message for that device.
+type OlmEncryptedContent struct {
+	Algorithm  Algorithm                    `json:"algorithm"`
+	SenderKey  Curve25519                   `json:"sender_key"`
+	Ciphertext map[Curve25519]OlmCiphertext `json:"ciphertext"`
+}
+
+// EncryptOlmEvent encrypts an event of type eventType with the Session to the
+// device, and returns the content of the m.room.encrypted to-device event.
+// userID and deviceID identify our own device and a is its Account.  Returns
+// error on failure.
+func EncryptOlmEvent(a *Account, s *Session, userID, deviceID string, device *Device, eventType string, content interface{}) (*OlmEncryptedContent, error) {
+	ourEd25519, ourCurve25519 := a.IdentityKeys()
+	payload, err := json.Marshal(OlmPayload{
+		Type:          eventType,
+		Content:       content,
+		Sender:        userID,
+		SenderDevice:  deviceID,
+		Recipient:     device.UserID,
+		RecipientKeys: map[string]Ed25519{"ed25519": device.Ed25519},
+		Keys:          map[string]Ed25519{"ed25519": ourEd25519},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgType, ciphertext := s.Encrypt(string(payload))
+	return &OlmEncryptedContent{
+		Algorithm:  AlgorithmOlmV1,
+		SenderKey:  ourCurve25519,
+		Ciphertext: map[Curve25519]OlmCiphertext{device.Curve25519: {Type: msgType, Body: ciphertext}},
+	}, nil
+}
+
+// DecryptOlmPayload decrypts the message for our device from the content of
+// an Olm encrypted to-device event with the Session and checks that the
+// payload is addressed to us.  userID is our own user and a is our Account.
+// Returns error on failure.
+func DecryptOlmPayload(a *Account, s *Session, userID string, content *OlmEncryptedContent) (*OlmPayload, error) {
+	if content.Algorithm != AlgorithmOlmV1 {
+		return nil, fmt.Errorf("Unsupported algorithm %s", content.Algorithm)
+	}
+	ourEd25519, ourCurve25519 := a.IdentityKeys()
+	message, ok := content.Ciphertext[ourCurve25519]
+	if !ok {
+		return nil, fmt.Errorf("Event isn't encrypted for this device")
+	}
+	plaintext, err := s.Decrypt(message.Body, message.Type)
+	if err != nil {
+		return nil, err
+	}
+	var payload OlmPayload
+	err = json.Unmarshal([]byte(plaintext), &payload)
+	if err != nil {
+		return nil, err
+	}
+	if payload.Recipient != userID || payload.RecipientKeys["ed25519"] != ourEd25519 {
+		return nil, fmt.Errorf("Event is addressed to another recipient")
+	}
+	return &payload, nil
+}
@@ -0,0 +1,85 @@
+package olm
+
+import "fmt"
+
+// KeyAlgorithmSignedCurve25519 is the algorithm of signed one time keys.
+const KeyAlgorithmSignedCurve25519 = "signed_curve25519"
+
+// SignedOneTimeKey is a one time key signed by the Account that owns it, as
+// uploaded to /keys/upload and returned by /keys/claim.  Fallback is true for
+// fallback keys, and is covered by the signature.
+type SignedOneTimeKey struct {
+	Key        Curve25519 `json:"key"`
+	Fallback   bool       `json:"fallback,omitempty"`
+	Signatures Signatures `json:"signatures"`
+}
+
+// OneTimeKeyManager keeps the number of one time keys published on the server
+// for an Account at half of MaxNumberOfOneTimeKeys.
+type OneTimeKeyManager struct {
+	account  *Account
+	userID   string
+	deviceID string
+}
+
+// NewOneTimeKeyManager creates a OneTimeKeyManager for the Account of the
+// device deviceID of userID.
+func NewOneTimeKeyManager(a *Account, userID, deviceID string) *OneTimeKeyManager {
+	return &OneTimeKeyManager{account: a, userID: userID, deviceID: deviceID}
+}
+
+// target returns the number of one time keys to keep published.
+func (m *OneTimeKeyManager) target() uint {
+	return m.account.MaxNumberOfOneTimeKeys() / 2
+}
+
+// KeysToGenerate returns the number of one time keys to generate given the
+// one_time_key_counts of the server.  Keys that were generated but not yet
+// published count towards the target.
+func (m *OneTimeKeyManager) KeysToGenerate(counts map[string]int) uint {
+	published := uint(0)
+	if counts[KeyAlgorithmSignedCurve25519] > 0 {
+		published = uint(counts[KeyAlgorithmSignedCurve25519])
+	}
+	pending := uint(len(m.account.OneTimeKeys().Curve25519))
+	if published+pending >= m.target() {
+		return 0
+	}
+	return m.target() - published - pending
+}
+
+// Prepare generates the one time keys needed to reach the target given the
+// one_time_key_counts of the server, and returns the signed one_time_keys of
+// a /keys/upload request mapping "signed_curve25519:<key id>" to key.  The
+// payload includes keys generated by a previous Prepare whose upload wasn't
+// confirmed.  Returns nil if there is nothing to upload.  Call Confirm once
+// the upload succeeded.  Returns error on failure.
+func (m *OneTimeKeyManager) Prepare(counts map[string]int) (map[string]*SignedOneTimeKey, error) {
+	num := m.KeysToGenerate(counts)
+	if num > 0 {
+		m.account.GenOneTimeKeys(num)
+	}
+	unpublished := m.account.OneTimeKeys().Curve25519
+	if len(unpublished) == 0 {
+		return nil, nil
+	}
+	payload := make(map[string]*SignedOneTimeKey, len(unpublished))
+	for keyID, key := range unpublished {
+		signed, err := m.account.SignJSON(SignedOneTimeKey{Key: key}, m.userID, m.deviceID)
+		if err != nil {
+			return nil, err
+		}
+		signatures, err := toSignatures(signed.(map[string]interface{})["signatures"])
+		if err != nil {
+			return nil, err
+		}
+		payload[fmt.Sprintf("%s:%s", KeyAlgorithmSignedCurve25519, keyID)] = &SignedOneTimeKey{Key: key, Signatures: signatures}
+	}
+	return payload, nil
+}
+
+// Confirm marks the one time keys returned by Prepare as published.  Only call
+// it after the server accepted the upload, otherwise the keys are lost.
+func (m *OneTimeKeyManager) Confirm() {
+	m.account.MarkKeysAsPublished()
+}
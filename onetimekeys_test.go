@@ -0,0 +1,64 @@
+package olm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOneTimeKeyManager(t *testing.T) {
+	a := NewAccount()
+	signingKey, _ := a.IdentityKeys()
+	m := NewOneTimeKeyManager(a, "@alice:example.org", "DEVICEID")
+	target := a.MaxNumberOfOneTimeKeys() / 2
+
+	counts := map[string]int{KeyAlgorithmSignedCurve25519: 3}
+	if m.KeysToGenerate(counts) != target-3 {
+		t.Fatalf("KeysToGenerate() = %d, expected %d", m.KeysToGenerate(counts), target-3)
+	}
+	payload, err := m.Prepare(counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint(len(payload)) != target-3 {
+		t.Fatalf("Prepare() returned %d keys, expected %d", len(payload), target-3)
+	}
+	for keyID, key := range payload {
+		if !strings.HasPrefix(keyID, KeyAlgorithmSignedCurve25519+":") {
+			t.Fatal("Unexpected key ID", keyID)
+		}
+		ok, err := VerifySignatureJSON(key, "@alice:example.org", "DEVICEID", signingKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("One time key signature verification failed")
+		}
+	}
+
+	// The upload failed: the same keys are prepared again
+	if m.KeysToGenerate(counts) != 0 {
+		t.Fatal("Unpublished keys should count towards the target")
+	}
+	retry, err := m.Prepare(counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for keyID, key := range payload {
+		if retry[keyID] == nil || retry[keyID].Key != key.Key {
+			t.Fatal("Prepare() after a failed upload should return the same keys")
+		}
+	}
+
+	// The upload succeeded
+	m.Confirm()
+	if len(a.OneTimeKeys().Curve25519) != 0 {
+		t.Fatal("Keys should be published after Confirm()")
+	}
+	payload, err = m.Prepare(map[string]int{KeyAlgorithmSignedCurve25519: int(target)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload != nil {
+		t.Fatal("Prepare() should return nil when the server has enough keys")
+	}
+}
@@ -0,0 +1,178 @@
+package olm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// pickleMACLen is the length of the truncated HMAC-SHA-256 appended to
+// pickles.
+const pickleMACLen = 8
+
+// pickleKeys derives the AES key, HMAC key and AES IV used by libolm to
+// encrypt pickles from the pickle key.  An empty key is replaced by " ", as
+// the bindings do before calling libolm.
+func pickleKeys(key []byte) (aesKey, hmacKey, iv []byte) {
+	if len(key) == 0 {
+		key = []byte(" ")
+	}
+	keys := make([]byte, 80)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("Pickle")), keys)
+	if err != nil {
+		panic(err)
+	}
+	return keys[:32], keys[32:64], keys[64:]
+}
+
+// pickleMAC returns the truncated MAC of the cipher-text of a pickle.
+func pickleMAC(hmacKey, ciphertext []byte) []byte {
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(ciphertext)
+	return mac.Sum(nil)[:pickleMACLen]
+}
+
+// pickleEncrypt encrypts the serialised object as libolm does and returns the
+// pickle in unpadded base64.
+func pickleEncrypt(plaintext, key []byte) string {
+	aesKey, hmacKey, iv := pickleKeys(key)
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		panic(err)
+	}
+	padded := pkcs7Pad(append([]byte(nil), plaintext...), aes.BlockSize)
+	ciphertext := make([]byte, len(padded), len(padded)+pickleMACLen)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+	clearBytes(padded)
+	return base64.RawStdEncoding.EncodeToString(append(ciphertext, pickleMAC(hmacKey, ciphertext)...))
+}
+
+// pickleDecrypt decrypts a pickle in unpadded base64 and returns the
+// serialised object.  Returns error on failure.  If the base64 couldn't be
+// decoded then the error will be "INVALID_BASE64".  If the key doesn't match
+// the one used to encrypt the pickle then the error will be
+// "BAD_ACCOUNT_KEY", as libolm reports it for every type of pickle.
+func pickleDecrypt(pickled string, key []byte) ([]byte, error) {
+	raw, err := decodeBase64(pickled)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < pickleMACLen+aes.BlockSize {
+		return nil, fmt.Errorf("CORRUPTED_PICKLE")
+	}
+	aesKey, hmacKey, iv := pickleKeys(key)
+	ciphertext := raw[:len(raw)-pickleMACLen]
+	if !hmac.Equal(pickleMAC(hmacKey, ciphertext), raw[len(ciphertext):]) {
+		return nil, fmt.Errorf("BAD_ACCOUNT_KEY")
+	}
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("CORRUPTED_PICKLE")
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	plaintext, err = pkcs7Unpad(plaintext, aes.BlockSize)
+	if err != nil {
+		return nil, fmt.Errorf("CORRUPTED_PICKLE")
+	}
+	return plaintext, nil
+}
+
+// pickleReader reads the fields of an object serialised by libolm.  The first
+// read past the end of the data sets err to "CORRUPTED_PICKLE" and every
+// later read returns zero values.
+type pickleReader struct {
+	data []byte
+	err  error
+}
+
+// bytes reads n bytes.
+func (r *pickleReader) bytes(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("CORRUPTED_PICKLE")
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// uint32 reads a big-endian 32 bit integer.
+func (r *pickleReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.bytes(4))
+}
+
+// uint8 reads a single byte integer.
+func (r *pickleReader) uint8() uint8 {
+	return r.bytes(1)[0]
+}
+
+// bool reads a boolean stored as a single byte.
+func (r *pickleReader) bool() bool {
+	return r.uint8() != 0
+}
+
+// count reads the length of a list and checks it against the capacity of the
+// list in libolm.
+func (r *pickleReader) count(max uint32) int {
+	n := r.uint32()
+	if n > max && r.err == nil {
+		r.err = fmt.Errorf("CORRUPTED_PICKLE")
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+// end checks that the whole data was read.
+func (r *pickleReader) end() error {
+	if r.err == nil && len(r.data) != 0 {
+		r.err = fmt.Errorf("CORRUPTED_PICKLE")
+	}
+	return r.err
+}
+
+// pickleWriter serialises the fields of an object as libolm does.
+type pickleWriter struct {
+	data []byte
+}
+
+// bytes writes b.
+func (w *pickleWriter) bytes(b []byte) {
+	w.data = append(w.data, b...)
+}
+
+// uint32 writes a big-endian 32 bit integer.
+func (w *pickleWriter) uint32(n uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	w.bytes(b[:])
+}
+
+// uint8 writes a single byte integer.
+func (w *pickleWriter) uint8(n uint8) {
+	w.data = append(w.data, n)
+}
+
+// bool writes a boolean as a single byte.
+func (w *pickleWriter) bool(b bool) {
+	if b {
+		w.uint8(1)
+	} else {
+		w.uint8(0)
+	}
+}
@@ -0,0 +1,268 @@
+package olm
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// PickleType is the type of object stored in a pickle.
+type PickleType string
+
+const (
+	PickleTypeAccount              PickleType = "account"
+	PickleTypeSession              PickleType = "session"
+	PickleTypeOutboundGroupSession PickleType = "outbound_group_session"
+	PickleTypeInboundGroupSession  PickleType = "inbound_group_session"
+)
+
+// Pickle versions written by libolm.  Older versions listed in
+// pickleVersions can still be read by libolm.
+const (
+	AccountPickleVersion              = 4
+	SessionPickleVersion              = 1
+	OutboundGroupSessionPickleVersion = 1
+	InboundGroupSessionPickleVersion  = 2
+)
+
+// Capacities of the lists stored in pickles by libolm.
+const (
+	maxOneTimeKeys       = 100
+	maxSenderChains      = 1
+	maxReceiverChains    = 5
+	maxSkippedMessageKey = 40
+)
+
+// Sizes of the fields stored in pickles by libolm.
+const (
+	ed25519PrivateKeyLen = 64
+	megolmRatchetLen     = 128
+	sessionChainIndex    = 0x80000001
+)
+
+// PickleInfo is the non-secret metadata of a pickle.  Only the fields that
+// apply to Type are set.
+type PickleInfo struct {
+	Type    PickleType
+	Version uint32
+
+	// Ed25519 and Curve25519 are the identity keys of an Account.
+	Ed25519    Ed25519
+	Curve25519 Curve25519
+	// OneTimeKeys is the number of one time keys of an Account, of which
+	// UnpublishedOneTimeKeys are unpublished.  FallbackKeys is the number of
+	// fallback keys.
+	OneTimeKeys            int
+	UnpublishedOneTimeKeys int
+	FallbackKeys           int
+
+	// SessionID is the ID of a Session or group session.
+	SessionID SessionID
+	// HasReceivedMessage is true if a Session has received a message.
+	HasReceivedMessage bool
+
+	// MessageIndex is the index of the next message of an
+	// OutboundGroupSession, or the latest known index of an
+	// InboundGroupSession.  FirstKnownIndex is the first index an
+	// InboundGroupSession can decrypt.
+	MessageIndex    uint32
+	FirstKnownIndex uint32
+	// Verified is true if the key of an InboundGroupSession came from the
+	// session owner rather than being forwarded or imported.
+	Verified bool
+}
+
+// pickleVersions maps from each type to the versions libolm can read.
+var pickleVersions = map[PickleType][]uint32{
+	PickleTypeAccount:              {2, 3, AccountPickleVersion},
+	PickleTypeSession:              {SessionPickleVersion, sessionChainIndex},
+	PickleTypeOutboundGroupSession: {OutboundGroupSessionPickleVersion},
+	PickleTypeInboundGroupSession:  {1, InboundGroupSessionPickleVersion},
+}
+
+// pickleInspectors maps from each type to the function reading its metadata.
+var pickleInspectors = map[PickleType]func(*pickleReader, *PickleInfo){
+	PickleTypeAccount:              inspectAccount,
+	PickleTypeSession:              inspectSession,
+	PickleTypeOutboundGroupSession: inspectOutboundGroupSession,
+	PickleTypeInboundGroupSession:  inspectInboundGroupSession,
+}
+
+// InspectPickleAs returns the metadata of a pickle of type t without
+// constructing the object.  Returns error on failure.  If the base64 couldn't
+// be decoded then the error will be "INVALID_BASE64".  If the key doesn't
+// match the one used to encrypt the pickle then the error will be
+// "BAD_ACCOUNT_KEY".  If the pickle was written by a version of libolm this
+// one can't read then the error will be "UNKNOWN_PICKLE_VERSION", or
+// "BAD_LEGACY_ACCOUNT_PICKLE" for version 1 accounts, and the returned info
+// has the version of the pickle.  If the pickle doesn't hold an object of
+// type t the error will be "CORRUPTED_PICKLE".
+func InspectPickleAs(t PickleType, pickled string, key []byte) (*PickleInfo, error) {
+	plaintext, err := pickleDecrypt(pickled, key)
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(plaintext)
+	return inspectPickle(t, plaintext)
+}
+
+// InspectPickle returns the type and metadata of a pickle without
+// constructing the object.  The type is found by reading the pickle as each
+// type, which is unambiguous for pickles written by libolm.  Returns error on
+// failure, as InspectPickleAs.  If the pickle doesn't hold any known type of
+// object the error will be "CORRUPTED_PICKLE", or "UNKNOWN_PICKLE_VERSION" if
+// its version isn't known for any type.
+func InspectPickle(pickled string, key []byte) (*PickleInfo, error) {
+	plaintext, err := pickleDecrypt(pickled, key)
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(plaintext)
+	var found *PickleInfo
+	var firstErr error
+	for _, t := range []PickleType{PickleTypeAccount, PickleTypeSession, PickleTypeOutboundGroupSession, PickleTypeInboundGroupSession} {
+		info, err := inspectPickle(t, plaintext)
+		if err != nil {
+			if firstErr == nil || firstErr.Error() == "UNKNOWN_PICKLE_VERSION" {
+				firstErr = err
+			}
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("Pickle could be a %s or a %s", found.Type, info.Type)
+		}
+		found = info
+	}
+	if found == nil {
+		return nil, firstErr
+	}
+	return found, nil
+}
+
+// inspectPickle reads the metadata of a serialised object of type t.
+func inspectPickle(t PickleType, plaintext []byte) (*PickleInfo, error) {
+	inspect, ok := pickleInspectors[t]
+	if !ok {
+		return nil, fmt.Errorf("Unknown pickle type %q", t)
+	}
+	r := &pickleReader{data: plaintext}
+	info := &PickleInfo{Type: t, Version: r.uint32()}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if !IsPickleVersionSupported(t, info.Version) {
+		if t == PickleTypeAccount && info.Version == 1 {
+			return info, fmt.Errorf("BAD_LEGACY_ACCOUNT_PICKLE")
+		}
+		return info, fmt.Errorf("UNKNOWN_PICKLE_VERSION")
+	}
+	inspect(r, info)
+	err := r.end()
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// IsPickleVersionSupported returns true if libolm can read pickles of type t
+// with the version.
+func IsPickleVersionSupported(t PickleType, version uint32) bool {
+	for _, v := range pickleVersions[t] {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectAccount reads the metadata of an Account.
+func inspectAccount(r *pickleReader, info *PickleInfo) {
+	info.Ed25519 = Ed25519(base64.RawStdEncoding.EncodeToString(r.bytes(32)))
+	r.bytes(ed25519PrivateKeyLen)
+	info.Curve25519 = Curve25519(base64.RawStdEncoding.EncodeToString(r.bytes(32)))
+	r.bytes(32)
+	info.OneTimeKeys = r.count(maxOneTimeKeys)
+	for i := 0; i < info.OneTimeKeys; i++ {
+		if !readOneTimeKey(r) {
+			info.UnpublishedOneTimeKeys++
+		}
+	}
+	switch info.Version {
+	case 2:
+	case 3:
+		// Version 3 always stores two fallback keys and uses their
+		// published flag to tell whether they are set.
+		if readOneTimeKey(r) {
+			info.FallbackKeys++
+			if readOneTimeKey(r) {
+				info.FallbackKeys++
+			}
+		} else {
+			readOneTimeKey(r)
+		}
+	default:
+		info.FallbackKeys = int(r.uint8())
+		if info.FallbackKeys > 2 && r.err == nil {
+			r.err = fmt.Errorf("CORRUPTED_PICKLE")
+		}
+		for i := 0; i < info.FallbackKeys; i++ {
+			readOneTimeKey(r)
+		}
+	}
+	// next one time key ID
+	r.uint32()
+}
+
+// readOneTimeKey skips a one time key of an Account and returns whether it
+// was published.
+func readOneTimeKey(r *pickleReader) bool {
+	r.uint32()
+	published := r.bool()
+	r.bytes(64)
+	return published
+}
+
+// inspectSession reads the metadata of a Session.
+func inspectSession(r *pickleReader, info *PickleInfo) {
+	info.HasReceivedMessage = r.bool()
+	id := sha256.Sum256(r.bytes(3 * 32))
+	info.SessionID = SessionID(base64.RawStdEncoding.EncodeToString(id[:]))
+	// root key
+	r.bytes(32)
+	for i, n := 0, r.count(maxSenderChains); i < n; i++ {
+		// ratchet key pair, chain key and index
+		r.bytes(64 + 32 + 4)
+	}
+	for i, n := 0, r.count(maxReceiverChains); i < n; i++ {
+		// ratchet key, chain key and index
+		r.bytes(32 + 32 + 4)
+	}
+	for i, n := 0, r.count(maxSkippedMessageKey); i < n; i++ {
+		// ratchet key, message key and index
+		r.bytes(32 + 32 + 4)
+	}
+	if info.Version == sessionChainIndex {
+		r.bytes(8)
+	}
+}
+
+// inspectOutboundGroupSession reads the metadata of an OutboundGroupSession.
+func inspectOutboundGroupSession(r *pickleReader, info *PickleInfo) {
+	r.bytes(megolmRatchetLen)
+	info.MessageIndex = r.uint32()
+	info.SessionID = SessionID(base64.RawStdEncoding.EncodeToString(r.bytes(32)))
+	r.bytes(ed25519PrivateKeyLen)
+}
+
+// inspectInboundGroupSession reads the metadata of an InboundGroupSession.
+func inspectInboundGroupSession(r *pickleReader, info *PickleInfo) {
+	r.bytes(megolmRatchetLen)
+	info.FirstKnownIndex = r.uint32()
+	r.bytes(megolmRatchetLen)
+	info.MessageIndex = r.uint32()
+	info.SessionID = SessionID(base64.RawStdEncoding.EncodeToString(r.bytes(32)))
+	info.Verified = true
+	if info.Version >= 2 {
+		info.Verified = r.bool()
+	}
+}
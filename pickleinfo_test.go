@@ -0,0 +1,227 @@
+package olm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+// testKey returns a 32 byte key filled with b.
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// writeOneTimeKey writes a one time key of an Account.
+func writeOneTimeKey(w *pickleWriter, id uint32, published bool) {
+	w.uint32(id)
+	w.bool(published)
+	w.bytes(testKey(byte(id)))
+	w.bytes(testKey(0xff))
+}
+
+// testAccountPickle serialises an Account with three one time keys, one of
+// them published, and one fallback key.
+func testAccountPickle(version uint32) []byte {
+	w := &pickleWriter{}
+	w.uint32(version)
+	w.bytes(testKey(1))
+	w.bytes(bytes.Repeat([]byte{0xff}, 64))
+	w.bytes(testKey(2))
+	w.bytes(testKey(0xff))
+	w.uint32(3)
+	writeOneTimeKey(w, 1, true)
+	writeOneTimeKey(w, 2, false)
+	writeOneTimeKey(w, 3, false)
+	switch version {
+	case 3:
+		writeOneTimeKey(w, 4, true)
+		writeOneTimeKey(w, 0, false)
+	case 4:
+		w.uint8(1)
+		writeOneTimeKey(w, 4, true)
+	}
+	w.uint32(5)
+	return w.data
+}
+
+// testSessionPickle serialises a Session with a sender chain, two receiver
+// chains and a skipped message key.
+func testSessionPickle(version uint32) []byte {
+	w := &pickleWriter{}
+	w.uint32(version)
+	w.bool(true)
+	w.bytes(testKey(1))
+	w.bytes(testKey(2))
+	w.bytes(testKey(3))
+	w.bytes(testKey(4))
+	w.uint32(1)
+	w.bytes(make([]byte, 64+32+4))
+	w.uint32(2)
+	w.bytes(make([]byte, 2*(32+32+4)))
+	w.uint32(1)
+	w.bytes(make([]byte, 32+32+4))
+	if version == sessionChainIndex {
+		w.bytes(make([]byte, 8))
+	}
+	return w.data
+}
+
+func TestInspectPickle(t *testing.T) {
+	key := []byte("pickle key")
+	ed25519Key := Ed25519(base64.RawStdEncoding.EncodeToString(testKey(1)))
+	curve25519Key := Curve25519(base64.RawStdEncoding.EncodeToString(testKey(2)))
+	sessionID := sha256.Sum256(append(append(testKey(1), testKey(2)...), testKey(3)...))
+
+	for _, version := range []uint32{2, 3, 4} {
+		info, err := InspectPickle(pickleEncrypt(testAccountPickle(version), key), key)
+		if err != nil {
+			t.Fatal(version, err)
+		}
+		fallbackKeys := 1
+		if version == 2 {
+			fallbackKeys = 0
+		}
+		if info.Type != PickleTypeAccount || info.Version != version ||
+			info.Ed25519 != ed25519Key || info.Curve25519 != curve25519Key ||
+			info.OneTimeKeys != 3 || info.UnpublishedOneTimeKeys != 2 || info.FallbackKeys != fallbackKeys {
+			t.Fatalf("Wrong info for account version %d: %+v", version, info)
+		}
+	}
+
+	for _, version := range []uint32{SessionPickleVersion, sessionChainIndex} {
+		info, err := InspectPickle(pickleEncrypt(testSessionPickle(version), key), key)
+		if err != nil {
+			t.Fatal(version, err)
+		}
+		if info.Type != PickleTypeSession || info.Version != version || !info.HasReceivedMessage ||
+			info.SessionID != SessionID(base64.RawStdEncoding.EncodeToString(sessionID[:])) {
+			t.Fatalf("Wrong info for session version %d: %+v", version, info)
+		}
+	}
+
+	w := &pickleWriter{}
+	w.uint32(OutboundGroupSessionPickleVersion)
+	w.bytes(make([]byte, megolmRatchetLen))
+	w.uint32(7)
+	w.bytes(testKey(1))
+	w.bytes(make([]byte, 64))
+	info, err := InspectPickle(pickleEncrypt(w.data, key), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != PickleTypeOutboundGroupSession || info.MessageIndex != 7 || info.SessionID != SessionID(ed25519Key) {
+		t.Fatalf("Wrong info for outbound group session: %+v", info)
+	}
+
+	for _, version := range []uint32{1, InboundGroupSessionPickleVersion} {
+		w := &pickleWriter{}
+		w.uint32(version)
+		w.bytes(make([]byte, megolmRatchetLen))
+		w.uint32(3)
+		w.bytes(make([]byte, megolmRatchetLen))
+		w.uint32(9)
+		w.bytes(testKey(1))
+		if version == 2 {
+			w.bool(false)
+		}
+		info, err := InspectPickle(pickleEncrypt(w.data, key), key)
+		if err != nil {
+			t.Fatal(version, err)
+		}
+		if info.Type != PickleTypeInboundGroupSession || info.FirstKnownIndex != 3 || info.MessageIndex != 9 ||
+			info.SessionID != SessionID(ed25519Key) || info.Verified != (version == 1) {
+			t.Fatalf("Wrong info for inbound group session version %d: %+v", version, info)
+		}
+	}
+}
+
+func TestInspectPickleErrors(t *testing.T) {
+	key := []byte("pickle key")
+	account := pickleEncrypt(testAccountPickle(AccountPickleVersion), key)
+	if _, err := InspectPickle(account, []byte("wrong key")); err == nil || err.Error() != "BAD_ACCOUNT_KEY" {
+		t.Fatal("Expected BAD_ACCOUNT_KEY, got", err)
+	}
+	if _, err := InspectPickle("!"+account, key); err == nil || err.Error() != "INVALID_BASE64" {
+		t.Fatal("Expected INVALID_BASE64, got", err)
+	}
+	session := pickleEncrypt(testSessionPickle(SessionPickleVersion), key)
+	if _, err := InspectPickleAs(PickleTypeOutboundGroupSession, session, key); err == nil || err.Error() != "CORRUPTED_PICKLE" {
+		t.Fatal("Expected CORRUPTED_PICKLE, got", err)
+	}
+	trailing := pickleEncrypt(append(testAccountPickle(AccountPickleVersion), 0), key)
+	if _, err := InspectPickle(trailing, key); err == nil || err.Error() != "CORRUPTED_PICKLE" {
+		t.Fatal("Expected CORRUPTED_PICKLE, got", err)
+	}
+	truncated := pickleEncrypt(testSessionPickle(SessionPickleVersion)[:100], key)
+	if _, err := InspectPickleAs(PickleTypeSession, truncated, key); err == nil || err.Error() != "CORRUPTED_PICKLE" {
+		t.Fatal("Expected CORRUPTED_PICKLE, got", err)
+	}
+
+	legacy := pickleEncrypt(testAccountPickle(1), key)
+	info, err := InspectPickleAs(PickleTypeAccount, legacy, key)
+	if err == nil || err.Error() != "BAD_LEGACY_ACCOUNT_PICKLE" || info.Version != 1 {
+		t.Fatal("Expected BAD_LEGACY_ACCOUNT_PICKLE, got", err)
+	}
+	future := pickleEncrypt(testAccountPickle(99), key)
+	if _, err := InspectPickle(future, key); err == nil || err.Error() != "UNKNOWN_PICKLE_VERSION" {
+		t.Fatal("Expected UNKNOWN_PICKLE_VERSION, got", err)
+	}
+	if IsPickleVersionSupported(PickleTypeInboundGroupSession, 3) || !IsPickleVersionSupported(PickleTypeAccount, 3) {
+		t.Fatal("IsPickleVersionSupported() is wrong")
+	}
+}
+
+func TestInspectLibolmPickles(t *testing.T) {
+	key := []byte("pickle key")
+	a := NewAccount()
+	a.GenOneTimeKeys(2)
+	ed25519Key, curve25519Key := a.IdentityKeys()
+	info, err := InspectPickle(a.Pickle(key), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != PickleTypeAccount || info.Version != AccountPickleVersion ||
+		info.Ed25519 != ed25519Key || info.Curve25519 != curve25519Key || info.UnpublishedOneTimeKeys != 2 {
+		t.Fatalf("Wrong info for account: %+v", info)
+	}
+
+	outbound := NewOutboundGroupSession()
+	outbound.Encrypt("Hello")
+	info, err = InspectPickle(outbound.Pickle(key), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != PickleTypeOutboundGroupSession || info.SessionID != outbound.ID() || info.MessageIndex != 1 {
+		t.Fatalf("Wrong info for outbound group session: %+v", info)
+	}
+
+	inbound, err := NewInboundGroupSession([]byte(outbound.SessionKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = InspectPickle(inbound.Pickle(key), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != PickleTypeInboundGroupSession || info.SessionID != inbound.ID() || info.FirstKnownIndex != 1 || !info.Verified {
+		t.Fatalf("Wrong info for inbound group session: %+v", info)
+	}
+
+	_, theirKey := a.IdentityKeys()
+	otks := a.OneTimeKeys().Curve25519
+	for _, otk := range otks {
+		s, err := NewAccount().NewOutboundSession(theirKey, otk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err = InspectPickle(s.Pickle(key), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Type != PickleTypeSession || info.SessionID != s.ID() || info.HasReceivedMessage {
+			t.Fatalf("Wrong info for session: %+v", info)
+		}
+		break
+	}
+}
@@ -0,0 +1,164 @@
+package olm
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Algorithms for deriving a PickleKey from a passphrase.
+const (
+	PickleKeyArgon2id = "argon2id"
+	PickleKeyPBKDF2   = "pbkdf2-sha512"
+)
+
+// Default parameters of NewPickleKeyParams.  The Argon2id parameters are the
+// second recommended option of RFC 9106.
+const (
+	DefaultPickleKeyArgon2Time    = 3
+	DefaultPickleKeyArgon2Memory  = 64 * 1024
+	DefaultPickleKeyArgon2Threads = 4
+	DefaultPickleKeyIterations    = DefaultPassphraseIterations
+)
+
+// pickleKeyLen is the length in bytes of a PickleKey derived from a
+// passphrase.
+const pickleKeyLen = 32
+
+// PickleKey is the key used to encrypt pickles.  A PickleKey is never empty,
+// except for InsecureNoPickleKey.
+type PickleKey struct {
+	key      []byte
+	insecure bool
+}
+
+// InsecureNoPickleKey stores pickles effectively unencrypted.  It must be
+// chosen explicitly, for tests or for stores that are encrypted by other means.
+var InsecureNoPickleKey = &PickleKey{insecure: true}
+
+// NewPickleKey returns a PickleKey holding a copy of key.  Returns error if
+// the key is empty.
+func NewPickleKey(key []byte) (*PickleKey, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("Empty pickle key, use InsecureNoPickleKey to store pickles unencrypted")
+	}
+	return &PickleKey{key: append([]byte(nil), key...)}, nil
+}
+
+// PickleKeyFromEnv loads the PickleKey from the environment variable name,
+// which holds the key in base64.  Returns error if the variable is unset or
+// empty.  If the base64 couldn't be decoded then the error will be
+// "INVALID_BASE64".
+func PickleKeyFromEnv(name string) (*PickleKey, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("Environment variable %s isn't set", name)
+	}
+	return pickleKeyFromBase64(value)
+}
+
+// PickleKeyFromFile loads the PickleKey from a file holding the key in base64,
+// optionally followed by a new line.  Returns error if the file can't be read
+// or is empty.  If the base64 couldn't be decoded then the error will be
+// "INVALID_BASE64".
+func PickleKeyFromFile(path string) (*PickleKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(data)
+	return pickleKeyFromBase64(string(data))
+}
+
+// pickleKeyFromBase64 decodes a PickleKey in base64.
+func pickleKeyFromBase64(encoded string) (*PickleKey, error) {
+	key, err := decodeBase64(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(key)
+	return NewPickleKey(key)
+}
+
+// PickleKeyParams describes how a PickleKey is derived from a passphrase.  It
+// isn't secret and must be stored to derive the same key again.  Memory is
+// in KiB and is only used with Argon2id, as is Threads.
+type PickleKeyParams struct {
+	Algorithm  string `json:"algorithm"`
+	Salt       string `json:"salt"`
+	Iterations uint32 `json:"iterations"`
+	Memory     uint32 `json:"memory,omitempty"`
+	Threads    uint8  `json:"threads,omitempty"`
+}
+
+// NewPickleKeyParams returns PickleKeyParams using the algorithm with the
+// default parameters and a new random salt.  Returns error if the algorithm
+// isn't PickleKeyArgon2id or PickleKeyPBKDF2.
+func NewPickleKeyParams(algorithm string) (*PickleKeyParams, error) {
+	p := &PickleKeyParams{Algorithm: algorithm, Salt: randomString(32)}
+	switch algorithm {
+	case PickleKeyArgon2id:
+		p.Iterations = DefaultPickleKeyArgon2Time
+		p.Memory = DefaultPickleKeyArgon2Memory
+		p.Threads = DefaultPickleKeyArgon2Threads
+	case PickleKeyPBKDF2:
+		p.Iterations = DefaultPickleKeyIterations
+	default:
+		return nil, fmt.Errorf("Unsupported pickle key algorithm %s", algorithm)
+	}
+	return p, nil
+}
+
+// Key derives the PickleKey from the passphrase.  Returns error if the
+// passphrase is empty or the parameters are invalid.
+func (p *PickleKeyParams) Key(passphrase string) (*PickleKey, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("Empty passphrase")
+	}
+	if len(p.Salt) == 0 {
+		return nil, fmt.Errorf("Pickle key parameters have no salt")
+	}
+	if p.Iterations == 0 {
+		return nil, fmt.Errorf("Pickle key parameters have no iterations")
+	}
+	var key []byte
+	switch p.Algorithm {
+	case PickleKeyArgon2id:
+		if p.Memory == 0 || p.Threads == 0 {
+			return nil, fmt.Errorf("Pickle key parameters have no memory or threads")
+		}
+		key = argon2.IDKey([]byte(passphrase), []byte(p.Salt), p.Iterations, p.Memory, p.Threads, pickleKeyLen)
+	case PickleKeyPBKDF2:
+		key = pbkdf2.Key([]byte(passphrase), []byte(p.Salt), int(p.Iterations), pickleKeyLen, sha512.New)
+	default:
+		return nil, fmt.Errorf("Unsupported pickle key algorithm %s", p.Algorithm)
+	}
+	return &PickleKey{key: key}, nil
+}
+
+// Bytes returns a copy of the key to pass to the Pickle and FromPickled
+// functions, which the caller may clear.  Returns error if the PickleKey is
+// empty, which only happens for the zero value, unless it's
+// InsecureNoPickleKey.
+func (k *PickleKey) Bytes() ([]byte, error) {
+	if k == nil || (len(k.key) == 0 && !k.insecure) {
+		return nil, fmt.Errorf("Empty pickle key, use InsecureNoPickleKey to store pickles unencrypted")
+	}
+	return append([]byte{}, k.key...), nil
+}
+
+// IsInsecure returns true for InsecureNoPickleKey.
+func (k *PickleKey) IsInsecure() bool {
+	return k.insecure
+}
+
+// Clear overwrites the key in memory.  The PickleKey can't be used anymore.
+func (k *PickleKey) Clear() {
+	clearBytes(k.key)
+	k.key = nil
+}
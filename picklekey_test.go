@@ -0,0 +1,140 @@
+package olm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPickleKey(t *testing.T) {
+	if _, err := NewPickleKey(nil); err == nil {
+		t.Fatal("NewPickleKey() should reject empty keys")
+	}
+	raw := []byte("secret")
+	k, err := NewPickleKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[0] = 'S'
+	key, err := k.Bytes()
+	if err != nil || string(key) != "secret" {
+		t.Fatal("NewPickleKey() should copy the key, got", string(key), err)
+	}
+	key[0] = 'S'
+	if key, _ := k.Bytes(); string(key) != "secret" {
+		t.Fatal("Bytes() should return a copy of the key, got", string(key))
+	}
+	k.Clear()
+	if _, err := k.Bytes(); err == nil {
+		t.Fatal("Cleared key shouldn't be usable")
+	}
+	if _, err := (&PickleKey{}).Bytes(); err == nil {
+		t.Fatal("Zero PickleKey shouldn't be usable")
+	}
+	key, err = InsecureNoPickleKey.Bytes()
+	if err != nil || len(key) != 0 || !InsecureNoPickleKey.IsInsecure() {
+		t.Fatal("InsecureNoPickleKey should be an empty key, got", key, err)
+	}
+}
+
+func TestPickleKeyFromEnvAndFile(t *testing.T) {
+	const name = "OLM_TEST_PICKLE_KEY"
+	os.Setenv(name, "c2VjcmV0IHBpY2tsZSBrZXk=")
+	defer os.Unsetenv(name)
+	k, err := PickleKeyFromEnv(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := k.Bytes(); string(key) != "secret pickle key" {
+		t.Fatal("Wrong key from environment", string(key))
+	}
+	os.Setenv(name, "")
+	if _, err := PickleKeyFromEnv(name); err == nil {
+		t.Fatal("PickleKeyFromEnv() should reject empty keys")
+	}
+	os.Setenv(name, "not base64!")
+	if _, err := PickleKeyFromEnv(name); err == nil || err.Error() != "INVALID_BASE64" {
+		t.Fatal("Expected INVALID_BASE64, got", err)
+	}
+	os.Unsetenv(name)
+	if _, err := PickleKeyFromEnv(name); err == nil {
+		t.Fatal("PickleKeyFromEnv() should fail for unset variables")
+	}
+
+	dir, err := ioutil.TempDir("", "olm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pickle_key")
+	err = ioutil.WriteFile(path, []byte("c2VjcmV0IHBpY2tsZSBrZXk\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err = PickleKeyFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := k.Bytes(); string(key) != "secret pickle key" {
+		t.Fatal("Wrong key from file", string(key))
+	}
+	err = ioutil.WriteFile(path, []byte("\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PickleKeyFromFile(path); err == nil {
+		t.Fatal("PickleKeyFromFile() should reject empty keys")
+	}
+}
+
+func TestPickleKeyParams(t *testing.T) {
+	for _, algorithm := range []string{PickleKeyArgon2id, PickleKeyPBKDF2} {
+		p, err := NewPickleKeyParams(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Keep the test fast.
+		p.Iterations = 1
+		p.Memory = p.Memory / 64
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(string(data))
+		var stored PickleKeyParams
+		err = json.Unmarshal(data, &stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k1, err := p.Key("correct horse battery staple")
+		if err != nil {
+			t.Fatal(err)
+		}
+		k2, err := stored.Key("correct horse battery staple")
+		if err != nil {
+			t.Fatal(err)
+		}
+		k3, err := stored.Key("wrong passphrase")
+		if err != nil {
+			t.Fatal(err)
+		}
+		key1, _ := k1.Bytes()
+		key2, _ := k2.Bytes()
+		key3, _ := k3.Bytes()
+		if len(key1) != 32 || !bytes.Equal(key1, key2) || bytes.Equal(key1, key3) {
+			t.Fatal("Derived keys don't match for", algorithm)
+		}
+		if _, err := p.Key(""); err == nil {
+			t.Fatal("Key() should reject empty passphrases")
+		}
+	}
+	if _, err := NewPickleKeyParams("scrypt"); err == nil {
+		t.Fatal("NewPickleKeyParams() should reject unknown algorithms")
+	}
+	if _, err := (&PickleKeyParams{Algorithm: PickleKeyPBKDF2, Iterations: 1}).Key("passphrase"); err == nil {
+		t.Fatal("Key() should reject parameters without salt")
+	}
+}
@@ -0,0 +1,249 @@
+package olm
+
+import (
+	crand "crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// recoveryKeyPrefix is prepended to the key before encoding it as a recovery
+// key.
+var recoveryKeyPrefix = []byte{0x8B, 0x01}
+
+// recoveryKeyLen is the length in bytes of the keys encoded as recovery keys.
+const recoveryKeyLen = 32
+
+// base58Alphabet is the Bitcoin base58 alphabet used by recovery keys.
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// EncodeRecoveryKey encodes a 32 byte key as a recovery key: the prefix
+// 0x8B 0x01, the key and a parity byte encoded as base58 in groups of four
+// characters separated by spaces.
+func EncodeRecoveryKey(key []byte) (string, error) {
+	if len(key) != recoveryKeyLen {
+		return "", fmt.Errorf("Invalid key length %d, expected %d", len(key), recoveryKeyLen)
+	}
+	data := make([]byte, 0, len(recoveryKeyPrefix)+recoveryKeyLen+1)
+	data = append(data, recoveryKeyPrefix...)
+	data = append(data, key...)
+	var parity byte
+	for _, b := range data {
+		parity ^= b
+	}
+	data = append(data, parity)
+
+	encoded := base58Encode(data)
+	var out strings.Builder
+	for i := 0; i < len(encoded); i += 4 {
+		if i > 0 {
+			out.WriteByte(' ')
+		}
+		end := i + 4
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		out.WriteString(encoded[i:end])
+	}
+	return out.String(), nil
+}
+
+// DecodeRecoveryKey decodes a recovery key created by EncodeRecoveryKey.
+// Whitespace in the recovery key is ignored.  Returns error on failure.  If
+// the recovery key has an invalid prefix, length or parity byte the error
+// describes the problem.
+func DecodeRecoveryKey(recoveryKey string) ([]byte, error) {
+	encoded := strings.Join(strings.Fields(recoveryKey), "")
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("Empty input")
+	}
+	data, err := base58Decode(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != len(recoveryKeyPrefix)+recoveryKeyLen+1 {
+		return nil, fmt.Errorf("Invalid recovery key length %d, expected %d", len(data), len(recoveryKeyPrefix)+recoveryKeyLen+1)
+	}
+	if data[0] != recoveryKeyPrefix[0] || data[1] != recoveryKeyPrefix[1] {
+		return nil, fmt.Errorf("Invalid recovery key prefix 0x%02X 0x%02X", data[0], data[1])
+	}
+	var parity byte
+	for _, b := range data {
+		parity ^= b
+	}
+	if parity != 0 {
+		return nil, fmt.Errorf("Invalid recovery key parity")
+	}
+	return data[len(recoveryKeyPrefix) : len(recoveryKeyPrefix)+recoveryKeyLen], nil
+}
+
+// base58Encode encodes the input using the Bitcoin base58 alphabet.
+func base58Encode(input []byte) string {
+	n := new(big.Int).SetBytes(input)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range input {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+// base58Decode decodes input encoded with base58Encode.  Returns error if the
+// input contains a character outside the base58 alphabet.
+func base58Decode(input string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range input {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid base58 character %q", c)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	var zeros int
+	for zeros < len(input) && input[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// randomString returns a random alphanumeric string of the given length.
+func randomString(length int) string {
+	const chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	random := make([]byte, length)
+	_, err := crand.Read(random)
+	if err != nil {
+		panic("Couldn't get enough randomness from crypto/rand")
+	}
+	for i, b := range random {
+		random[i] = chars[int(b)%len(chars)]
+	}
+	return string(random)
+}
+
+// AlgorithmPBKDF2 is the algorithm used to derive keys from passphrases.
+const AlgorithmPBKDF2 = "m.pbkdf2"
+
+// DefaultPassphraseIterations is the number of PBKDF2 iterations used by
+// NewPassphraseInfo.
+const DefaultPassphraseIterations = 500000
+
+// PassphraseInfo describes how a key was derived from a passphrase, as stored
+// in the passphrase of a secret storage key description.
+type PassphraseInfo struct {
+	Algorithm  string `json:"algorithm"`
+	Salt       string `json:"salt"`
+	Iterations int    `json:"iterations"`
+	Bits       int    `json:"bits,omitempty"`
+}
+
+// NewPassphraseInfo returns a PassphraseInfo using AlgorithmPBKDF2 with a new
+// random salt.
+func NewPassphraseInfo(iterations int) *PassphraseInfo {
+	return &PassphraseInfo{
+		Algorithm:  AlgorithmPBKDF2,
+		Salt:       randomString(32),
+		Iterations: iterations,
+		Bits:       recoveryKeyLen * 8,
+	}
+}
+
+// Key derives the key from the passphrase.  Returns error on failure.  If the
+// algorithm isn't AlgorithmPBKDF2 or the parameters are invalid an error is
+// returned.
+func (p *PassphraseInfo) Key(passphrase string) ([]byte, error) {
+	if p.Algorithm != AlgorithmPBKDF2 {
+		return nil, fmt.Errorf("Unsupported passphrase algorithm %s", p.Algorithm)
+	}
+	if p.Iterations <= 0 {
+		return nil, fmt.Errorf("Invalid number of iterations %d", p.Iterations)
+	}
+	bits := p.Bits
+	if bits == 0 {
+		bits = recoveryKeyLen * 8
+	}
+	if bits%8 != 0 {
+		return nil, fmt.Errorf("Invalid number of bits %d", bits)
+	}
+	return pbkdf2.Key([]byte(passphrase), []byte(p.Salt), p.Iterations, bits/8, sha512.New), nil
+}
+
+// BackupKeyFromRecoveryKey loads a BackupKey from its recovery key.  Returns
+// error on failure.
+func BackupKeyFromRecoveryKey(recoveryKey string) (*BackupKey, error) {
+	key, err := DecodeRecoveryKey(recoveryKey)
+	if err != nil {
+		return nil, err
+	}
+	return BackupKeyFromBytes(key)
+}
+
+// RecoveryKey returns the private key of the BackupKey encoded as a recovery
+// key.
+func (k *BackupKey) RecoveryKey() string {
+	recoveryKey, err := EncodeRecoveryKey(k.privateKey[:])
+	if err != nil {
+		panic(err)
+	}
+	return recoveryKey
+}
+
+// NewBackupKeyFromPassphrase derives a new BackupKey from a passphrase with a
+// random salt.  The salt and iterations are included in the AuthData of the
+// key so that the passphrase can be used to restore the backup.
+func NewBackupKeyFromPassphrase(passphrase string, iterations int) (*BackupKey, error) {
+	p := NewPassphraseInfo(iterations)
+	key, err := p.Key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	k, err := BackupKeyFromBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	k.passphrase = p
+	return k, nil
+}
+
+// BackupKeyFromPassphrase derives a BackupKey from a passphrase using the
+// private_key_salt and private_key_iterations of the backup's auth_data.
+// Returns error on failure.
+func BackupKeyFromPassphrase(passphrase string, authData *BackupAuthData) (*BackupKey, error) {
+	if len(authData.PrivateKeySalt) == 0 {
+		return nil, fmt.Errorf("Backup has no passphrase")
+	}
+	p := PassphraseInfo{
+		Algorithm:  AlgorithmPBKDF2,
+		Salt:       authData.PrivateKeySalt,
+		Iterations: authData.PrivateKeyIterations,
+		Bits:       authData.PrivateKeyBits,
+	}
+	key, err := p.Key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	k, err := BackupKeyFromBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	if k.PublicKey() != authData.PublicKey {
+		return nil, fmt.Errorf("Passphrase doesn't match the backup public key")
+	}
+	k.passphrase = &p
+	return k, nil
+}
@@ -0,0 +1,103 @@
+package olm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestRecoveryKey(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	expected := "EsSz ykH7 LCZx 7Cae cmKD wcmY JRXi Ybtu 8iQ3 t8Ez nRwK pUY1"
+	recoveryKey, err := EncodeRecoveryKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recoveryKey != expected {
+		t.Fatalf("EncodeRecoveryKey() = \"%s\" != \"%s\"", recoveryKey, expected)
+	}
+
+	decoded, err := DecodeRecoveryKey(strings.Replace(recoveryKey, " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, key) {
+		t.Fatal("DecodeRecoveryKey(EncodeRecoveryKey()) != key")
+	}
+
+	// Flip a character so that the parity byte doesn't match
+	_, err = DecodeRecoveryKey("EsSz ykH7 LCZx 7Cae cmKD wcmY JRXi Ybtu 8iQ3 t8Ez nRwK pUY2")
+	if err == nil || !strings.Contains(err.Error(), "parity") {
+		t.Fatal("DecodeRecoveryKey() with a bad parity byte should fail, got", err)
+	}
+
+	// Wrong prefix
+	_, err = DecodeRecoveryKey(base58Encode(append([]byte{0x8B, 0x02}, make([]byte, 33)...)))
+	if err == nil || !strings.Contains(err.Error(), "prefix") {
+		t.Fatal("DecodeRecoveryKey() with a bad prefix should fail, got", err)
+	}
+
+	// Wrong length
+	_, err = DecodeRecoveryKey("EsSz ykH7")
+	if err == nil || !strings.Contains(err.Error(), "length") {
+		t.Fatal("DecodeRecoveryKey() of a short key should fail, got", err)
+	}
+
+	// Not base58
+	_, err = DecodeRecoveryKey("EsSz ykH0")
+	if err == nil || !strings.Contains(err.Error(), "base58") {
+		t.Fatal("DecodeRecoveryKey() of invalid base58 should fail, got", err)
+	}
+
+	k := NewBackupKey()
+	k2, err := BackupKeyFromRecoveryKey(k.RecoveryKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.PublicKey() != k2.PublicKey() {
+		t.Fatal("BackupKeyFromRecoveryKey(k.RecoveryKey()) has a different public key")
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	p := &PassphraseInfo{Algorithm: AlgorithmPBKDF2, Salt: "saltsalt", Iterations: 1000}
+	key, err := p.Key("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "8b27903b51cf52d89b1de4b5708cd6b18e0116f69e769a19f9d56a5f5f5f8ba1"
+	if hex.EncodeToString(key) != expected {
+		t.Fatalf("Key() = %x != %s", key, expected)
+	}
+
+	p.Algorithm = "m.unknown"
+	_, err = p.Key("passphrase")
+	if err == nil {
+		t.Fatal("Key() with an unknown algorithm should fail")
+	}
+
+	k, err := NewBackupKeyFromPassphrase("passphrase", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authData := &BackupAuthData{
+		PublicKey:            k.PublicKey(),
+		PrivateKeySalt:       k.passphrase.Salt,
+		PrivateKeyIterations: k.passphrase.Iterations,
+	}
+	k2, err := BackupKeyFromPassphrase("passphrase", authData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(k.Bytes(), k2.Bytes()) {
+		t.Fatal("BackupKeyFromPassphrase() returned a different key")
+	}
+	_, err = BackupKeyFromPassphrase("wrong", authData)
+	if err == nil {
+		t.Fatal("BackupKeyFromPassphrase() with a wrong passphrase should fail")
+	}
+}
@@ -0,0 +1,152 @@
+package olm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultRotationBatchSize is the default number of pickles stored in each
+// transaction by RotatePickleKey.
+const DefaultRotationBatchSize = 100
+
+// PickleStore is a persistent store of pickled Accounts, Sessions and group
+// sessions, such as a database table, as used by RotatePickleKey.
+type PickleStore interface {
+	// PickleIDs returns the IDs of the stored pickles of type t.
+	PickleIDs(t PickleType) ([]string, error)
+	// LoadPickle returns the pickle of type t with the ID id.
+	LoadPickle(t PickleType, id string) (string, error)
+	// StorePickles replaces the pickles of type t by ID in a single
+	// transaction: either all of them are stored or none is.
+	StorePickles(t PickleType, pickles map[string]string) error
+}
+
+// PickleKeyRotation reports the progress of RotatePickleKey.
+type PickleKeyRotation struct {
+	// Rotated is the number of pickles of each type re-encrypted with the new
+	// key.
+	Rotated map[PickleType]int
+	// AlreadyRotated is the number of pickles of each type that were already
+	// encrypted with the new key, by an earlier interrupted rotation.
+	AlreadyRotated map[PickleType]int
+}
+
+// rotationTypes are the types of pickles rotated by RotatePickleKey, in order.
+var rotationTypes = []PickleType{
+	PickleTypeAccount,
+	PickleTypeSession,
+	PickleTypeOutboundGroupSession,
+	PickleTypeInboundGroupSession,
+}
+
+// RotatePickleKey re-encrypts every pickle of the store from oldPickleKey to
+// newPickleKey.  The pickles are re-encrypted without constructing the
+// objects, after checking that each one holds an object of its type.  Every
+// pickle is first checked, and nothing is stored if one of them can't be
+// decrypted with either key.  The pickles are then stored in transactions of
+// batchSize pickles, or DefaultRotationBatchSize if batchSize isn't positive.
+// Pickles already encrypted with newPickleKey are skipped, so an interrupted
+// rotation is resumed by calling RotatePickleKey again with the same keys.
+// Pickles stored with an empty key are rotated with InsecureNoPickleKey as
+// oldPickleKey.  Returns the progress so far and error on failure.
+func RotatePickleKey(store PickleStore, oldPickleKey, newPickleKey *PickleKey, batchSize int) (*PickleKeyRotation, error) {
+	oldKey, err := oldPickleKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(oldKey)
+	newKey, err := newPickleKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(newKey)
+	if batchSize <= 0 {
+		batchSize = DefaultRotationBatchSize
+	}
+	progress := &PickleKeyRotation{
+		Rotated:        map[PickleType]int{},
+		AlreadyRotated: map[PickleType]int{},
+	}
+
+	pending := map[PickleType][]string{}
+	for _, t := range rotationTypes {
+		ids, err := store.PickleIDs(t)
+		if err != nil {
+			return progress, err
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			pickled, err := store.LoadPickle(t, id)
+			if err != nil {
+				return progress, err
+			}
+			rotated, err := checkRotation(t, pickled, oldKey, newKey)
+			if err != nil {
+				return progress, fmt.Errorf("Can't rotate the key of %s %s: %v", t, id, err)
+			}
+			if rotated {
+				progress.AlreadyRotated[t]++
+			} else {
+				pending[t] = append(pending[t], id)
+			}
+		}
+	}
+
+	for _, t := range rotationTypes {
+		ids := pending[t]
+		for len(ids) > 0 {
+			n := batchSize
+			if n > len(ids) {
+				n = len(ids)
+			}
+			batch := map[string]string{}
+			for _, id := range ids[:n] {
+				pickled, err := store.LoadPickle(t, id)
+				if err != nil {
+					return progress, err
+				}
+				repickled, err := repickle(t, pickled, oldKey, newKey)
+				if err != nil {
+					return progress, fmt.Errorf("Can't rotate the key of %s %s: %v", t, id, err)
+				}
+				batch[id] = repickled
+			}
+			err := store.StorePickles(t, batch)
+			if err != nil {
+				return progress, err
+			}
+			progress.Rotated[t] += n
+			ids = ids[n:]
+		}
+	}
+	return progress, nil
+}
+
+// checkRotation returns true if the pickle is already encrypted with newKey,
+// or false if it's encrypted with oldKey.  Returns error if it can't be
+// decrypted with either key or doesn't hold an object of type t.
+func checkRotation(t PickleType, pickled string, oldKey, newKey []byte) (bool, error) {
+	_, err := InspectPickleAs(t, pickled, newKey)
+	if err == nil {
+		return true, nil
+	}
+	if err.Error() != "BAD_ACCOUNT_KEY" {
+		return false, err
+	}
+	_, err = InspectPickleAs(t, pickled, oldKey)
+	return false, err
+}
+
+// repickle re-encrypts a pickle of type t from oldKey to newKey.
+func repickle(t PickleType, pickled string, oldKey, newKey []byte) (string, error) {
+	plaintext, err := pickleDecrypt(pickled, oldKey)
+	if err != nil {
+		return "", err
+	}
+	defer clearBytes(plaintext)
+	_, err = inspectPickle(t, plaintext)
+	if err != nil {
+		return "", err
+	}
+	return pickleEncrypt(plaintext, newKey), nil
+}
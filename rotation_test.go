@@ -0,0 +1,168 @@
+package olm
+
+import (
+	"fmt"
+	"testing"
+)
+
+// memoryPickleStore is a PickleStore whose StorePickles fails after failAfter
+// successful transactions, if failAfter is positive.
+type memoryPickleStore struct {
+	pickles   map[PickleType]map[string]string
+	stores    int
+	failAfter int
+}
+
+func (s *memoryPickleStore) PickleIDs(t PickleType) ([]string, error) {
+	var ids []string
+	for id := range s.pickles[t] {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *memoryPickleStore) LoadPickle(t PickleType, id string) (string, error) {
+	pickled, ok := s.pickles[t][id]
+	if !ok {
+		return "", fmt.Errorf("No %s %s", t, id)
+	}
+	return pickled, nil
+}
+
+func (s *memoryPickleStore) StorePickles(t PickleType, pickles map[string]string) error {
+	if s.failAfter > 0 && s.stores >= s.failAfter {
+		return fmt.Errorf("Interrupted")
+	}
+	s.stores++
+	for id, pickled := range pickles {
+		s.pickles[t][id] = pickled
+	}
+	return nil
+}
+
+func TestRotatePickleKey(t *testing.T) {
+	oldKey := []byte("old key")
+	newKey := []byte("new key")
+	oldPickleKey, _ := NewPickleKey(oldKey)
+	newPickleKey, _ := NewPickleKey(newKey)
+	store := &memoryPickleStore{pickles: map[PickleType]map[string]string{
+		PickleTypeAccount: {"@alice:example.org/ALICE": pickleEncrypt(testAccountPickle(AccountPickleVersion), oldKey)},
+		PickleTypeSession: {},
+	}}
+	for i := 0; i < 5; i++ {
+		store.pickles[PickleTypeSession][fmt.Sprint(i)] = pickleEncrypt(testSessionPickle(SessionPickleVersion), oldKey)
+	}
+
+	// A pickle encrypted with an unknown key aborts the rotation before
+	// anything is stored.
+	store.pickles[PickleTypeSession]["bad"] = pickleEncrypt(testSessionPickle(SessionPickleVersion), []byte("other key"))
+	_, err := RotatePickleKey(store, oldPickleKey, newPickleKey, 2)
+	if err == nil || store.stores != 0 {
+		t.Fatal("RotatePickleKey() should fail without storing anything, got", err)
+	}
+	delete(store.pickles[PickleTypeSession], "bad")
+
+	// Interrupt the rotation after the account and the first two sessions.
+	store.failAfter = 2
+	progress, err := RotatePickleKey(store, oldPickleKey, newPickleKey, 2)
+	if err == nil {
+		t.Fatal("RotatePickleKey() should fail when interrupted")
+	}
+	if progress.Rotated[PickleTypeAccount] != 1 || progress.Rotated[PickleTypeSession] != 2 {
+		t.Fatal("Wrong progress after interruption", progress)
+	}
+
+	store.failAfter = 0
+	progress, err = RotatePickleKey(store, oldPickleKey, newPickleKey, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.AlreadyRotated[PickleTypeAccount] != 1 || progress.AlreadyRotated[PickleTypeSession] != 2 || progress.Rotated[PickleTypeSession] != 3 {
+		t.Fatal("Wrong progress after resuming", progress)
+	}
+	for tp, pickles := range store.pickles {
+		for id, pickled := range pickles {
+			if _, err := InspectPickleAs(tp, pickled, newKey); err != nil {
+				t.Fatal(tp, id, "wasn't rotated:", err)
+			}
+		}
+	}
+
+	progress, err = RotatePickleKey(store, oldPickleKey, newPickleKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(progress.Rotated) != 0 || progress.AlreadyRotated[PickleTypeSession] != 5 {
+		t.Fatal("Nothing should be left to rotate", progress)
+	}
+
+	if _, err := RotatePickleKey(store, &PickleKey{}, newPickleKey, 0); err == nil {
+		t.Fatal("RotatePickleKey() should refuse an empty key")
+	}
+}
+
+func TestRotateLibolmPickleKey(t *testing.T) {
+	oldKey := []byte("old key")
+	newKey := []byte("new key")
+	oldPickleKey, _ := NewPickleKey(oldKey)
+	newPickleKey, _ := NewPickleKey(newKey)
+	a := NewAccount()
+	outbound := NewOutboundGroupSession()
+	store := &memoryPickleStore{pickles: map[PickleType]map[string]string{
+		PickleTypeAccount:              {"ALICE": a.Pickle(oldKey)},
+		PickleTypeOutboundGroupSession: {string(outbound.ID()): outbound.Pickle(oldKey)},
+	}}
+	_, err := RotatePickleKey(store, oldPickleKey, newPickleKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := AccountFromPickled(store.pickles[PickleTypeAccount]["ALICE"], newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.IdentityKeysJSON() != a.IdentityKeysJSON() {
+		t.Fatal("Rotated account doesn't match")
+	}
+	rotatedOutbound, err := OutboundGroupSessionFromPickled(store.pickles[PickleTypeOutboundGroupSession][string(outbound.ID())], newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotatedOutbound.ID() != outbound.ID() {
+		t.Fatal("Rotated outbound group session doesn't match")
+	}
+}
+
+func TestRotateInsecurePickleKey(t *testing.T) {
+	newKey := []byte("new key")
+	newPickleKey, _ := NewPickleKey(newKey)
+	a := NewAccount()
+	// The bindings pickle with " " when the key is empty.
+	store := &memoryPickleStore{pickles: map[PickleType]map[string]string{
+		PickleTypeAccount: {"ALICE": a.Pickle(nil), "BOB": a.Pickle([]byte(" "))},
+	}}
+	if _, err := InspectPickle(store.pickles[PickleTypeAccount]["ALICE"], nil); err != nil {
+		t.Fatal("InspectPickle() failed with an empty key", err)
+	}
+	_, err := RotatePickleKey(store, InsecureNoPickleKey, newPickleKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, pickled := range store.pickles[PickleTypeAccount] {
+		rotated, err := AccountFromPickled(pickled, newKey)
+		if err != nil {
+			t.Fatal(id, err)
+		}
+		if rotated.IdentityKeysJSON() != a.IdentityKeysJSON() {
+			t.Fatal("Rotated account doesn't match", id)
+		}
+	}
+
+	// And back again.
+	_, err = RotatePickleKey(store, newPickleKey, InsecureNoPickleKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.pickles[PickleTypeAccount]["ALICE"] != a.Pickle(nil) {
+		t.Fatal("Pickle rotated to InsecureNoPickleKey doesn't match")
+	}
+}
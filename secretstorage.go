@@ -0,0 +1,314 @@
+package olm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// AlgorithmSecretStorageV1 is the algorithm of secret storage keys whose
+// secrets are encrypted with AES-256-CTR and authenticated with HMAC-SHA-256.
+const AlgorithmSecretStorageV1 = "m.secret_storage.v1.aes-hmac-sha2"
+
+// Names of the secrets stored in secret storage.
+const (
+	SecretCrossSigningMaster      = "m.cross_signing.master"
+	SecretCrossSigningSelfSigning = "m.cross_signing.self_signing"
+	SecretCrossSigningUserSigning = "m.cross_signing.user_signing"
+	SecretMegolmBackupV1          = "m.megolm_backup.v1"
+)
+
+// Account data event types used by secret storage.
+const (
+	SecretStorageDefaultKeyType = "m.secret_storage.default_key"
+	// SecretStorageKeyTypePrefix is followed by the ID of the key.
+	SecretStorageKeyTypePrefix = "m.secret_storage.key."
+)
+
+// SecretStorageKeyDescription is the content of the m.secret_storage.key.<id>
+// account data event describing a secret storage key.
+type SecretStorageKeyDescription struct {
+	Name       string          `json:"name,omitempty"`
+	Algorithm  string          `json:"algorithm"`
+	Passphrase *PassphraseInfo `json:"passphrase,omitempty"`
+	IV         string          `json:"iv,omitempty"`
+	MAC        string          `json:"mac,omitempty"`
+}
+
+// SecretStorageDefaultKey is the content of the m.secret_storage.default_key
+// account data event.
+type SecretStorageDefaultKey struct {
+	Key string `json:"key"`
+}
+
+// EncryptedSecret is a secret encrypted with a secret storage key.
+type EncryptedSecret struct {
+	IV         string `json:"iv"`
+	Ciphertext string `json:"ciphertext"`
+	MAC        string `json:"mac"`
+}
+
+// EncryptedSecretContent is the content of the account data event holding a
+// secret, mapping from secret storage key ID to encrypted secret.
+type EncryptedSecretContent struct {
+	Encrypted map[string]*EncryptedSecret `json:"encrypted"`
+}
+
+// SecretStorageKey stores a secret storage key and its description.
+type SecretStorageKey struct {
+	ID          string
+	Description *SecretStorageKeyDescription
+	key         []byte
+}
+
+// NewSecretStorageKey creates a new random secret storage key with a random
+// ID.  name is the human readable name stored in the key description.
+func NewSecretStorageKey(name string) *SecretStorageKey {
+	key := make([]byte, 32)
+	_, err := crand.Read(key)
+	if err != nil {
+		panic("Couldn't get enough randomness from crypto/rand")
+	}
+	return newSecretStorageKey(name, key, nil)
+}
+
+// NewSecretStorageKeyFromPassphrase derives a new secret storage key with a
+// random ID from the passphrase.  The passphrase parameters are stored in the
+// key description.  Returns error on failure.
+func NewSecretStorageKeyFromPassphrase(name, passphrase string, iterations int) (*SecretStorageKey, error) {
+	p := NewPassphraseInfo(iterations)
+	key, err := p.Key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return newSecretStorageKey(name, key, p), nil
+}
+
+// newSecretStorageKey creates the description of the key and returns the
+// SecretStorageKey.
+func newSecretStorageKey(name string, key []byte, passphrase *PassphraseInfo) *SecretStorageKey {
+	k := &SecretStorageKey{
+		ID: randomString(32),
+		Description: &SecretStorageKeyDescription{
+			Name:       name,
+			Algorithm:  AlgorithmSecretStorageV1,
+			Passphrase: passphrase,
+		},
+		key: key,
+	}
+	check, err := k.Encrypt("", string(make([]byte, 32)))
+	if err != nil {
+		panic(err)
+	}
+	k.Description.IV = check.IV
+	k.Description.MAC = check.MAC
+	return k
+}
+
+// SecretStorageKeyFromBytes loads the secret storage key with the ID id and
+// the description d from the raw key.  Returns error on failure.  If the key
+// doesn't match the iv and mac of the description the error will be
+// "BAD_MESSAGE_MAC".
+func SecretStorageKeyFromBytes(id string, d *SecretStorageKeyDescription, key []byte) (*SecretStorageKey, error) {
+	k := &SecretStorageKey{ID: id, Description: d, key: key}
+	err := k.verify()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// SecretStorageKeyFromRecoveryKey loads the secret storage key with the ID id
+// and the description d from its recovery key.  Returns error on failure.
+func SecretStorageKeyFromRecoveryKey(id string, d *SecretStorageKeyDescription, recoveryKey string) (*SecretStorageKey, error) {
+	key, err := DecodeRecoveryKey(recoveryKey)
+	if err != nil {
+		return nil, err
+	}
+	return SecretStorageKeyFromBytes(id, d, key)
+}
+
+// SecretStorageKeyFromPassphrase derives the secret storage key with the ID id
+// and the description d from the passphrase.  Returns error on failure.
+func SecretStorageKeyFromPassphrase(id string, d *SecretStorageKeyDescription, passphrase string) (*SecretStorageKey, error) {
+	if d.Passphrase == nil {
+		return nil, fmt.Errorf("Secret storage key has no passphrase")
+	}
+	key, err := d.Passphrase.Key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return SecretStorageKeyFromBytes(id, d, key)
+}
+
+// verify checks the key against the iv and mac of its description.  Keys
+// whose description has no iv and mac are accepted.
+func (k *SecretStorageKey) verify() error {
+	if k.Description.Algorithm != AlgorithmSecretStorageV1 {
+		return fmt.Errorf("Unsupported secret storage algorithm %s", k.Description.Algorithm)
+	}
+	if len(k.Description.IV) == 0 && len(k.Description.MAC) == 0 {
+		return nil
+	}
+	iv, err := decodeBase64(k.Description.IV)
+	if err != nil {
+		return err
+	}
+	if len(iv) != aes.BlockSize {
+		return fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	aesKey, hmacKey, err := secretStorageKeys(k.key, "")
+	if err != nil {
+		return err
+	}
+	mac, err := secretStorageMAC(hmacKey, secretStorageCrypt(aesKey, iv, make([]byte, 32)))
+	if err != nil {
+		return err
+	}
+	expected, err := decodeBase64(k.Description.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, expected) {
+		return fmt.Errorf("BAD_MESSAGE_MAC")
+	}
+	return nil
+}
+
+// Bytes returns the raw secret storage key.
+func (k *SecretStorageKey) Bytes() []byte {
+	key := make([]byte, len(k.key))
+	copy(key, k.key)
+	return key
+}
+
+// RecoveryKey returns the secret storage key encoded as a recovery key.
+func (k *SecretStorageKey) RecoveryKey() string {
+	recoveryKey, err := EncodeRecoveryKey(k.key)
+	if err != nil {
+		panic(err)
+	}
+	return recoveryKey
+}
+
+// secretStorageKeys derives the AES and HMAC keys used to encrypt the secret
+// called name.
+func secretStorageKeys(key []byte, name string) (aesKey, hmacKey []byte, err error) {
+	keys := make([]byte, 64)
+	_, err = io.ReadFull(hkdf.New(sha256.New, key, make([]byte, 32), []byte(name)), keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// secretStorageCrypt encrypts or decrypts the input with AES-256-CTR.
+func secretStorageCrypt(aesKey, iv, input []byte) []byte {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		panic(err)
+	}
+	output := make([]byte, len(input))
+	cipher.NewCTR(block, iv).XORKeyStream(output, input)
+	return output
+}
+
+// secretStorageMAC returns the HMAC-SHA-256 of the cipher-text.
+func secretStorageMAC(hmacKey, ciphertext []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, hmacKey)
+	_, err := mac.Write(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return mac.Sum(nil), nil
+}
+
+// Encrypt encrypts the secret called name.  Secrets which are keys, such as
+// the cross-signing private keys, are stored as unpadded base64.  Returns
+// error on failure.
+func (k *SecretStorageKey) Encrypt(name, secret string) (*EncryptedSecret, error) {
+	aesKey, hmacKey, err := secretStorageKeys(k.key, name)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	_, err = crand.Read(iv)
+	if err != nil {
+		panic("Couldn't get enough randomness from crypto/rand")
+	}
+	// Clear bit 63 of the counter so that it can't overflow on platforms
+	// which only use the lower 64 bits.
+	iv[8] &= 0x7f
+	ciphertext := secretStorageCrypt(aesKey, iv, []byte(secret))
+	mac, err := secretStorageMAC(hmacKey, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedSecret{
+		IV:         base64.StdEncoding.EncodeToString(iv),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+		MAC:        base64.StdEncoding.EncodeToString(mac),
+	}, nil
+}
+
+// Decrypt decrypts the secret called name.  Returns error on failure.  If the
+// base64 couldn't be decoded then the error will be "INVALID_BASE64".  If the
+// MAC didn't match, because the key or name are wrong or the secret was
+// modified, then the error will be "BAD_MESSAGE_MAC".
+func (k *SecretStorageKey) Decrypt(name string, secret *EncryptedSecret) (string, error) {
+	iv, err := decodeBase64(secret.IV)
+	if err != nil {
+		return "", err
+	}
+	if len(iv) != aes.BlockSize {
+		return "", fmt.Errorf("BAD_MESSAGE_FORMAT")
+	}
+	ciphertext, err := decodeBase64(secret.Ciphertext)
+	if err != nil {
+		return "", err
+	}
+	expected, err := decodeBase64(secret.MAC)
+	if err != nil {
+		return "", err
+	}
+	aesKey, hmacKey, err := secretStorageKeys(k.key, name)
+	if err != nil {
+		return "", err
+	}
+	mac, err := secretStorageMAC(hmacKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(mac, expected) {
+		return "", fmt.Errorf("BAD_MESSAGE_MAC")
+	}
+	return string(secretStorageCrypt(aesKey, iv, ciphertext)), nil
+}
+
+// EncryptContent encrypts the secret called name and returns the content of
+// its account data event.  Returns error on failure.
+func (k *SecretStorageKey) EncryptContent(name, secret string) (*EncryptedSecretContent, error) {
+	encrypted, err := k.Encrypt(name, secret)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedSecretContent{Encrypted: map[string]*EncryptedSecret{k.ID: encrypted}}, nil
+}
+
+// DecryptContent decrypts the secret called name from the content of its
+// account data event.  Returns error on failure.  If the secret isn't
+// encrypted with this key an error is returned.
+func (k *SecretStorageKey) DecryptContent(name string, content *EncryptedSecretContent) (string, error) {
+	encrypted, ok := content.Encrypted[k.ID]
+	if !ok {
+		return "", fmt.Errorf("Secret %s isn't encrypted with key %s", name, k.ID)
+	}
+	return k.Decrypt(name, encrypted)
+}
@@ -0,0 +1,96 @@
+package olm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSecretStorageKeyDescription(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	d := &SecretStorageKeyDescription{
+		Algorithm: AlgorithmSecretStorageV1,
+		IV:        "AAAAAAAAAAAAAAAAAAAAAA==",
+		MAC:       "Gv+0yDqPNdj9zSgvL1FUew0ODALBHY/PO5cLnkGX55w=",
+	}
+	_, err := SecretStorageKeyFromBytes("KEYID", d, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key[0] = 0xff
+	_, err = SecretStorageKeyFromBytes("KEYID", d, key)
+	if err == nil || err.Error() != "BAD_MESSAGE_MAC" {
+		t.Fatal("SecretStorageKeyFromBytes() with a wrong key should fail with BAD_MESSAGE_MAC, got", err)
+	}
+
+	// An IV of the wrong length must fail, not panic.
+	d.IV, d.MAC = "AAAA", "AAAA"
+	_, err = SecretStorageKeyFromBytes("KEYID", d, key)
+	if err == nil || err.Error() != "BAD_MESSAGE_FORMAT" {
+		t.Fatal("SecretStorageKeyFromBytes() with a short IV should fail with BAD_MESSAGE_FORMAT, got", err)
+	}
+}
+
+func TestSecretStorage(t *testing.T) {
+	k := NewSecretStorageKey("Default key")
+	t.Log("ID:", k.ID, "Description:", k.Description)
+
+	secret := "ZW5jcnlwdGVkIGNyb3NzLXNpZ25pbmcga2V5"
+	content, err := k.EncryptContent(SecretCrossSigningMaster, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := k.DecryptContent(SecretCrossSigningMaster, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != secret {
+		t.Fatalf("DecryptContent(EncryptContent(\"%s\")) = \"%s\"", secret, decrypted)
+	}
+
+	// The secret name is part of the key derivation
+	_, err = k.DecryptContent(SecretCrossSigningSelfSigning, content)
+	if err == nil || err.Error() != "BAD_MESSAGE_MAC" {
+		t.Fatal("DecryptContent() with a wrong name should fail with BAD_MESSAGE_MAC, got", err)
+	}
+
+	// Load the key from its recovery key
+	k2, err := SecretStorageKeyFromRecoveryKey(k.ID, k.Description, k.RecoveryKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err = k2.DecryptContent(SecretCrossSigningMaster, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != secret {
+		t.Fatal("Secret decrypted with the key loaded from the recovery key doesn't match")
+	}
+
+	// A different key doesn't match the description
+	_, err = SecretStorageKeyFromBytes(k.ID, k.Description, NewSecretStorageKey("").Bytes())
+	if err == nil {
+		t.Fatal("SecretStorageKeyFromBytes() with a different key should fail")
+	}
+}
+
+func TestSecretStoragePassphrase(t *testing.T) {
+	k, err := NewSecretStorageKeyFromPassphrase("Default key", "passphrase", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := SecretStorageKeyFromPassphrase(k.ID, k.Description, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(k.Bytes(), k2.Bytes()) {
+		t.Fatal("SecretStorageKeyFromPassphrase() returned a different key")
+	}
+	_, err = SecretStorageKeyFromPassphrase(k.ID, k.Description, "wrong")
+	if err == nil {
+		t.Fatal("SecretStorageKeyFromPassphrase() with a wrong passphrase should fail")
+	}
+}
@@ -0,0 +1,160 @@
+package olm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StoredSession is an Olm Session together with the metadata a SessionStore
+// uses to pick the preferred session with a device.
+type StoredSession struct {
+	Session      *Session
+	ID           SessionID
+	CreatedAt    time.Time
+	LastReceived time.Time
+	LastUsed     time.Time
+}
+
+// lastActivity returns the time of the last message received on the session,
+// or its creation time if that is later.  A new session is thus preferred
+// over older sessions until they receive another message.
+func (s *StoredSession) lastActivity() time.Time {
+	if s.LastReceived.After(s.CreatedAt) {
+		return s.LastReceived
+	}
+	return s.CreatedAt
+}
+
+// SessionStore stores the Olm Sessions with other devices by the Curve25519
+// identity key of the device.  It is safe for concurrent use.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[Curve25519][]*StoredSession
+	now      func() time.Time
+}
+
+// NewSessionStore creates an empty SessionStore.
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: map[Curve25519][]*StoredSession{}}
+}
+
+// clock returns the current time.
+func (st *SessionStore) clock() time.Time {
+	if st.now != nil {
+		return st.now()
+	}
+	return time.Now()
+}
+
+// Add stores a new Session with the device whose identity key is theirKey.
+func (st *SessionStore) Add(theirKey Curve25519, s *Session) *StoredSession {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stored := &StoredSession{Session: s, ID: s.ID(), CreatedAt: st.clock()}
+	st.sessions[theirKey] = append(st.sessions[theirKey], stored)
+	return stored
+}
+
+// Sessions returns the Sessions with the device whose identity key is
+// theirKey, the preferred one first.
+func (st *SessionStore) Sessions(theirKey Curve25519) []*StoredSession {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.sorted(theirKey)
+}
+
+// sorted returns a copy of the Sessions with theirKey, sorted by most recent
+// activity and then by session ID.
+func (st *SessionStore) sorted(theirKey Curve25519) []*StoredSession {
+	sessions := append([]*StoredSession(nil), st.sessions[theirKey]...)
+	sort.SliceStable(sessions, func(i, j int) bool {
+		ai, aj := sessions[i].lastActivity(), sessions[j].lastActivity()
+		if !ai.Equal(aj) {
+			return ai.After(aj)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// Preferred returns the Session to use to encrypt to the device whose
+// identity key is theirKey: the one that most recently received a message,
+// unless a Session was created after that.  Ties are broken by the lowest
+// session ID.  Returns nil if there is no Session with the device.
+func (st *SessionStore) Preferred(theirKey Curve25519) *StoredSession {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sessions := st.sorted(theirKey)
+	if len(sessions) == 0 {
+		return nil
+	}
+	return sessions[0]
+}
+
+// Encrypt encrypts a message to the device whose identity key is theirKey
+// with the preferred Session.  Returns error if there is no Session with the
+// device.
+func (st *SessionStore) Encrypt(theirKey Curve25519, plaintext string) (MsgType, string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sessions := st.sorted(theirKey)
+	if len(sessions) == 0 {
+		return 0, "", fmt.Errorf("No session with %s", theirKey)
+	}
+	preferred := sessions[0]
+	msgType, message := preferred.Session.Encrypt(plaintext)
+	preferred.LastUsed = st.clock()
+	return msgType, message, nil
+}
+
+// Decrypt decrypts a message from the device whose identity key is theirKey
+// with the stored Sessions.  PRE_KEY messages are only tried on the Session
+// they match.  The Session which decrypted the message becomes the preferred
+// one.  Returns error on failure.  If no Session could decrypt the message
+// then the error of the preferred Session is returned.
+func (st *SessionStore) Decrypt(theirKey Curve25519, message string, msgType MsgType) (string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var firstErr error
+	for _, stored := range st.sorted(theirKey) {
+		if msgType == MsgTypePreKey {
+			matches, err := stored.Session.MatchesInboundSessionFrom(string(theirKey), message)
+			if err != nil {
+				return "", err
+			}
+			if !matches {
+				continue
+			}
+		}
+		plaintext, err := stored.Session.Decrypt(message, msgType)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		stored.LastReceived = st.clock()
+		return plaintext, nil
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("No session with %s matches the message", theirKey)
+	}
+	return "", firstErr
+}
+
+// Remove removes the Session with the ID id with the device whose identity
+// key is theirKey.  Returns false if there is no such Session.
+func (st *SessionStore) Remove(theirKey Curve25519, id SessionID) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sessions := st.sessions[theirKey]
+	for i, stored := range sessions {
+		if stored.ID == id {
+			st.sessions[theirKey] = append(sessions[:i:i], sessions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
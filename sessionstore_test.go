@@ -0,0 +1,109 @@
+package olm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionStorePreferred(t *testing.T) {
+	st := NewSessionStore()
+	theirKey := Curve25519("theirkey")
+	if st.Preferred(theirKey) != nil {
+		t.Fatal("Empty store shouldn't have a preferred session")
+	}
+	base := time.Unix(1500000000, 0)
+	old := &StoredSession{ID: "b", CreatedAt: base, LastReceived: base.Add(time.Minute)}
+	newer := &StoredSession{ID: "c", CreatedAt: base.Add(2 * time.Minute)}
+	tied := &StoredSession{ID: "a", CreatedAt: base.Add(2 * time.Minute)}
+	st.sessions[theirKey] = []*StoredSession{old, newer, tied}
+
+	if p := st.Preferred(theirKey); p != tied {
+		t.Fatal("Expected the newest session with the lowest ID, got", p.ID)
+	}
+	old.LastReceived = base.Add(3 * time.Minute)
+	if p := st.Preferred(theirKey); p != old {
+		t.Fatal("Expected the session that last received a message, got", p.ID)
+	}
+	sessions := st.Sessions(theirKey)
+	if len(sessions) != 3 || sessions[0] != old || sessions[1] != tied || sessions[2] != newer {
+		t.Fatal("Sessions() should be sorted by preference")
+	}
+	if !st.Remove(theirKey, "b") || st.Remove(theirKey, "b") {
+		t.Fatal("Remove() should remove the session exactly once")
+	}
+	if p := st.Preferred(theirKey); p != tied {
+		t.Fatal("Expected the newest session after removal, got", p.ID)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	alice := NewAccount()
+	bob := NewAccount()
+	_, aliceKey := alice.IdentityKeys()
+	_, bobKey := bob.IdentityKeys()
+	bob.GenOneTimeKeys(2)
+	otks := bob.OneTimeKeys().Curve25519
+	bob.MarkKeysAsPublished()
+
+	now := time.Unix(1500000000, 0)
+	aliceStore := NewSessionStore()
+	aliceStore.now = func() time.Time { return now }
+	bobStore := NewSessionStore()
+	bobStore.now = func() time.Time { return now }
+
+	var first, second *Session
+	for _, otk := range otks {
+		s, err := alice.NewOutboundSession(bobKey, otk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = s
+		} else {
+			second = s
+		}
+	}
+	aliceStore.Add(bobKey, first)
+	now = now.Add(time.Second)
+	aliceStore.Add(bobKey, second)
+	if aliceStore.Preferred(bobKey).Session != second {
+		t.Fatal("Newest session should be preferred")
+	}
+
+	// Bob receives a message on the first session and replies on it.
+	msgType, msg := first.Encrypt("Hello")
+	if _, err := bobStore.Decrypt(aliceKey, msg, msgType); err == nil {
+		t.Fatal("Decrypt() should fail without a matching session")
+	}
+	inbound, err := bob.NewInboundSessionFrom(aliceKey, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.RemoveOneTimeKeys(inbound)
+	bobStore.Add(aliceKey, inbound)
+	plaintext, err := bobStore.Decrypt(aliceKey, msg, msgType)
+	if err != nil || plaintext != "Hello" {
+		t.Fatal("Decrypt() failed", plaintext, err)
+	}
+	now = now.Add(time.Second)
+	msgType, msg, err = bobStore.Encrypt(aliceKey, "Hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bobStore.Preferred(aliceKey).LastUsed.Equal(now) {
+		t.Fatal("Encrypt() should update LastUsed")
+	}
+
+	now = now.Add(time.Second)
+	plaintext, err = aliceStore.Decrypt(bobKey, msg, msgType)
+	if err != nil || plaintext != "Hi" {
+		t.Fatal("Decrypt() failed", plaintext, err)
+	}
+	preferred := aliceStore.Preferred(bobKey)
+	if preferred.Session != first || !preferred.LastReceived.Equal(now) {
+		t.Fatal("Session that last received a message should be preferred")
+	}
+	if _, _, err := aliceStore.Encrypt("unknown", "Hello"); err == nil {
+		t.Fatal("Encrypt() should fail without a session")
+	}
+}
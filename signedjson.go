@@ -0,0 +1,147 @@
+package olm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fatih/structs"
+)
+
+// jsonObject returns a copy of the JSON object _obj as a map.  _obj can be a
+// struct, whose `json` tags are honored, a pointer to a struct, a
+// map[string]interface{} or the JSON encoding of an object as a
+// json.RawMessage or []byte.  Returns error for other types.
+func jsonObject(_obj interface{}) (map[string]interface{}, error) {
+	switch obj := _obj.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(obj))
+		for k, v := range obj {
+			copied[k] = v
+		}
+		return copied, nil
+	case json.RawMessage:
+		return decodeJSONObject(obj)
+	case []byte:
+		return decodeJSONObject(obj)
+	}
+	v := reflect.ValueOf(_obj)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("JSON object must be a struct or a map, not %T", _obj)
+	}
+	s := structs.New(_obj)
+	s.TagName = "json"
+	return s.Map(), nil
+}
+
+// decodeJSONObject decodes a JSON object, keeping its numbers as they are
+// written.
+func decodeJSONObject(data []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var obj map[string]interface{}
+	err := d.Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("JSON object is null")
+	}
+	return obj, nil
+}
+
+// signJSON signs the JSON object _obj following the Matrix specification with
+// the sign function and adds the signature under userID and keyID, keeping
+// any existing signatures.  _obj is any type accepted by jsonObject.
+func signJSON(_obj interface{}, userID, keyID string, sign func(message string) string) (map[string]interface{}, error) {
+	obj, err := jsonObject(_obj)
+	if err != nil {
+		return nil, err
+	}
+	signatures := Signatures{}
+	_signatures, ok := obj["signatures"]
+	if ok {
+		delete(obj, "signatures")
+		existing, err := toSignatures(_signatures)
+		if err != nil {
+			return nil, err
+		}
+		for signer, signerSignatures := range existing {
+			signatures[signer] = map[string]string{}
+			for signerKeyID, signature := range signerSignatures {
+				signatures[signer][signerKeyID] = signature
+			}
+		}
+	}
+	unsigned, ok := obj["unsigned"]
+	if ok {
+		delete(obj, "unsigned")
+	}
+	objJSON, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	signature := sign(string(objJSON))
+	if signatures[userID] == nil {
+		signatures[userID] = map[string]string{}
+	}
+	signatures[userID][keyID] = signature
+	obj["signatures"] = signatures
+	if unsigned != nil {
+		obj["unsigned"] = unsigned
+	}
+
+	return obj, nil
+}
+
+// toSignatures converts the value of the signatures key of a JSON object to
+// Signatures.  Returns error if the value is of an invalid type.
+func toSignatures(_signatures interface{}) (Signatures, error) {
+	switch signatures := _signatures.(type) {
+	case nil:
+		return Signatures{}, nil
+	case Signatures:
+		return signatures, nil
+	case map[string]map[string]string:
+		return Signatures(signatures), nil
+	case map[string]interface{}:
+		// Decoded from JSON.
+		converted := Signatures{}
+		for userID, _keys := range signatures {
+			keys, ok := _keys.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("signatures key of JSON object is an invalid type")
+			}
+			converted[userID] = map[string]string{}
+			for keyID, _signature := range keys {
+				signature, ok := _signature.(string)
+				if !ok {
+					return nil, fmt.Errorf("signatures key of JSON object is an invalid type")
+				}
+				converted[userID][keyID] = signature
+			}
+		}
+		return converted, nil
+	default:
+		return nil, fmt.Errorf("signatures key of JSON object is an invalid type")
+	}
+}
+
+// hasSignature returns true if the JSON object _obj has a signature by userID
+// with keyID.  The signature itself isn't verified.
+func hasSignature(_obj interface{}, userID, keyID string) bool {
+	obj, err := jsonObject(_obj)
+	if err != nil {
+		return false
+	}
+	signatures, err := toSignatures(obj["signatures"])
+	if err != nil {
+		return false
+	}
+	_, ok := signatures[userID][keyID]
+	return ok
+}
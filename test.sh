@@ -1,3 +1,6 @@
 #!/bin/sh
 
-CGO_CFLAGS="-I/home/dev/git/olm/include/" CGO_LDFLAGS="-L/home/dev/git/olm/build/" go test -v
+# Run with -olm.writevectors to write the vectors and transcripts of each
+# backend to testdata, where the other backend checks them.
+CGO_CFLAGS="-I/home/dev/git/olm/include/" CGO_LDFLAGS="-L/home/dev/git/olm/build/" go test -v "$@"
+CGO_ENABLED=0 go test -tags goolm -v "$@"
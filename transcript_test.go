@@ -0,0 +1,502 @@
+package olm
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+var transcriptSeed = flag.Int64("olm.seed", 0,
+	"record and replay transcripts with this seed only")
+
+// transcriptRuns is the number of seeds used by TestTranscriptReplay.
+const transcriptRuns = 20
+
+// storedTranscripts is the number of seeds whose transcripts are
+// written to testdata with -olm.writevectors.
+const storedTranscripts = 2
+
+// Only one backend is built at a time, so the backends are compared through
+// transcripts.  A transcript is a randomized conversation run with one
+// backend, with messages delivered out of order, dropped and replayed, and
+// group sessions joined late.  It records every operation with its results
+// and the state of the object afterwards.  Replaying it with another backend
+// must give the same results and, since decryption is deterministic, the same
+// pickles.  Olm encryption is random, so the pickle of the session after
+// encrypting is recorded and loaded by the replaying backend.
+
+// transcriptStep is an operation of a transcript and its results.
+type transcriptStep struct {
+	Op   string `json:"op"`
+	Name string `json:"name"`
+	// From is the account creating an in-bound session.
+	From string `json:"from,omitempty"`
+	// Pickle is the object to load.
+	Pickle    string  `json:"pickle,omitempty"`
+	Key       string  `json:"key,omitempty"`
+	Imported  bool    `json:"imported,omitempty"`
+	Message   string  `json:"message,omitempty"`
+	Type      MsgType `json:"type,omitempty"`
+	Index     uint32  `json:"index,omitempty"`
+	Plaintext string  `json:"plaintext,omitempty"`
+	Result    string  `json:"result,omitempty"`
+	Err       string  `json:"err,omitempty"`
+	// State is the hash of the pickle of the object after the operation.
+	State string `json:"state,omitempty"`
+}
+
+// transcript is a conversation recorded by Backend.
+type transcript struct {
+	Backend string           `json:"backend"`
+	Seed    int64            `json:"seed"`
+	Key     string           `json:"pickle_key"`
+	Steps   []transcriptStep `json:"steps"`
+}
+
+// errString returns the error message of err, or "" for nil.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// pickleState returns the hash of the pickle of an object.
+func pickleState(obj interface{ Pickle([]byte) string }, key []byte) string {
+	sum := sha256.Sum256([]byte(obj.Pickle(key)))
+	return base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// recorder runs randomized conversations with a backend and records them.
+type recorder struct {
+	t   testing.TB
+	rng *rand.Rand
+	b   Backend
+	key []byte
+	tr  *transcript
+}
+
+func newRecorder(t testing.TB, b Backend, seed int64) *recorder {
+	key := fmt.Sprintf("transcript %d", seed)
+	return &recorder{
+		t:   t,
+		rng: rand.New(rand.NewSource(seed)),
+		b:   b,
+		key: []byte(key),
+		tr:  &transcript{Backend: backend, Seed: seed, Key: key},
+	}
+}
+
+// record adds a step to the transcript.
+func (r *recorder) record(step transcriptStep) {
+	r.tr.Steps = append(r.tr.Steps, step)
+}
+
+// plaintext returns a random plain-text for the message n.
+func (r *recorder) plaintext(n int) string {
+	padding := make([]byte, r.rng.Intn(40))
+	for i := range padding {
+		padding[i] = byte('a' + r.rng.Intn(26))
+	}
+	return fmt.Sprintf("%d %s", n, padding)
+}
+
+// newAccount creates an Account with a few one time keys.
+func (r *recorder) newAccount(name string) OlmAccount {
+	a := r.b.NewAccount()
+	a.GenOneTimeKeys(uint(1 + r.rng.Intn(5)))
+	r.record(transcriptStep{Op: "account", Name: name, Pickle: a.Pickle(r.key), Result: a.IdentityKeysJSON() + a.Sign("message")})
+	return a
+}
+
+// sentOlmMessage is a message sent in an Olm conversation.
+type sentOlmMessage struct {
+	to        string
+	msgType   MsgType
+	message   string
+	plaintext string
+}
+
+// encrypt encrypts a message and records the session afterwards, as the
+// ratchet keys are random.
+func (r *recorder) encrypt(sessions map[string]OlmSession, from, to string, n int) *sentOlmMessage {
+	s := sessions[from]
+	plaintext := r.plaintext(n)
+	msgType, message := s.Encrypt(plaintext)
+	r.record(transcriptStep{Op: "session", Name: from, Pickle: s.Pickle(r.key), Type: s.EncryptMsgType(), Result: string(s.ID())})
+	return &sentOlmMessage{to: to, msgType: msgType, message: message, plaintext: plaintext}
+}
+
+// decrypt decrypts a message and records the result.
+func (r *recorder) decrypt(sessions map[string]OlmSession, m *sentOlmMessage) error {
+	s := sessions[m.to]
+	plaintext, err := s.Decrypt(m.message, m.msgType)
+	if err == nil && plaintext != m.plaintext {
+		r.t.Fatalf("%s Decrypt() returned %q, expected %q", m.to, plaintext, m.plaintext)
+	}
+	r.record(transcriptStep{Op: "decrypt", Name: m.to, Message: m.message, Type: m.msgType, Plaintext: plaintext, Err: errString(err), State: pickleState(s, r.key)})
+	return err
+}
+
+// runOlm records an Olm conversation between Alice and Bob.
+func (r *recorder) runOlm() {
+	alice := r.newAccount("Alice")
+	bob := r.newAccount("Bob")
+	var otk Curve25519
+	for _, otk = range bob.OneTimeKeys().Curve25519 {
+	}
+	_, bobKey := bob.IdentityKeys()
+	_, aliceKey := alice.IdentityKeys()
+	outbound, err := alice.NewOutboundSession(bobKey, otk)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	sessions := map[string]OlmSession{"Alice": outbound}
+	first := r.encrypt(sessions, "Alice", "Bob", 0)
+	inbound, err := bob.NewInboundSessionFrom(aliceKey, first.message)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if inbound.ID() != outbound.ID() {
+		r.t.Fatal("Session IDs differ")
+	}
+	r.record(transcriptStep{Op: "inbound_session", Name: "Bob", From: "Bob", Key: string(aliceKey), Message: first.message, Result: string(inbound.ID()), State: pickleState(inbound, r.key)})
+	if err := bob.RemoveOneTimeKeys(inbound); err != nil {
+		r.t.Fatal(err)
+	}
+	r.record(transcriptStep{Op: "remove_one_time_keys", Name: "Bob", State: pickleState(bob, r.key)})
+	sessions["Bob"] = inbound
+
+	inFlight := []*sentOlmMessage{first}
+	var delivered []*sentOlmMessage
+	decrypted := 0
+	for n := 1; n < 200; n++ {
+		switch x := r.rng.Intn(10); {
+		case x < 4:
+			// Send a message, from Alice or Bob.
+			if r.rng.Intn(2) == 0 {
+				inFlight = append(inFlight, r.encrypt(sessions, "Alice", "Bob", n))
+			} else if sessions["Bob"].HasReceivedMessage() {
+				inFlight = append(inFlight, r.encrypt(sessions, "Bob", "Alice", n))
+			}
+		case x < 8 && len(inFlight) > 0:
+			// Deliver a random message, or drop it.
+			i := r.rng.Intn(len(inFlight))
+			m := inFlight[i]
+			inFlight = append(inFlight[:i], inFlight[i+1:]...)
+			if r.rng.Intn(8) == 0 {
+				continue
+			}
+			if r.decrypt(sessions, m) == nil {
+				decrypted++
+			}
+			delivered = append(delivered, m)
+		case x < 9 && len(delivered) > 0:
+			// Replay a delivered message.
+			r.decrypt(sessions, delivered[r.rng.Intn(len(delivered))])
+		default:
+			// Pickle round-trip a session.
+			name := []string{"Alice", "Bob"}[r.rng.Intn(2)]
+			pickled := sessions[name].Pickle(r.key)
+			s, err := r.b.SessionFromPickled(pickled, r.key)
+			if err != nil || s.Pickle(r.key) != pickled {
+				r.t.Fatal(name, "Session pickle round-trip failed", err)
+			}
+			sessions[name] = s
+		}
+	}
+	if decrypted == 0 {
+		r.t.Fatal("No message was decrypted")
+	}
+}
+
+// sentGroupMessage is a message sent in a group conversation.
+type sentGroupMessage struct {
+	index     uint32
+	message   string
+	plaintext string
+}
+
+// receiver is an InboundGroupSession of a group conversation.
+type receiver struct {
+	name  string
+	s     OlmInboundGroupSession
+	first uint32
+}
+
+// newReceiver creates an InboundGroupSession with the session key or export.
+func (r *recorder) newReceiver(name, sessionKey string, imported bool) *receiver {
+	var s OlmInboundGroupSession
+	var err error
+	if imported {
+		s, err = r.b.InboundGroupSessionImport([]byte(sessionKey))
+	} else {
+		s, err = r.b.NewInboundGroupSession([]byte(sessionKey))
+	}
+	if err != nil {
+		r.t.Fatal(name, err)
+	}
+	pickled := s.Pickle(r.key)
+	s, err = r.b.InboundGroupSessionFromPickled(pickled, r.key)
+	if err != nil || s.Pickle(r.key) != pickled {
+		r.t.Fatal(name, "InboundGroupSession pickle round-trip failed", err)
+	}
+	first := uint32(s.FirstKnownIndex())
+	r.record(transcriptStep{Op: "inbound_group", Name: name, Key: sessionKey, Imported: imported, Index: first, State: pickleState(s, r.key)})
+	return &receiver{name: name, s: s, first: first}
+}
+
+// decryptGroup decrypts a group message and records the result.
+func (r *recorder) decryptGroup(g *receiver, m *sentGroupMessage) {
+	plaintext, index, err := g.s.Decrypt(m.message)
+	if m.index < g.first {
+		if errString(err) != "UNKNOWN_MESSAGE_INDEX" {
+			r.t.Fatal(g.name, "Expected UNKNOWN_MESSAGE_INDEX for message", m.index, "got", err)
+		}
+	} else if err != nil || plaintext != m.plaintext || index != m.index {
+		r.t.Fatal(g.name, "Decrypt() failed for message", m.index, plaintext, index, err)
+	}
+	r.record(transcriptStep{Op: "group_decrypt", Name: g.name, Message: m.message, Plaintext: plaintext, Index: index, Err: errString(err), State: pickleState(g.s, r.key)})
+}
+
+// runMegolm records a group conversation with receivers joining late with the
+// session key or an export.
+func (r *recorder) runMegolm() {
+	outbound := r.b.NewOutboundGroupSession()
+	r.record(transcriptStep{Op: "outbound_group", Name: "Outbound", Pickle: outbound.Pickle(r.key), Result: outbound.SessionKey()})
+
+	receivers := []*receiver{r.newReceiver("Receiver 0", outbound.SessionKey(), false)}
+	var messages []*sentGroupMessage
+	type delivery struct {
+		g *receiver
+		m *sentGroupMessage
+	}
+	var inFlight []delivery
+	for n := 0; n < 200; n++ {
+		switch x := r.rng.Intn(10); {
+		case x < 3:
+			// Send a message to all receivers.
+			m := &sentGroupMessage{index: uint32(outbound.MessageIndex()), plaintext: r.plaintext(n)}
+			m.message = outbound.Encrypt(m.plaintext)
+			r.record(transcriptStep{Op: "group_encrypt", Name: "Outbound", Plaintext: m.plaintext, Message: m.message, State: pickleState(outbound, r.key)})
+			messages = append(messages, m)
+			for _, g := range receivers {
+				inFlight = append(inFlight, delivery{g, m})
+			}
+		case x < 7 && len(inFlight) > 0:
+			// Deliver a random message, or drop it.
+			i := r.rng.Intn(len(inFlight))
+			delivery := inFlight[i]
+			inFlight = append(inFlight[:i], inFlight[i+1:]...)
+			if r.rng.Intn(8) != 0 {
+				r.decryptGroup(delivery.g, delivery.m)
+			}
+		case x < 8 && len(messages) > 0:
+			// A late joiner receives an old message, or replays one.
+			r.decryptGroup(receivers[r.rng.Intn(len(receivers))], messages[r.rng.Intn(len(messages))])
+		case x < 9:
+			// A receiver joins with the current session key.
+			name := fmt.Sprintf("Receiver %d", len(receivers))
+			receivers = append(receivers, r.newReceiver(name, outbound.SessionKey(), false))
+		default:
+			// A receiver joins with an export of another receiver.
+			from := receivers[r.rng.Intn(len(receivers))]
+			index := from.first + uint32(r.rng.Intn(int(uint32(outbound.MessageIndex())-from.first)+1))
+			export, err := from.s.Export(index)
+			if err != nil {
+				r.t.Fatal(from.name, "Export() failed", err)
+			}
+			r.record(transcriptStep{Op: "export", Name: from.name, Index: index, Result: export})
+			name := fmt.Sprintf("Receiver %d", len(receivers))
+			receivers = append(receivers, r.newReceiver(name, export, true))
+		}
+	}
+}
+
+// recordTranscript records the Olm and Megolm conversations of a seed with
+// the backend b.
+func recordTranscript(t testing.TB, b Backend, seed int64) *transcript {
+	r := newRecorder(t, b, seed)
+	r.runOlm()
+	r.runMegolm()
+	return r.tr
+}
+
+// replayTranscript replays a transcript with the backend b and checks that
+// every operation gives the recorded results.
+func replayTranscript(t testing.TB, b Backend, tr *transcript) {
+	key := []byte(tr.Key)
+	accounts := map[string]OlmAccount{}
+	sessions := map[string]OlmSession{}
+	outbound := map[string]OlmOutboundGroupSession{}
+	inbound := map[string]OlmInboundGroupSession{}
+	for i, step := range tr.Steps {
+		fail := func(format string, args ...interface{}) {
+			t.Fatalf("Step %d %s of %s recorded by %s: %s", i, step.Op, step.Name, tr.Backend, fmt.Sprintf(format, args...))
+		}
+		switch step.Op {
+		case "account":
+			a, err := b.AccountFromPickled(step.Pickle, key)
+			if err != nil {
+				fail("AccountFromPickled() failed: %v", err)
+			}
+			if a.Pickle(key) != step.Pickle || a.IdentityKeysJSON()+a.Sign("message") != step.Result {
+				fail("Account differs between backends")
+			}
+			accounts[step.Name] = a
+		case "session":
+			s, err := b.SessionFromPickled(step.Pickle, key)
+			if err != nil {
+				fail("SessionFromPickled() failed: %v", err)
+			}
+			if s.Pickle(key) != step.Pickle || string(s.ID()) != step.Result || s.EncryptMsgType() != step.Type {
+				fail("Session differs between backends")
+			}
+			sessions[step.Name] = s
+		case "inbound_session":
+			s, err := accounts[step.From].NewInboundSessionFrom(Curve25519(step.Key), step.Message)
+			if err != nil {
+				fail("NewInboundSessionFrom() failed: %v", err)
+			}
+			if string(s.ID()) != step.Result || pickleState(s, key) != step.State {
+				fail("Session differs between backends")
+			}
+			sessions[step.Name] = s
+		case "remove_one_time_keys":
+			a := accounts[step.Name]
+			if err := a.RemoveOneTimeKeys(sessions[step.Name]); err != nil {
+				fail("RemoveOneTimeKeys() failed: %v", err)
+			}
+			if pickleState(a, key) != step.State {
+				fail("Account differs between backends")
+			}
+		case "decrypt":
+			s := sessions[step.Name]
+			plaintext, err := s.Decrypt(step.Message, step.Type)
+			if plaintext != step.Plaintext || errString(err) != step.Err {
+				fail("Decrypt() returned %q %v, recorded %q %s", plaintext, err, step.Plaintext, step.Err)
+			}
+			if pickleState(s, key) != step.State {
+				fail("Session differs between backends")
+			}
+		case "outbound_group":
+			s, err := b.OutboundGroupSessionFromPickled(step.Pickle, key)
+			if err != nil {
+				fail("OutboundGroupSessionFromPickled() failed: %v", err)
+			}
+			if s.Pickle(key) != step.Pickle || s.SessionKey() != step.Result {
+				fail("OutboundGroupSession differs between backends")
+			}
+			outbound[step.Name] = s
+		case "group_encrypt":
+			// Megolm encryption is deterministic.
+			s := outbound[step.Name]
+			if s.Encrypt(step.Plaintext) != step.Message || pickleState(s, key) != step.State {
+				fail("Encrypt() differs between backends")
+			}
+		case "inbound_group":
+			var s OlmInboundGroupSession
+			var err error
+			if step.Imported {
+				s, err = b.InboundGroupSessionImport([]byte(step.Key))
+			} else {
+				s, err = b.NewInboundGroupSession([]byte(step.Key))
+			}
+			if err != nil {
+				fail("Creating the InboundGroupSession failed: %v", err)
+			}
+			if uint32(s.FirstKnownIndex()) != step.Index || pickleState(s, key) != step.State {
+				fail("InboundGroupSession differs between backends")
+			}
+			inbound[step.Name] = s
+		case "group_decrypt":
+			s := inbound[step.Name]
+			plaintext, index, err := s.Decrypt(step.Message)
+			if plaintext != step.Plaintext || index != step.Index || errString(err) != step.Err {
+				fail("Decrypt() returned %q %d %v, recorded %q %d %s", plaintext, index, err, step.Plaintext, step.Index, step.Err)
+			}
+			if pickleState(s, key) != step.State {
+				fail("InboundGroupSession differs between backends")
+			}
+		case "export":
+			export, err := inbound[step.Name].Export(step.Index)
+			if err != nil || export != step.Result {
+				fail("Export() differs between backends: %v", err)
+			}
+		default:
+			fail("Unknown operation")
+		}
+	}
+}
+
+// transcriptsPath returns the file holding the transcripts recorded by
+// backend b.
+func transcriptsPath(b string) string {
+	return filepath.Join("testdata", "transcripts_"+b+".json")
+}
+
+// runTranscripts records transcripts with a and replays them with b.
+func runTranscripts(t *testing.T, a, b Backend) {
+	seeds := []int64{*transcriptSeed}
+	if *transcriptSeed == 0 {
+		seeds = nil
+		for seed := int64(1); seed <= transcriptRuns; seed++ {
+			seeds = append(seeds, seed)
+		}
+	}
+	for _, seed := range seeds {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			replayTranscript(t, b, recordTranscript(t, a, seed))
+		})
+	}
+}
+
+// TestTranscriptReplay checks that the transcripts of DefaultBackend replay
+// with itself, after a pickle round-trip of every object.  The backends are
+// compared by TestCrossBackendTranscripts.
+func TestTranscriptReplay(t *testing.T) {
+	runTranscripts(t, DefaultBackend, DefaultBackend)
+}
+
+// TestCrossBackendTranscripts replays the transcripts stored in testdata by
+// the other backend, and fails if there are none.  Run with -olm.writevectors
+// to also write the transcripts of the selected backend.
+func TestCrossBackendTranscripts(t *testing.T) {
+	if *writeCrossVectors {
+		var transcripts []*transcript
+		for seed := int64(1); seed <= storedTranscripts; seed++ {
+			transcripts = append(transcripts, recordTranscript(t, DefaultBackend, seed))
+		}
+		data, err := json.Marshal(transcripts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(transcriptsPath(backend), append(data, '\n'), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(transcriptsPath(otherBackend))
+	if err != nil {
+		t.Fatalf("Missing transcripts of %s, write them with -olm.writevectors: %v", otherBackend, err)
+	}
+	var transcripts []*transcript
+	err = json.Unmarshal(data, &transcripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range transcripts {
+		if tr.Backend != otherBackend {
+			t.Fatalf("Transcripts of %s were recorded by %s", otherBackend, tr.Backend)
+		}
+		t.Run(fmt.Sprintf("seed=%d", tr.Seed), func(t *testing.T) {
+			replayTranscript(t, DefaultBackend, tr)
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package olm
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Signatures is the data structure used to sign JSON objects.  It maps from
+// userID to a map from <algorithm:deviceID> to signature.
+type Signatures map[string]map[string]string
+
+// SessionID is the identifier of an Olm/Megolm session
+type SessionID string
+
+// Ed25519 is the base64 representation of an Ed25519 public key
+type Ed25519 string
+
+// Curve25519 is the base64 representation of an Curve25519 public key
+type Curve25519 string
+
+type Algorithm string
+
+const (
+	AlgorithmNone     Algorithm = ""
+	AlgorithmOlmV1    Algorithm = "m.olm.v1.curve25519-aes-sha2"
+	AlgorithmMegolmV1 Algorithm = "m.megolm.v1.aes-sha2"
+)
+
+type MsgType uint
+
+const (
+	MsgTypePreKey MsgType = 0
+	MsgTypeMsg    MsgType = 1
+)
+
+type OTKs struct {
+	Curve25519 map[string]Curve25519 `json:"curve25519"`
+}
+
+// IdentityKeys returns the public parts of the Ed25519 and Curve25519 identity
+// keys for the Account.
+func (a *Account) IdentityKeys() (Ed25519, Curve25519) {
+	identityKeysJSON := a.IdentityKeysJSON()
+	identityKeys := map[string]string{}
+	err := json.Unmarshal([]byte(identityKeysJSON), &identityKeys)
+	if err != nil {
+		panic(err)
+	}
+	return Ed25519(identityKeys["ed25519"]), Curve25519(identityKeys["curve25519"])
+}
+
+// SignJSON signs the JSON object _obj following the Matrix specification:
+// https://matrix.org/speculator/spec/drafts%2Fe2e/appendices.html#signing-json
+// If the _obj is a struct, the `json` tags will be honored.  It can also be a
+// map[string]interface{} or the JSON encoding of the object.  Signatures
+// already in _obj are kept, and _obj doesn't need a signatures key.
+func (a *Account) SignJSON(_obj interface{}, userID, deviceID string) (interface{}, error) {
+	return signJSON(_obj, userID, fmt.Sprintf("ed25519:%s", deviceID), a.Sign)
+}
+
+// VerifySignatureJSON verifies the signature in the JSON object _obj following
+// the Matrix specification:
+// https://matrix.org/speculator/spec/drafts%2Fe2e/appendices.html#signing-json
+// If the _obj is a struct, the `json` tags will be honored.  It can also be a
+// map[string]interface{} or the JSON encoding of the object.
+func (u *Utility) VerifySignatureJSON(_obj interface{}, userID, deviceID string, key Ed25519) (bool, error) {
+	obj, err := jsonObject(_obj)
+	if err != nil {
+		return false, err
+	}
+	_signatures, ok := obj["signatures"]
+	if !ok {
+		return false, fmt.Errorf("JSON object doesn't contain signatures key")
+	}
+	signatures, err := toSignatures(_signatures)
+	if err != nil {
+		return false, err
+	}
+	signatureDevices, ok := signatures[userID]
+	if !ok {
+		return false, fmt.Errorf("JSON object isn't signed by user %s", userID)
+	}
+	signature, ok := signatureDevices[fmt.Sprintf("ed25519:%s", deviceID)]
+	if !ok {
+		return false, fmt.Errorf("JSON object isn't signed by user's device %s", deviceID)
+	}
+	delete(obj, "signatures")
+	delete(obj, "unsigned")
+	objJSON, err := json.Marshal(obj)
+	if err != nil {
+		return false, err
+	}
+	return u.VerifySignature(string(objJSON), key, signature)
+}
+
+// VerifySignatureJSON verifies the signature in the JSON object _obj following
+// the Matrix specification:
+// https://matrix.org/speculator/spec/drafts%2Fe2e/appendices.html#signing-json
+// This function is a wrapper over Utility.VerifySignatureJSON that creates and
+// destroys the Utility object transparently.
+// If the _obj is a struct, the `json` tags will be honored.  It can also be a
+// map[string]interface{} or the JSON encoding of the object.
+func VerifySignatureJSON(_obj interface{}, userID, deviceID string, key Ed25519) (bool, error) {
+	u := NewUtility()
+	defer u.Clear()
+	return u.VerifySignatureJSON(_obj, userID, deviceID, key)
+}
@@ -0,0 +1,165 @@
+package olm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultWedgeThreshold is the number of consecutive BAD_MESSAGE_MAC
+// failures from a sender key after which its sessions are considered wedged.
+const DefaultWedgeThreshold = 3
+
+// DefaultUnwedgeInterval is the minimum time between two attempts to unwedge
+// the sessions with the same device.
+const DefaultUnwedgeInterval = time.Hour
+
+// EventTypeDummy is the type of the event sent on a new Session to replace a
+// wedged one.
+const EventTypeDummy = "m.dummy"
+
+// SessionUnwedger detects wedged Olm sessions from decryption failures and
+// replaces them by creating a new outbound Session and sending an m.dummy
+// event on it.  It is safe for concurrent use.
+type SessionUnwedger struct {
+	// Account is our own device's Account, UserID and DeviceID identify it.
+	Account  *Account
+	UserID   string
+	DeviceID string
+	// Devices is used to find the device of a sender key.
+	Devices *DeviceTracker
+	// Claim claims a one time key for each device with /keys/claim.
+	Claim func(devices []*Device) (*KeysClaimResponse, error)
+	// Send sends the Olm encrypted content to the device as an
+	// m.room.encrypted to-device event.
+	Send func(device *Device, content *OlmEncryptedContent) error
+	// Sessions, if set, stores the new Sessions so they become the preferred
+	// sessions with their devices.
+	Sessions *SessionStore
+	// Threshold is the number of consecutive failures after which the
+	// sessions with a sender key are wedged.  Defaults to
+	// DefaultWedgeThreshold.
+	Threshold int
+	// Interval is the minimum time between two attempts to unwedge the
+	// sessions with the same device.  Defaults to DefaultUnwedgeInterval.
+	Interval time.Duration
+
+	mu       sync.Mutex
+	failures map[Curve25519]int
+	attempts map[Curve25519]time.Time
+	now      func() time.Time
+}
+
+// threshold returns the configured Threshold or its default.
+func (u *SessionUnwedger) threshold() int {
+	if u.Threshold <= 0 {
+		return DefaultWedgeThreshold
+	}
+	return u.Threshold
+}
+
+// interval returns the configured Interval or its default.
+func (u *SessionUnwedger) interval() time.Duration {
+	if u.Interval <= 0 {
+		return DefaultUnwedgeInterval
+	}
+	return u.Interval
+}
+
+// clock returns the current time.
+func (u *SessionUnwedger) clock() time.Time {
+	if u.now != nil {
+		return u.now()
+	}
+	return time.Now()
+}
+
+// RecordFailure records the error returned when decrypting a message from
+// senderKey.  Only "BAD_MESSAGE_MAC" errors count towards the threshold.
+// Returns true if the sessions with senderKey are now wedged.
+func (u *SessionUnwedger) RecordFailure(senderKey Curve25519, err error) bool {
+	if err == nil || err.Error() != "BAD_MESSAGE_MAC" {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.failures == nil {
+		u.failures = map[Curve25519]int{}
+	}
+	u.failures[senderKey]++
+	return u.failures[senderKey] >= u.threshold()
+}
+
+// RecordSuccess resets the failures of senderKey after a message from it was
+// decrypted.
+func (u *SessionUnwedger) RecordSuccess(senderKey Curve25519) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.failures, senderKey)
+}
+
+// IsWedged returns true if the sessions with senderKey are wedged.
+func (u *SessionUnwedger) IsWedged(senderKey Curve25519) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.failures[senderKey] >= u.threshold()
+}
+
+// Unwedge creates a new outbound Session to the device with senderKey and
+// sends an m.dummy event on it, so that the device creates a matching inbound
+// Session.  Attempts for the same device are rate limited to one per
+// Interval.  Returns the new Session, which is added to Sessions if set, or
+// else must be stored by the caller as the preferred session for the device.
+// Returns error on failure.
+func (u *SessionUnwedger) Unwedge(senderKey Curve25519) (*Session, error) {
+	device, ok := u.Devices.LookupSenderKey(senderKey)
+	if !ok {
+		return nil, fmt.Errorf("Unknown sender key %s", senderKey)
+	}
+
+	u.mu.Lock()
+	if last, ok := u.attempts[senderKey]; ok && u.clock().Sub(last) < u.interval() {
+		u.mu.Unlock()
+		return nil, fmt.Errorf("Sessions with device %s of %s were unwedged less than %s ago", device.DeviceID, device.UserID, u.interval())
+	}
+	if u.attempts == nil {
+		u.attempts = map[Curve25519]time.Time{}
+	}
+	u.attempts[senderKey] = u.clock()
+	u.mu.Unlock()
+
+	resp, err := u.Claim([]*Device{device})
+	if err != nil {
+		return nil, err
+	}
+	sessions, failed := u.Account.ClaimSessions(resp, []*Device{device})
+	if err := failed[device.UserID][device.DeviceID]; err != nil {
+		return nil, err
+	}
+	s := sessions[device.UserID][device.DeviceID]
+	content, err := EncryptOlmEvent(u.Account, s, u.UserID, u.DeviceID, device, EventTypeDummy, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	err = u.Send(device, content)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Sessions != nil {
+		u.Sessions.Add(senderKey, s)
+	}
+	u.RecordSuccess(senderKey)
+	return s, nil
+}
+
+// HandleDecryptError records the error returned when decrypting a message
+// from senderKey and unwedges the sessions with it once they are wedged.
+// Returns the new Session if one was created, or nil.  Returns error if
+// unwedging failed.
+func (u *SessionUnwedger) HandleDecryptError(senderKey Curve25519, err error) (*Session, error) {
+	if !u.RecordFailure(senderKey, err) {
+		return nil, nil
+	}
+	return u.Unwedge(senderKey)
+}
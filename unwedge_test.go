@@ -0,0 +1,117 @@
+package olm
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSessionUnwedger(t *testing.T) {
+	alice := NewAccount()
+	bob := NewAccount()
+	bobKeys, err := bob.DeviceKeys("@bob:example.org", "BOB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := NewDeviceTracker()
+	devices.Track("@bob:example.org")
+	devices.Ingest(&KeysQueryResponse{DeviceKeys: map[string]map[string]*DeviceKeys{
+		"@bob:example.org": {"BOB": bobKeys},
+	}})
+	bobOTKs := NewOneTimeKeyManager(bob, "@bob:example.org", "BOB")
+
+	now := time.Unix(1500000000, 0)
+	var sent []*OlmEncryptedContent
+	u := &SessionUnwedger{
+		Account:  alice,
+		UserID:   "@alice:example.org",
+		DeviceID: "ALICE",
+		Devices:  devices,
+		Claim: func(claimed []*Device) (*KeysClaimResponse, error) {
+			keys, err := bobOTKs.Prepare(nil)
+			if err != nil {
+				return nil, err
+			}
+			bobOTKs.Confirm()
+			for keyID, key := range keys {
+				data, err := json.Marshal(key)
+				if err != nil {
+					return nil, err
+				}
+				return &KeysClaimResponse{OneTimeKeys: map[string]map[string]map[string]json.RawMessage{
+					"@bob:example.org": {"BOB": {keyID: data}},
+				}}, nil
+			}
+			return nil, fmt.Errorf("No one time keys")
+		},
+		Send: func(device *Device, content *OlmEncryptedContent) error {
+			sent = append(sent, content)
+			return nil
+		},
+		Threshold: 2,
+		now:       func() time.Time { return now },
+	}
+
+	senderKey := bobKeys.Curve25519()
+	badMAC := fmt.Errorf("BAD_MESSAGE_MAC")
+	if u.RecordFailure(senderKey, fmt.Errorf("BAD_MESSAGE_FORMAT")) {
+		t.Fatal("Only BAD_MESSAGE_MAC should count towards the threshold")
+	}
+	s, err := u.HandleDecryptError(senderKey, badMAC)
+	if err != nil || s != nil {
+		t.Fatal("Session shouldn't be wedged after one failure, got", s, err)
+	}
+	u.RecordSuccess(senderKey)
+	u.RecordFailure(senderKey, badMAC)
+	if u.IsWedged(senderKey) {
+		t.Fatal("RecordSuccess() should reset the failures")
+	}
+	s, err = u.HandleDecryptError(senderKey, badMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s == nil || len(sent) != 1 {
+		t.Fatal("Session should be unwedged after two failures")
+	}
+	if u.IsWedged(senderKey) {
+		t.Fatal("Session shouldn't be wedged after unwedging")
+	}
+
+	// Bob receives the m.dummy event on a new session
+	_, aliceCurve25519 := alice.IdentityKeys()
+	message := sent[0].Ciphertext[senderKey]
+	if sent[0].SenderKey != aliceCurve25519 || message.Type != MsgTypePreKey {
+		t.Fatal("Unexpected m.room.encrypted content", sent[0])
+	}
+	bobSession, err := bob.NewInboundSessionFrom(aliceCurve25519, message.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := DecryptOlmPayload(bob, bobSession, "@bob:example.org", sent[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Type != EventTypeDummy || payload.Sender != "@alice:example.org" {
+		t.Fatal("Unexpected payload", payload)
+	}
+
+	// Unwedging is rate limited
+	u.RecordFailure(senderKey, badMAC)
+	_, err = u.HandleDecryptError(senderKey, badMAC)
+	if err == nil || len(sent) != 1 {
+		t.Fatal("Unwedging twice within the interval should fail")
+	}
+	now = now.Add(DefaultUnwedgeInterval)
+	s, err = u.Unwedge(senderKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s == nil || len(sent) != 2 {
+		t.Fatal("Unwedging after the interval should succeed")
+	}
+
+	if _, err = u.Unwedge("unknown"); err == nil {
+		t.Fatal("Unwedge() of an unknown sender key should fail")
+	}
+}